@@ -1,10 +1,8 @@
 package dilithium
 
 import (
-	"context"
 	"crypto/tls"
 	"encoding/hex"
-	"github.com/lucas-clemente/quic-go"
 	"github.com/openziti/dilithium/cf"
 	"github.com/openziti/dilithium/protocol/westlsworld3"
 	"github.com/openziti/dilithium/protocol/westworld2"
@@ -84,26 +82,7 @@ func ProtocolFor(protocol string) (Protocol, error) {
 		return impl, nil
 
 	case "quic":
-		impl := struct{ ProtoProtocol }{}
-		impl.listen = func(address string) (Accepter, error) {
-			listener, err := quic.ListenAddr(address, generateTLSConfig(), nil)
-			if err != nil {
-				return nil, errors.Wrap(err, "listen")
-			}
-			return &quicAccepter{listener}, nil
-		}
-		impl.dial = func(address string) (net.Conn, error) {
-			session, err := quic.DialAddr(address, generateTLSConfig(), nil)
-			if err != nil {
-				return nil, errors.Wrap(err, "dial")
-			}
-			stream, err := session.OpenStreamSync(context.Background())
-			if err != nil {
-				return nil, errors.Wrap(err, "stream")
-			}
-			return &quicConn{session, stream}, nil
-		}
-		return impl, nil
+		return quicProtocol()
 
 	case "westworld2":
 		cfg := westworld2.NewDefaultConfig()
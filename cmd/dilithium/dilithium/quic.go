@@ -1,12 +1,43 @@
+//go:build !go1.16
+// +build !go1.16
+
 package dilithium
 
 import (
 	"context"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
 	"net"
 	"time"
 )
 
+/*
+ * quicProtocol is only built with go1.15, as quic-go v0.18 depends on qtls-go1-15, which panics at init with any other
+ * version of crypto/tls.
+ */
+func quicProtocol() (Protocol, error) {
+	impl := struct{ ProtoProtocol }{}
+	impl.listen = func(address string) (Accepter, error) {
+		listener, err := quic.ListenAddr(address, generateTLSConfig(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "listen")
+		}
+		return &quicAccepter{listener}, nil
+	}
+	impl.dial = func(address string) (net.Conn, error) {
+		session, err := quic.DialAddr(address, generateTLSConfig(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "dial")
+		}
+		stream, err := session.OpenStreamSync(context.Background())
+		if err != nil {
+			return nil, errors.Wrap(err, "stream")
+		}
+		return &quicConn{session, stream}, nil
+	}
+	return impl, nil
+}
+
 type quicAccepter struct {
 	listener quic.Listener
 }
@@ -0,0 +1,13 @@
+//go:build go1.16
+// +build go1.16
+
+package dilithium
+
+import (
+	"github.com/pkg/errors"
+	"runtime"
+)
+
+func quicProtocol() (Protocol, error) {
+	return nil, errors.Errorf("quic requires go1.15 (built with %s)", runtime.Version())
+}
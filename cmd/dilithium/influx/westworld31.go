@@ -61,15 +61,33 @@ var westworld31Datasets = []string{
 	"tx_keepalive_msgs",
 	"rx_keepalive_bytes",
 	"rx_keepalive_msgs",
+	"tx_pmtu_probe_msgs",
+	"rx_pmtu_probe_msgs",
+	"tx_pmtu_ack_msgs",
+	"rx_pmtu_ack_msgs",
+	"tx_path_challenge_msgs",
+	"rx_path_challenge_msgs",
+	"tx_path_response_msgs",
+	"rx_path_response_msgs",
 	"tx_portal_capacity",
 	"tx_portal_sz",
 	"tx_portal_rx_sz",
+	"tx_portal_pacing_rate",
 	"retx_ms",
 	"retx_scale",
+	"srtt_us",
+	"rttvar_us",
+	"path_mtu",
+	"path_mtu_black_holes",
 	"dup_acks",
+	"fast_retx_msgs",
+	"timed_retx_msgs",
 	"rx_portal_sz",
 	"dup_rx_bytes",
 	"dup_rx_msgs",
+	"hello_retries",
+	"hello_rejected",
+	"migrations",
 	"allocations",
 	"errors",
 }
@@ -2,10 +2,11 @@ package tunnel
 
 import (
 	"github.com/openziti/dilithium/cmd/dilithium/dilithium"
+	"github.com/openziti/dilithium/protocol/westworld3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"io"
 	"net"
+	"sync"
 )
 
 func init() {
@@ -48,55 +49,49 @@ func handleTunnelInitiator(initiator net.Conn, serverAddress string) {
 	logrus.Infof("tunneling for initiator at [%s]", initiator.RemoteAddr())
 	defer logrus.Warnf("end tunnel for initiator at [%s]", initiator.RemoteAddr())
 
-	protocol, err := dilithium.ProtocolFor(dilithium.SelectedProtocol)
-	if err != nil {
-		logrus.Fatalf("error selecting protocol (%v)", err)
-	}
-
-	tunnel, err := protocol.Dial(serverAddress)
+	tunnel, err := dialTunnel(serverAddress)
 	if err != nil {
 		logrus.Errorf("error dialing tunnel server at [%s] (%v)", serverAddress, err)
 		return
 	}
-	go handleTunnelInitiatorReader(initiator, tunnel)
 	defer func() { _ = tunnel.Close() }()
 	logrus.Infof("tunnel established to [%s]", serverAddress)
 
-	buffer := make([]byte, bufferSize)
-	for {
-		n, err := initiator.Read(buffer)
-		if err != nil {
-			logrus.Errorf("error reading from initiator (%v)", err)
-			return
-		}
-		n, err = tunnel.Write(buffer[:n])
-		if err != nil {
-			logrus.Errorf("error writing to tunnel (%v)", err)
-			return
-		}
-	}
+	splice(initiator, tunnel)
 }
 
-func handleTunnelInitiatorReader(initiator net.Conn, tunnel net.Conn) {
-	defer logrus.Warnf("closing")
-	defer func() {
-		_ = tunnel.Close()
-		_ = initiator.Close()
-	}()
+var session *westworld3.Session
+var sessionLock sync.Mutex
 
-	buffer := make([]byte, bufferSize)
-	for {
-		n, err := tunnel.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			logrus.Errorf("error reading from tunnel (%v)", err)
-		}
-		n, err = initiator.Write(buffer[:n])
-		if err != nil {
-			logrus.Errorf("error writing to initiator (%v)", err)
-			return
+/*
+ * dialTunnel connects a new tunnel to the server. When multiplexing, tunnels are streams opened over a single shared
+ * session, which is re-established if it fails.
+ */
+func dialTunnel(serverAddress string) (net.Conn, error) {
+	protocol, err := dilithium.ProtocolFor(dilithium.SelectedProtocol)
+	if err != nil {
+		logrus.Fatalf("error selecting protocol (%v)", err)
+	}
+	if !tunnelMux {
+		return protocol.Dial(serverAddress)
+	}
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if session != nil {
+		if st, err := session.Open(); err == nil {
+			return st, nil
 		}
+		logrus.Warnf("session failed, reconnecting")
+		_ = session.Close()
+		session = nil
+	}
+	conn, err := protocol.Dial(serverAddress)
+	if err != nil {
+		return nil, err
 	}
+	session = westworld3.NewSession(conn, true, westworld3.NewBaselineProfile())
+	logrus.Infof("session established to [%s]", serverAddress)
+	return session.Open()
 }
@@ -2,16 +2,77 @@ package tunnel
 
 import (
 	"github.com/openziti/dilithium/cmd/dilithium/dilithium"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io"
+	"net"
 )
 
 const bufferSize = 16 * 1024
 
 func init() {
+	tunnelCmd.PersistentFlags().BoolVarP(&tunnelMux, "mux", "m", false, "Multiplex initiators as streams over a single connection")
 	dilithium.RootCmd.AddCommand(tunnelCmd)
 }
 
+var tunnelMux bool
+
 var tunnelCmd = &cobra.Command{
 	Use:   "tunnel",
 	Short: "Use a dilithium conduit as a tunnel",
 }
+
+/*
+ * closeWriter is implemented by connections supporting half-close, like *net.TCPConn, and westworld3 connections and
+ * streams.
+ */
+type closeWriter interface {
+	CloseWrite() error
+}
+
+/*
+ * splice copies both directions between a and b until each reaches end of stream. End of stream in one direction is
+ * propagated as a half-close of the other connection, so the other direction keeps flowing. Connections without
+ * half-close support are closed outright. An error in either direction aborts both.
+ */
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pump(a, b)
+	}()
+	pump(b, a)
+	<-done
+}
+
+func pump(dst, src net.Conn) {
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				logrus.Errorf("error writing to [%s] (%v)", dst.RemoteAddr(), err)
+				_ = src.Close()
+				_ = dst.Close()
+				return
+			}
+		}
+		if err == io.EOF {
+			logrus.Infof("end of stream from [%s]", src.RemoteAddr())
+			if cw, ok := dst.(closeWriter); ok {
+				if err := cw.CloseWrite(); err != nil {
+					logrus.Errorf("error half-closing [%s] (%v)", dst.RemoteAddr(), err)
+				}
+			} else {
+				_ = dst.Close()
+			}
+			return
+		}
+		if err != nil {
+			logrus.Errorf("error reading from [%s] (%v)", src.RemoteAddr(), err)
+			_ = src.Close()
+			_ = dst.Close()
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"github.com/openziti/dilithium/cmd/dilithium/dilithium"
+	"github.com/openziti/dilithium/protocol/westworld3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"net"
@@ -42,7 +43,28 @@ func tunnelServer(_ *cobra.Command, args []string) {
 			logrus.Errorf("error accepting tunnel (%v)", err)
 			continue
 		}
-		go handleTunnelTerminator(conn, destinationAddress)
+		if tunnelMux {
+			go handleTunnelSession(conn, destinationAddress)
+		} else {
+			go handleTunnelTerminator(conn, destinationAddress)
+		}
+	}
+}
+
+func handleTunnelSession(conn net.Conn, destinationAddress *net.TCPAddr) {
+	session := westworld3.NewSession(conn, false, westworld3.NewBaselineProfile())
+	defer func() { _ = session.Close() }()
+
+	logrus.Infof("session established for [%s]", conn.RemoteAddr())
+	defer logrus.Warnf("end session for [%s]", conn.RemoteAddr())
+
+	for {
+		tunnel, err := session.Accept()
+		if err != nil {
+			logrus.Errorf("error accepting stream (%v)", err)
+			return
+		}
+		go handleTunnelTerminator(tunnel, destinationAddress)
 	}
 }
 
@@ -57,36 +79,7 @@ func handleTunnelTerminator(tunnel net.Conn, destinationAddress *net.TCPAddr) {
 		logrus.Errorf("error connecting to terminator [%s] (%v)", destinationAddress, err)
 		return
 	}
-	go handleTunnelTerminatorReader(tunnel, terminator)
 	defer func() { _ = terminator.Close() }()
 
-	buffer := make([]byte, bufferSize)
-	for {
-		n, err := tunnel.Read(buffer)
-		if err != nil {
-			logrus.Errorf("error reading from tunnel (%v)", err)
-			return
-		}
-		n, err = terminator.Write(buffer[:n])
-		if err != nil {
-			logrus.Errorf("error writing to terminator (%v)", err)
-			return
-		}
-	}
-}
-
-func handleTunnelTerminatorReader(tunnel net.Conn, terminator net.Conn) {
-	buffer := make([]byte, bufferSize)
-	for {
-		n, err := terminator.Read(buffer)
-		if err != nil {
-			logrus.Errorf("error reading from terminator (%v)", err)
-			return
-		}
-		n, err = tunnel.Write(buffer[:n])
-		if err != nil {
-			logrus.Errorf("error writing to tunnel (%v)", err)
-			return
-		}
-	}
+	splice(tunnel, terminator)
 }
@@ -1,10 +1,12 @@
 package westworld2
 
 import (
+	"bytes"
 	"github.com/emirpasic/gods/trees/btree"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strings"
 	"sync"
 )
 
@@ -35,11 +37,11 @@ func Listen(addr *net.UDPAddr, config *Config) (net.Listener, error) {
 		peers:       btree.NewWith(config.treeLen, addrComparator),
 		acceptQueue: make(chan net.Conn, config.acceptQLen),
 		conn:        conn,
-		addr:        addr,
+		addr:        conn.LocalAddr().(*net.UDPAddr),
 		config:      config,
 	}
 	if config.i != nil {
-		l.ii = config.i.newInstance(addr)
+		l.ii = config.i.newInstance(l.addr)
 	}
 	l.pool = newPool("listener", l.ii)
 	go l.run()
@@ -128,16 +130,15 @@ func (self *listener) hello(hello *wireMessage, peer *net.UDPAddr) {
 	}
 }
 
+/*
+ * addrComparator orders peers by their 16-byte IP representation (so that IPv4 and IPv4-mapped IPv6 forms of the same
+ * address compare equal), then by port, then by IPv6 zone.
+ */
 func addrComparator(i, j interface{}) int {
 	ai := i.(*net.UDPAddr)
 	aj := j.(*net.UDPAddr)
-	for l := 0; l < 4; l++ {
-		if ai.IP[l] < aj.IP[l] {
-			return -1
-		}
-		if ai.IP[l] > aj.IP[l] {
-			return 1
-		}
+	if c := bytes.Compare(ai.IP.To16(), aj.IP.To16()); c != 0 {
+		return c
 	}
 	if ai.Port < aj.Port {
 		return -1
@@ -145,5 +146,5 @@ func addrComparator(i, j interface{}) int {
 	if ai.Port > aj.Port {
 		return 1
 	}
-	return 0
+	return strings.Compare(ai.Zone, aj.Zone)
 }
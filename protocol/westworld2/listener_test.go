@@ -0,0 +1,57 @@
+package westworld2
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestAddrComparator(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6262}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6262}
+	assert.Equal(t, 0, addrComparator(v4, mapped))
+
+	a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6262}
+	b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 6262}
+	assert.Equal(t, -1, addrComparator(a, b))
+	assert.Equal(t, 1, addrComparator(b, a))
+	assert.NotEqual(t, 0, addrComparator(a, v4))
+
+	eth0 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}
+	eth1 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth1"}
+	assert.Equal(t, -1, addrComparator(eth0, eth1))
+	assert.Equal(t, 0, addrComparator(eth0, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}))
+}
+
+/*
+ * TestListenerIPv6 dials a listener over [::1], and checks that the listener tracks the dialer as an IPv6 peer.
+ */
+func TestListenerIPv6(t *testing.T) {
+	probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("ipv6 loopback unavailable (%v)", err)
+	}
+	_ = probe.Close()
+
+	config := NewDefaultConfig()
+	l, err := Listen(&net.UDPAddr{IP: net.IPv6loopback}, config)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	assert.True(t, l.Addr().(*net.UDPAddr).IP.Equal(net.IPv6loopback))
+	assert.NotEqual(t, 0, l.Addr().(*net.UDPAddr).Port)
+
+	conn, err := Dial(l.Addr().(*net.UDPAddr), config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() { _ = conn.Close() }()
+
+	peer := &net.UDPAddr{IP: net.IPv6loopback, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	ll := l.(*listener)
+	ll.lock.Lock()
+	_, found := ll.peers.Get(peer)
+	assert.True(t, found)
+	_, found = ll.peers.Get(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: peer.Port})
+	assert.False(t, found)
+	ll.lock.Unlock()
+}
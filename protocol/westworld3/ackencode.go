@@ -24,6 +24,7 @@ type ack struct {
 }
 
 const ackSeriesMarker = uint8(1 << 7)
+const maxAckSeries = 127
 const sequenceRangeMarker = uint32(1 << 31)
 const sequenceRangeInvert = 0xFFFFFFFF ^ sequenceRangeMarker
 
@@ -31,8 +32,8 @@ func encodeAcks(acks []ack, data []byte) (n uint32, err error) {
 	if len(acks) < 1 {
 		return 0, nil
 	}
-	if len(acks) > 127 {
-		return 0, errors.Errorf("ack series too large [%d > 127]", len(acks))
+	if len(acks) > maxAckSeries {
+		return 0, errors.Errorf("ack series too large [%d > %d]", len(acks), maxAckSeries)
 	}
 
 	dataSz := uint32(len(data))
@@ -78,6 +79,72 @@ func encodeAcks(acks []ack, data []byte) (n uint32, err error) {
 	return i, nil
 }
 
+/*
+ * encodedAcksSz returns the number of bytes encodeAcks will require to encode acks.
+ */
+func encodedAcksSz(acks []ack) uint32 {
+	if len(acks) < 1 {
+		return 0
+	}
+	if len(acks) == 1 && acks[0].start == acks[0].end {
+		return 4
+	}
+	sz := uint32(1)
+	for _, a := range acks {
+		if a.start == a.end {
+			sz += 4
+		} else {
+			sz += 8
+		}
+	}
+	return sz
+}
+
+/*
+ * decodedAcksSz returns the number of bytes occupied by the encoded acks at the start of data, without decoding them.
+ */
+func decodedAcksSz(data []byte) (uint32, error) {
+	dataSz := uint32(len(data))
+	if dataSz < 4 {
+		return 0, errors.Errorf("short ack buffer [%d < 4]", dataSz)
+	}
+	if data[0]&ackSeriesMarker == 0 {
+		return 4, nil
+	}
+	seriesSz := int(data[0] ^ ackSeriesMarker)
+	sz := uint32(1)
+	for i := 0; i < seriesSz; i++ {
+		if sz+4 > dataSz {
+			return 0, errors.Errorf("short ack series buffer [%d < %d]", dataSz, sz+4)
+		}
+		if util.ReadUint32(data[sz:sz+4])&sequenceRangeMarker == sequenceRangeMarker {
+			sz += 4
+		}
+		sz += 4
+	}
+	if sz > dataSz {
+		return 0, errors.Errorf("short ack series buffer [%d < %d]", dataSz, sz)
+	}
+	return sz, nil
+}
+
+/*
+ * appendAck adds seq to a series of acks, extending the last range when seq immediately follows it (across a wrap).
+ */
+func appendAck(acks []ack, seq int32) []ack {
+	if len(acks) > 0 {
+		last := &acks[len(acks)-1]
+		if !seqLess(seq, last.start) && !seqLess(last.end, seq) {
+			return acks
+		}
+		if seq == seqNext(last.end) {
+			last.end = seq
+			return acks
+		}
+	}
+	return append(acks, ack{seq, seq})
+}
+
 func decodeAcks(data []byte) (acks []ack, sz uint32, err error) {
 	dataSz := uint32(len(data))
 	if dataSz < 4 {
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -120,3 +121,33 @@ func BenchmarkAckEncoderDecoder4(b *testing.B)   { benchmarkAckEncoderDecoder(4,
 func BenchmarkAckEncoderDecoder16(b *testing.B)  { benchmarkAckEncoderDecoder(16, b) }
 func BenchmarkAckEncoderDecoder64(b *testing.B)  { benchmarkAckEncoderDecoder(64, b) }
 func BenchmarkAckEncoderDecoder127(b *testing.B) { benchmarkAckEncoderDecoder(127, b) }
+
+func TestAppendAck(t *testing.T) {
+	var acks []ack
+	acks = appendAck(acks, 10)
+	acks = appendAck(acks, 11)
+	acks = appendAck(acks, 12)
+	acks = appendAck(acks, 11)
+	acks = appendAck(acks, 14)
+	acks = appendAck(acks, 15)
+	acks = appendAck(acks, 3)
+	assert.EqualValues(t, []ack{{10, 12}, {14, 15}, {3, 3}}, acks)
+}
+
+func TestAppendAckWrap(t *testing.T) {
+	var acks []ack
+	acks = appendAck(acks, math.MaxInt32-1)
+	acks = appendAck(acks, math.MaxInt32)
+	acks = appendAck(acks, 0)
+	acks = appendAck(acks, 1)
+	acks = appendAck(acks, math.MaxInt32)
+	assert.EqualValues(t, []ack{{math.MaxInt32 - 1, 1}}, acks)
+
+	data := make([]byte, 64)
+	n, err := encodeAcks(acks, data)
+	assert.NoError(t, err)
+	acksOut, sz, err := decodeAcks(data[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, n, sz)
+	assert.EqualValues(t, acks, acksOut)
+}
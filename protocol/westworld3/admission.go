@@ -0,0 +1,101 @@
+package westworld3
+
+import (
+	"net"
+	"time"
+)
+
+/*
+ * AcceptFilter decides whether a listener will admit a connection from peer. It is called from the listener's receive
+ * loop for every admissible HELLO, so it must not block. Listeners created with Listen have *net.UDPAddr peers; those
+ * created with ListenPacket have the addresses of their packet connection.
+ */
+type AcceptFilter func(peer net.Addr) bool
+
+/*
+ * rateLimiter is a set of token buckets, one for each source key, refilling at rate tokens per second up to burst.
+ * Buckets that have refilled completely are indistinguishable from new ones, and are swept once they could have.
+ *
+ * At most maxBuckets sources are tracked. Once full, the limiter fails closed: new sources are refused until a sweep
+ * makes room, so a flood of (possibly spoofed) sources cannot grow it without bound.
+ */
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+	lastSweep  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst, maxBuckets int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		buckets:    make(map[string]*tokenBucket),
+		maxBuckets: maxBuckets,
+	}
+}
+
+func (self *rateLimiter) allow(key string, now time.Time) bool {
+	self.sweep(now)
+
+	b, found := self.buckets[key]
+	if !found {
+		if len(self.buckets) >= self.maxBuckets {
+			return false
+		}
+		b = &tokenBucket{tokens: self.burst, last: now}
+		self.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * self.rate
+	if b.tokens > self.burst {
+		b.tokens = self.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (self *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(self.burst / self.rate * float64(time.Second))
+	if now.Sub(self.lastSweep) < refill {
+		return
+	}
+	for key, b := range self.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(self.buckets, key)
+		}
+	}
+	self.lastSweep = now
+}
+
+/*
+ * addrIP returns the IP address of peer, or nil when its transport has none.
+ */
+func addrIP(peer net.Addr) net.IP {
+	if udpPeer, ok := peer.(*net.UDPAddr); ok {
+		return udpPeer.IP
+	}
+	return nil
+}
+
+/*
+ * subnetKey identifies the subnet of ip, by the v4 or v6 prefix length as appropriate.
+ */
+func subnetKey(ip net.IP, v4Prefix, v6Prefix int) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(v4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(v6Prefix, 128)).String()
+}
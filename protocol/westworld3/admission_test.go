@@ -0,0 +1,120 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3, 16)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, rl.allow("a", now))
+	}
+	assert.False(t, rl.allow("a", now))
+	assert.True(t, rl.allow("b", now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, rl.allow("a", now))
+	assert.False(t, rl.allow("a", now))
+
+	// refilled buckets are swept
+	now = now.Add(2 * time.Second)
+	assert.True(t, rl.allow("c", now))
+	assert.Equal(t, 1, len(rl.buckets))
+}
+
+func TestRateLimiterFull(t *testing.T) {
+	rl := newRateLimiter(2, 3, 2)
+	now := time.Unix(1000, 0)
+
+	// new sources are refused while full; known sources are still limited as usual
+	assert.True(t, rl.allow("a", now))
+	assert.True(t, rl.allow("b", now))
+	assert.False(t, rl.allow("c", now))
+	assert.Equal(t, 2, len(rl.buckets))
+	assert.True(t, rl.allow("a", now))
+
+	// until sweeping makes room
+	now = now.Add(2 * time.Second)
+	assert.True(t, rl.allow("c", now))
+	assert.Equal(t, 1, len(rl.buckets))
+}
+
+func TestSubnetKey(t *testing.T) {
+	assert.Equal(t, "10.1.2.0", subnetKey(net.IPv4(10, 1, 2, 3), 24, 48))
+	assert.Equal(t, subnetKey(net.IPv4(10, 1, 2, 3), 24, 48), subnetKey(net.ParseIP("10.1.2.200").To4(), 24, 48))
+	assert.Equal(t, "2001:db8:1::", subnetKey(net.ParseIP("2001:db8:1:2::3"), 24, 48))
+}
+
+func TestListenerAcceptFilter(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	ci := &recordingInstrument{}
+	GetProfile(profileId).i = ci
+	var filtered int32
+	GetProfile(profileId).SetAcceptFilter(func(peer net.Addr) bool {
+		atomic.AddInt32(&filtered, 1)
+		return !peer.(*net.UDPAddr).IP.IsLoopback()
+	})
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	start := time.Now()
+	_, err = Dial(l.Addr().(*net.UDPAddr), profileId)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), refuseDenied.String())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&filtered))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ci.helloRejected))
+	assert.Equal(t, 0, l.(*listener).peerCount())
+}
+
+func TestListenerMaxPeers(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	GetProfile(profileId).ListenerMaxPeers = 1
+
+	l, _, _ := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	_, err := Dial(l.Addr().(*net.UDPAddr), profileId)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), refuseBusy.String())
+	assert.Equal(t, 1, l.(*listener).peerCount())
+}
+
+func TestListenerHelloRateLimits(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	GetProfile(profileId).ListenerIpHelloRate = 0.01
+	GetProfile(profileId).ListenerIpHelloBurst = 1
+
+	l, _, _ := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	_, err := Dial(l.Addr().(*net.UDPAddr), profileId)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), refuseRateLimited.String())
+
+}
+
+func TestListenerSubnetRateLimit(t *testing.T) {
+	ll := &listener{profile: NewBaselineProfile(), subnetRate: newRateLimiter(0.01, 2, 16)}
+	assert.Equal(t, refuseReason(0), ll.admission(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}))
+	assert.Equal(t, refuseReason(0), ll.admission(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}))
+	assert.Equal(t, refuseRateLimited, ll.admission(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}))
+	assert.Equal(t, refuseReason(0), ll.admission(&net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1}))
+}
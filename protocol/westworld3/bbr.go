@@ -0,0 +1,342 @@
+package westworld3
+
+import (
+	"github.com/sirupsen/logrus"
+	"net"
+	"time"
+)
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBw
+	bbrProbeRtt
+)
+
+func (self bbrMode) String() string {
+	switch self {
+	case bbrStartup:
+		return "STARTUP"
+	case bbrDrain:
+		return "DRAIN"
+	case bbrProbeBw:
+		return "PROBE_BW"
+	case bbrProbeRtt:
+		return "PROBE_RTT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+const (
+	// bbrHighGain is the pacing and window gain used to double the sending rate every round during startup
+	bbrHighGain = 2.885
+	// bbrCwndGain sizes the window to cover delayed and stretched acks while probing bandwidth
+	bbrCwndGain = 2.0
+	// bbrFullBwGrowth is the per-round bandwidth growth below which startup considers the pipe full
+	bbrFullBwGrowth = 1.25
+	// bbrFullBwRounds is the number of rounds without bbrFullBwGrowth after which startup exits
+	bbrFullBwRounds = 3
+	// bbrMinRoundMs bounds the delivery rate sampling interval on paths with a very small RTT
+	bbrMinRoundMs = 5
+	// bbrProbeRttSegments is the window, in segments, used while re-measuring the minimum RTT
+	bbrProbeRttSegments = 4
+)
+
+var bbrProbeBwGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+/*
+ * bbrCongestionController sizes the send window from a model of the path, rather than reacting to loss. Every round
+ * (one minimum RTT) the acknowledged bytes are turned into a delivery rate sample. The bottleneck bandwidth is the
+ * maximum sample over the last BbrBwWindowRounds rounds, and the minimum RTT is the smallest RTT sample seen within
+ * BbrMinRttWindowMs. The window is a multiple of their product (the bandwidth-delay product), and transmission is paced
+ * at a multiple of the bottleneck bandwidth.
+ *
+ * Like BBR, the controller starts up by doubling its rate every round until the bandwidth stops growing, drains the
+ * queue this created, and then cycles its pacing gain to periodically probe for more bandwidth. When the minimum RTT
+ * has not been refreshed within BbrMinRttWindowMs, the window collapses to let queues drain, and the RTT is re-measured
+ * for BbrProbeRttMs once they have.
+ *
+ * Duplicate acks and retransmissions are not treated as congestion signals.
+ */
+type bbrCongestionController struct {
+	mode             bbrMode
+	cwnd             int
+	pacingGain       float64
+	cwndGain         float64
+	bwFilter         *bbrMaxFilter
+	maxBw            int
+	aggFilter        *bbrMaxFilter
+	fullBw           int
+	fullBwCt         int
+	filledPipe       bool
+	minRtt           time.Duration
+	minRttStamp      time.Time
+	probeRtt         time.Duration
+	probeRttEnd      time.Time
+	delivered        int
+	roundStart       time.Time
+	cycleIdx         int
+	inflight         int
+	roundMaxInflight int
+	rxPortalSz       int
+	profile          *Profile
+	peer             net.Addr
+	ii               InstrumentInstance
+	now              func() time.Time
+}
+
+func newBbrCongestionController(profile *Profile, peer net.Addr, ii InstrumentInstance) CongestionController {
+	return &bbrCongestionController{
+		mode:       bbrStartup,
+		cwnd:       profile.TxPortalStartSz,
+		pacingGain: bbrHighGain,
+		cwndGain:   bbrHighGain,
+		bwFilter:   newBbrMaxFilter(profile.BbrBwWindowRounds),
+		aggFilter:  newBbrMaxFilter(profile.BbrBwWindowRounds),
+		minRtt:     -1,
+		rxPortalSz: -1,
+		profile:    profile,
+		peer:       peer,
+		ii:         ii,
+		now:        time.Now,
+	}
+}
+
+func (self *bbrCongestionController) Ack(sz int) {
+	now := self.now()
+	if self.roundStart.IsZero() {
+		self.roundStart = now
+		return
+	}
+	self.delivered += sz
+
+	elapsed := now.Sub(self.roundStart)
+	if elapsed >= self.roundDuration() {
+		/*
+		 * The collapsed probe rtt window says nothing about the bottleneck bandwidth. Rounds which never filled the
+		 * pipe were limited by the sender, and may only raise the estimate.
+		 *
+		 * Acks arriving in bunches stretch a round beyond its expected duration. The stretch is tracked so the window
+		 * can cover the data the path delivers while the acks are delayed.
+		 */
+		bw := int(int64(self.delivered) * int64(time.Second) / int64(elapsed))
+		appLimited := self.roundMaxInflight < self.targetInflight()
+		if self.mode != bbrProbeRtt {
+			if !appLimited || bw > self.maxBw {
+				self.maxBw = int(self.bwFilter.add(int64(bw)))
+			}
+			if !appLimited {
+				self.aggFilter.add(int64(elapsed - self.roundDuration()))
+			}
+		}
+		self.roundMaxInflight = self.inflight
+		self.delivered = 0
+		self.roundStart = now
+		self.round()
+	}
+	self.checkProbeRtt(now)
+	self.updateCwnd()
+}
+
+func (self *bbrCongestionController) DuplicateAck() {}
+
+func (self *bbrCongestionController) Retx() {}
+
+func (self *bbrCongestionController) Rtt(rtt time.Duration) {
+	now := self.now()
+	if self.minRtt < 0 || rtt <= self.minRtt {
+		self.minRtt = rtt
+		self.minRttStamp = now
+	}
+	if self.mode == bbrProbeRtt && !self.probeRttEnd.IsZero() && (self.probeRtt < 0 || rtt < self.probeRtt) {
+		self.probeRtt = rtt
+	}
+}
+
+func (self *bbrCongestionController) RxPortalSz(sz int) {
+	self.rxPortalSz = sz
+}
+
+func (self *bbrCongestionController) Available(txPortalSz, segmentSz int) int {
+	self.inflight = txPortalSz
+	if txPortalSz+segmentSz > self.roundMaxInflight {
+		self.roundMaxInflight = txPortalSz + segmentSz
+	}
+	available := self.cwnd - (txPortalSz + segmentSz)
+	if rxAvailable := self.profile.TxPortalMaxSz - (self.rxPortalSz + segmentSz); rxAvailable < available {
+		available = rxAvailable
+	}
+	return available
+}
+
+func (self *bbrCongestionController) Capacity() int {
+	return self.cwnd
+}
+
+func (self *bbrCongestionController) PacingRate() int {
+	return int(self.pacingGain * float64(self.maxBw))
+}
+
+func (self *bbrCongestionController) round() {
+	switch self.mode {
+	case bbrStartup:
+		self.checkFullBw()
+		if self.filledPipe {
+			self.setMode(bbrDrain, 1/bbrHighGain, bbrHighGain)
+		}
+
+	case bbrDrain:
+		if self.inflight <= self.targetInflight() {
+			self.enterProbeBw()
+		}
+
+	case bbrProbeBw:
+		self.cycleIdx = (self.cycleIdx + 1) % len(bbrProbeBwGains)
+		self.pacingGain = bbrProbeBwGains[self.cycleIdx]
+	}
+}
+
+func (self *bbrCongestionController) checkFullBw() {
+	if float64(self.maxBw) >= float64(self.fullBw)*bbrFullBwGrowth {
+		self.fullBw = self.maxBw
+		self.fullBwCt = 0
+		return
+	}
+	self.fullBwCt++
+	if self.fullBwCt >= bbrFullBwRounds {
+		self.filledPipe = true
+	}
+}
+
+func (self *bbrCongestionController) checkProbeRtt(now time.Time) {
+	if self.mode != bbrProbeRtt && !self.minRttStamp.IsZero() && now.Sub(self.minRttStamp) > time.Duration(self.profile.BbrMinRttWindowMs)*time.Millisecond {
+		self.setMode(bbrProbeRtt, 1, 1)
+		self.probeRtt = -1
+		self.probeRttEnd = time.Time{}
+		return
+	}
+	if self.mode != bbrProbeRtt {
+		return
+	}
+	// samples taken before the queue drains measure the queue, not the path; time the probe from the drain
+	if self.probeRttEnd.IsZero() {
+		if self.inflight <= bbrProbeRttSegments*self.profile.MaxSegmentSz {
+			self.probeRttEnd = now.Add(time.Duration(self.profile.BbrProbeRttMs) * time.Millisecond)
+		}
+		return
+	}
+	if !now.Before(self.probeRttEnd) {
+		if self.probeRtt >= 0 {
+			self.minRtt = self.probeRtt
+		}
+		self.minRttStamp = now
+		if self.filledPipe {
+			self.enterProbeBw()
+		} else {
+			self.setMode(bbrStartup, bbrHighGain, bbrHighGain)
+		}
+	}
+}
+
+func (self *bbrCongestionController) enterProbeBw() {
+	self.cycleIdx = 0
+	self.setMode(bbrProbeBw, bbrProbeBwGains[0], bbrCwndGain)
+}
+
+func (self *bbrCongestionController) setMode(mode bbrMode, pacingGain, cwndGain float64) {
+	if mode != self.mode {
+		logrus.Debugf("[%s] bbr %s -> %s (bw %d, min rtt %v)", self.peer, self.mode, mode, self.maxBw, self.minRtt)
+	}
+	self.mode = mode
+	self.pacingGain = pacingGain
+	self.cwndGain = cwndGain
+}
+
+func (self *bbrCongestionController) updateCwnd() {
+	var cwnd int
+	switch {
+	case self.mode == bbrProbeRtt:
+		cwnd = bbrProbeRttSegments * self.profile.MaxSegmentSz
+
+	case self.maxBw == 0:
+		cwnd = self.cwnd
+
+	default:
+		cwnd = int(self.cwndGain*float64(self.bdp())) + self.extraAcked()
+		if self.mode == bbrStartup && cwnd < self.cwnd {
+			cwnd = self.cwnd
+		}
+		if cwnd < self.profile.TxPortalMinSz {
+			cwnd = self.profile.TxPortalMinSz
+		}
+	}
+	if cwnd > self.profile.TxPortalMaxSz {
+		cwnd = self.profile.TxPortalMaxSz
+	}
+	if cwnd != self.cwnd {
+		self.cwnd = cwnd
+		self.ii.TxPortalCapacityChanged(self.peer, self.cwnd)
+	}
+}
+
+/*
+ * bdp is the bandwidth-delay product of the current path model, in bytes. Without RttProbeWide, loopback and LAN paths
+ * frequently measure a minimum RTT of 0 at millisecond resolution, so a zero RTT is taken as 1ms.
+ */
+func (self *bbrCongestionController) bdp() int {
+	minRtt := self.minRtt
+	if minRtt < 1 {
+		minRtt = time.Millisecond
+	}
+	return int(int64(self.maxBw) * int64(minRtt) / int64(time.Second))
+}
+
+/*
+ * targetInflight is the data the path holds without queueing: the bandwidth-delay product, plus what the path delivers
+ * while acks are held back.
+ */
+func (self *bbrCongestionController) targetInflight() int {
+	return self.bdp() + self.extraAcked()
+}
+
+func (self *bbrCongestionController) extraAcked() int {
+	return int(int64(self.maxBw) * self.aggFilter.max / int64(time.Second))
+}
+
+func (self *bbrCongestionController) roundDuration() time.Duration {
+	if self.minRtt > bbrMinRoundMs*time.Millisecond {
+		return self.minRtt
+	}
+	return bbrMinRoundMs * time.Millisecond
+}
+
+/*
+ * bbrMaxFilter tracks the maximum of the last len(samples) values added.
+ */
+type bbrMaxFilter struct {
+	samples []int64
+	idx     int
+	max     int64
+}
+
+func newBbrMaxFilter(sz int) *bbrMaxFilter {
+	if sz < 1 {
+		sz = 1
+	}
+	return &bbrMaxFilter{samples: make([]int64, sz)}
+}
+
+func (self *bbrMaxFilter) add(v int64) int64 {
+	self.samples[self.idx] = v
+	self.idx = (self.idx + 1) % len(self.samples)
+	self.max = 0
+	for _, sample := range self.samples {
+		if sample > self.max {
+			self.max = sample
+		}
+	}
+	return self.max
+}
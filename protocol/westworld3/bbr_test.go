@@ -0,0 +1,179 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBbrModel(t *testing.T) {
+	cc, clock := newTestBbr()
+	cc.Rtt(20 * time.Millisecond)
+
+	// 10 MB/s bottleneck, acked every millisecond
+	for i := 0; i < 20*20; i++ {
+		clock.advance(time.Millisecond)
+		cc.Ack(10 * 1000)
+		cc.Available(0, 0)
+	}
+	assert.Equal(t, 10*1000*1000, cc.maxBw)
+	assert.Equal(t, 20*time.Millisecond, cc.minRtt)
+	assert.Equal(t, 200*1000, cc.bdp())
+	assert.True(t, cc.filledPipe)
+	assert.Equal(t, bbrProbeBw, cc.mode)
+	assert.Equal(t, int(bbrCwndGain*200*1000), cc.cwnd)
+	assert.Equal(t, int(cc.pacingGain*10*1000*1000), cc.PacingRate())
+
+	// losses do not shrink the model
+	for i := 0; i < 1000; i++ {
+		cc.DuplicateAck()
+		cc.Retx()
+	}
+	assert.Equal(t, int(bbrCwndGain*200*1000), cc.cwnd)
+
+	// wide probes resolve sub-millisecond paths; only a 0 rtt is taken as 1ms
+	cc.Rtt(250 * time.Microsecond)
+	assert.Equal(t, 250*time.Microsecond, cc.minRtt)
+	assert.Equal(t, 2500, cc.bdp())
+	cc.Rtt(0)
+	assert.Equal(t, 10*1000, cc.bdp())
+}
+
+func TestBbrStartupGrowth(t *testing.T) {
+	cc, clock := newTestBbr()
+	cc.Rtt(10 * time.Millisecond)
+
+	// delivery rate doubles every round, so startup continues
+	rate := 1000
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 10; i++ {
+			clock.advance(time.Millisecond)
+			cc.Ack(rate)
+		}
+		rate *= 2
+	}
+	assert.Equal(t, bbrStartup, cc.mode)
+	assert.False(t, cc.filledPipe)
+	assert.Equal(t, int(bbrHighGain*float64(cc.maxBw)), cc.PacingRate())
+	assert.True(t, cc.cwnd >= cc.profile.TxPortalStartSz)
+}
+
+func TestBbrProbeRtt(t *testing.T) {
+	cc, clock := newTestBbr()
+	cc.Rtt(20 * time.Millisecond)
+	for i := 0; i < 20*20; i++ {
+		clock.advance(time.Millisecond)
+		cc.Ack(10 * 1000)
+		cc.Available(0, 0)
+	}
+	assert.Equal(t, bbrProbeBw, cc.mode)
+
+	// queueing inflates the RTT; the minimum expires and is re-measured
+	clock.advance(time.Duration(cc.profile.BbrMinRttWindowMs) * time.Millisecond)
+	cc.Rtt(40 * time.Millisecond)
+	cc.Ack(10 * 1000)
+	assert.Equal(t, bbrProbeRtt, cc.mode)
+	assert.Equal(t, bbrProbeRttSegments*cc.profile.MaxSegmentSz, cc.cwnd)
+
+	// samples behind the queue are ignored, and the probe is timed from the drain
+	cc.Available(400*1000, 0)
+	cc.Rtt(500 * time.Millisecond)
+	clock.advance(time.Duration(cc.profile.BbrProbeRttMs) * time.Millisecond)
+	cc.Ack(10 * 1000)
+	assert.Equal(t, bbrProbeRtt, cc.mode)
+
+	cc.Available(0, 0)
+	cc.Ack(10 * 1000)
+	cc.Rtt(30 * time.Millisecond)
+	clock.advance(time.Duration(cc.profile.BbrProbeRttMs) * time.Millisecond)
+	cc.Ack(10 * 1000)
+	assert.Equal(t, bbrProbeBw, cc.mode)
+	assert.Equal(t, 30*time.Millisecond, cc.minRtt)
+}
+
+func TestBbrAppLimited(t *testing.T) {
+	cc, clock := newTestBbr()
+	cc.Rtt(20 * time.Millisecond)
+	for i := 0; i < 20*20; i++ {
+		clock.advance(time.Millisecond)
+		cc.Ack(10 * 1000)
+		cc.Available(400*1000, 0)
+	}
+	assert.Equal(t, 10*1000*1000, cc.maxBw)
+
+	// the sender only keeps a trickle in flight; the estimate must not decay
+	for i := 0; i < 20*cc.profile.BbrBwWindowRounds*2; i++ {
+		clock.advance(time.Millisecond)
+		cc.Ack(100)
+		cc.Available(1000, 0)
+	}
+	assert.Equal(t, 10*1000*1000, cc.maxBw)
+}
+
+func TestBbrAckAggregation(t *testing.T) {
+	cc, clock := newTestBbr()
+	cc.Rtt(20 * time.Millisecond)
+	for i := 0; i < 20*20; i++ {
+		clock.advance(time.Millisecond)
+		cc.Ack(10 * 1000)
+		cc.Available(400*1000, 0)
+	}
+	assert.Equal(t, 0, cc.extraAcked())
+	roundStart := cc.roundStart
+
+	// acks held back well past the end of the round, then delivered together
+	clock.advance(50 * time.Millisecond)
+	cc.Ack(500 * 1000)
+	assert.Equal(t, int64(clock.t.Sub(roundStart)-20*time.Millisecond), cc.aggFilter.max)
+	assert.True(t, cc.extraAcked() > 0)
+	assert.Equal(t, int(bbrCwndGain*float64(cc.bdp()))+cc.extraAcked(), cc.cwnd)
+}
+
+func TestBbrTransfer(t *testing.T) {
+	profileId := registerTestProfile(t)
+	profile := GetProfile(profileId)
+	profile.CongestionController = "bbr"
+	profile.RetxAddMs = 50
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+	_, isBbr := conn.(*dialerConn).txPortal.cc.(*bbrCongestionController)
+	assert.True(t, isBbr)
+
+	data := make([]byte, 4*1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() { _, _ = conn.Write(data) }()
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf)
+
+	txp := conn.(*dialerConn).txPortal
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	assert.True(t, txp.cc.(*bbrCongestionController).maxBw > 0)
+}
+
+func newTestBbr() (*bbrCongestionController, *testClock) {
+	profile := NewBaselineProfile()
+	clock := &testClock{t: time.Unix(1000, 0)}
+	cc := newBbrCongestionController(profile, nil, NewNilInstrument().NewInstance("test", nil)).(*bbrCongestionController)
+	cc.now = clock.now
+	return cc, clock
+}
+
+type testClock struct {
+	t time.Time
+}
+
+func (self *testClock) now() time.Time {
+	return self.t
+}
+
+func (self *testClock) advance(d time.Duration) {
+	self.t = self.t.Add(d)
+}
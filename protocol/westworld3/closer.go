@@ -3,6 +3,7 @@ package westworld3
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
@@ -20,6 +21,8 @@ type closer struct {
 	lastEvent    time.Time
 	profile      *Profile
 	closeHook    func()
+	closeOnce    sync.Once
+	closed       chan struct{}
 }
 
 func newCloser(seq *util.Sequence, profile *Profile, closeHook func()) *closer {
@@ -31,29 +34,35 @@ func newCloser(seq *util.Sequence, profile *Profile, closeHook func()) *closer {
 		txCloseSeqIn: make(chan int32, 1),
 		profile:      profile,
 		closeHook:    closeHook,
+		closed:       make(chan struct{}),
 	}
 }
 
 func (self *closer) emergencyStop() {
 	logrus.Infof("broken glass")
-
-	self.txPortal.close()
-	self.rxPortal.close()
-
-	if self.closeHook != nil {
-		self.closeHook()
-	}
+	self.shutdown()
 }
 
 func (self *closer) timeout() {
 	logrus.Infof("timeout")
+	self.shutdown()
+}
 
-	self.txPortal.close()
-	self.rxPortal.close()
+/*
+ * shutdown releases the portals and invokes the close hook exactly once, regardless of whether the close handshake
+ * completed, the connection timed out, or the connection was torn down by an emergency stop.
+ */
+func (self *closer) shutdown() {
+	self.closeOnce.Do(func() {
+		self.txPortal.close()
+		self.rxPortal.close()
+
+		if self.closeHook != nil {
+			self.closeHook()
+		}
 
-	if self.closeHook != nil {
-		self.closeHook()
-	}
+		close(self.closed)
+	})
 }
 
 func (self *closer) run() {
@@ -93,6 +102,10 @@ closeWait:
 				break closeWait
 			}
 
+		case <-self.closed:
+			logrus.Info("already closed")
+			return
+
 		case <-time.After(time.Duration(self.profile.CloseCheckMs) * time.Millisecond):
 			if self.readyToClose() {
 				break closeWait
@@ -101,12 +114,7 @@ closeWait:
 	}
 	logrus.Info("ready to close")
 
-	self.txPortal.close()
-	self.rxPortal.close()
-
-	if self.closeHook != nil {
-		self.closeHook()
-	}
+	self.shutdown()
 
 	logrus.Info("close complete")
 }
@@ -0,0 +1,189 @@
+package westworld3
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * CongestionController decides how much data a txPortal may have outstanding. The txPortal reports acknowledgement, loss,
+ * RTT and receiver portal size events as they occur, and asks Available before transmitting each segment. Every call is
+ * made while holding the txPortal lock, so implementations do not need to synchronize internally.
+ */
+type CongestionController interface {
+	// Ack reports that sz bytes were acknowledged by the peer for the first time.
+	Ack(sz int)
+	// DuplicateAck reports an acknowledgement for data which was already acknowledged.
+	DuplicateAck()
+	// Retx reports a timed retransmission, which is taken as a loss signal.
+	Retx()
+	// Rtt reports a round-trip time sample, at the resolution of the connection's rtt probes.
+	Rtt(rtt time.Duration)
+	// RxPortalSz reports the size of the peer's receive portal.
+	RxPortalSz(sz int)
+	// Available returns the remaining send window in bytes, after sending segmentSz with txPortalSz bytes outstanding.
+	// The txPortal blocks while the result is negative.
+	Available(txPortalSz, segmentSz int) int
+}
+
+/*
+ * CongestionWindow is implemented by congestion controllers which can report their current send window in bytes. With
+ * TxPortalPacing, the txPortal spreads that window across the smoothed rtt; controllers without it are not paced by
+ * TxPortalPacing.
+ */
+type CongestionWindow interface {
+	Capacity() int
+}
+
+/*
+ * CongestionPacer is implemented by congestion controllers which also pace transmission. PacingRate returns the current
+ * sending rate in bytes per second, or 0 to send as quickly as the window allows. A controller's own pacing rate takes
+ * precedence over TxPortalPacing.
+ */
+type CongestionPacer interface {
+	PacingRate() int
+}
+
+const (
+	// pacingQuantum is the smallest delay the txPortal will sleep for when pacing, and how long a paced sender may go
+	// without transmitting, other than while sleeping for its schedule, before it is considered idle
+	pacingQuantum = time.Millisecond
+	// pacingMaxDebt is how far a paced sender may fall behind its schedule, oversleeping, and still catch up with a burst
+	pacingMaxDebt = 25 * time.Millisecond
+)
+
+type CongestionControllerFactory func(profile *Profile, peer net.Addr, ii InstrumentInstance) CongestionController
+
+var congestionControllers = map[string]CongestionControllerFactory{
+	"baseline": newBaselineCongestionController,
+	"bbr":      newBbrCongestionController,
+	"ledbat":   newLedbatCongestionController,
+}
+var congestionControllersLock sync.Mutex
+
+/*
+ * RegisterCongestionController makes a congestion controller available to profiles under name, through the
+ * 'congestion_controller' setting.
+ */
+func RegisterCongestionController(name string, factory CongestionControllerFactory) error {
+	congestionControllersLock.Lock()
+	defer congestionControllersLock.Unlock()
+
+	if _, found := congestionControllers[name]; found {
+		return errors.Errorf("congestion controller '%s' already registered", name)
+	}
+	congestionControllers[name] = factory
+	return nil
+}
+
+func newCongestionController(name string, profile *Profile, peer net.Addr, ii InstrumentInstance) (CongestionController, error) {
+	factory, err := congestionControllerFactory(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(profile, peer, ii), nil
+}
+
+func congestionControllerFactory(name string) (CongestionControllerFactory, error) {
+	congestionControllersLock.Lock()
+	defer congestionControllersLock.Unlock()
+
+	if factory, found := congestionControllers[name]; found {
+		return factory, nil
+	}
+	return nil, errors.Errorf("unknown congestion controller '%s'", name)
+}
+
+/*
+ * baselineCongestionController is the original westworld3 capacity algorithm. Capacity grows by a scaled portion of the
+ * acknowledged bytes every TxPortalIncreaseThresh successful acks, and shrinks by a fixed scale after
+ * TxPortalDupAckThresh duplicate acks or TxPortalRetxThresh retransmissions. The peer's receive portal size exerts
+ * additional back-pressure on the available window.
+ */
+type baselineCongestionController struct {
+	capacity     int
+	rxPortalSz   int
+	successCt    int
+	successAccum int
+	dupAckCt     int
+	retxCt       int
+	profile      *Profile
+	peer         net.Addr
+	ii           InstrumentInstance
+}
+
+func newBaselineCongestionController(profile *Profile, peer net.Addr, ii InstrumentInstance) CongestionController {
+	return &baselineCongestionController{
+		capacity:   profile.TxPortalStartSz,
+		rxPortalSz: -1,
+		profile:    profile,
+		peer:       peer,
+		ii:         ii,
+	}
+}
+
+func (self *baselineCongestionController) Ack(sz int) {
+	self.successCt++
+	self.successAccum += sz
+	if self.successCt == self.profile.TxPortalIncreaseThresh {
+		newCapacity := self.capacity + int(float64(self.successAccum)*self.profile.TxPortalIncreaseScale)
+		self.updateCapacity(newCapacity)
+		self.successCt = 0
+		self.successAccum = 0
+	}
+}
+
+func (self *baselineCongestionController) DuplicateAck() {
+	self.dupAckCt++
+	self.successCt = 0
+	if self.dupAckCt >= self.profile.TxPortalDupAckThresh {
+		newCapacity := int(float64(self.capacity) * self.profile.TxPortalDupAckCapacityScale)
+		self.updateCapacity(newCapacity)
+		self.dupAckCt = 0
+		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalDupAckSuccessScale)
+	}
+}
+
+func (self *baselineCongestionController) Retx() {
+	self.retxCt++
+	self.successCt = 0
+	if self.retxCt >= self.profile.TxPortalRetxThresh {
+		newCapacity := int(float64(self.capacity) * self.profile.TxPortalRetxCapacityScale)
+		self.updateCapacity(newCapacity)
+		self.retxCt = 0
+		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalRetxSuccessScale)
+	}
+}
+
+func (self *baselineCongestionController) Rtt(time.Duration) {}
+
+func (self *baselineCongestionController) RxPortalSz(sz int) {
+	self.rxPortalSz = sz
+}
+
+func (self *baselineCongestionController) Available(txPortalSz, segmentSz int) int {
+	txPortalCapacity := float64(self.capacity - int(float64(self.rxPortalSz)*self.profile.TxPortalRxSzPressureScale) - (txPortalSz + segmentSz))
+	rxPortalCapacity := float64(self.capacity - (self.rxPortalSz + segmentSz))
+	return int(math.Min(txPortalCapacity, rxPortalCapacity))
+}
+
+func (self *baselineCongestionController) Capacity() int {
+	return self.capacity
+}
+
+func (self *baselineCongestionController) updateCapacity(newCapacity int) {
+	oldCapacity := self.capacity
+	self.capacity = newCapacity
+	if self.capacity < self.profile.TxPortalMinSz {
+		self.capacity = self.profile.TxPortalMinSz
+	}
+	if self.capacity > self.profile.TxPortalMaxSz {
+		self.capacity = self.profile.TxPortalMaxSz
+	}
+	if self.capacity != oldCapacity {
+		self.ii.TxPortalCapacityChanged(self.peer, self.capacity)
+	}
+}
@@ -0,0 +1,107 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBaselineCongestionController(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.TxPortalStartSz = 64 * 1024
+	profile.TxPortalIncreaseThresh = 2
+	profile.TxPortalDupAckThresh = 2
+	profile.TxPortalRetxThresh = 2
+	cc := newBaselineCongestionController(profile, nil, NewNilInstrument().NewInstance("test", nil)).(*baselineCongestionController)
+
+	cc.RxPortalSz(0)
+	assert.Equal(t, 64*1024-1024, cc.Available(0, 1024))
+
+	cc.Ack(1024)
+	assert.Equal(t, 64*1024, cc.capacity)
+	cc.Ack(1024)
+	assert.Equal(t, 66*1024, cc.capacity)
+
+	cc.DuplicateAck()
+	cc.DuplicateAck()
+	assert.Equal(t, int(66*1024*profile.TxPortalDupAckCapacityScale), cc.capacity)
+
+	capacity := cc.capacity
+	cc.Retx()
+	cc.Retx()
+	assert.Equal(t, int(float64(capacity)*profile.TxPortalRetxCapacityScale), cc.capacity)
+
+	for i := 0; i < 100; i++ {
+		cc.Retx()
+	}
+	assert.Equal(t, profile.TxPortalMinSz, cc.capacity)
+
+	// peer receive portal pressure reduces the available window
+	cc.RxPortalSz(1024)
+	assert.True(t, cc.Available(0, 1024) < cc.capacity-2*1024)
+}
+
+func TestRegisterCongestionController(t *testing.T) {
+	ec := &eventCongestionController{window: 4096}
+	name := "test_events"
+	assert.NoError(t, RegisterCongestionController(name, func(*Profile, net.Addr, InstrumentInstance) CongestionController {
+		return ec
+	}))
+	defer func() {
+		congestionControllersLock.Lock()
+		delete(congestionControllers, name)
+		congestionControllersLock.Unlock()
+	}()
+	assert.Error(t, RegisterCongestionController(name, newBaselineCongestionController))
+
+	profile := NewBaselineProfile()
+	profile.RetxStartMs = 60000
+	profile.RttProbeMs = 60000
+	profile.CongestionController = name
+	profile.i = NewNilInstrument()
+	txp, seq := newTestTxPortalProfile(t, profile)
+	assert.Equal(t, ec, txp.cc)
+
+	for i := 0; i < 4; i++ {
+		_, err := txp.tx(make([]byte, 1024), seq)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, txp.ack([]ack{{0, 1}}))
+	assert.NoError(t, txp.ack([]ack{{1, 1}}))
+	txp.updateRxPortalSz(512)
+	// a wide probe, stamped 1.25ms ago, reaches the controller without being truncated to the millisecond
+	txp.rttClock.epoch = time.Now().Add(-time.Second)
+	txp.rtt(*txp.rttClock.probe(true, time.Now().Add(-1250*time.Microsecond)))
+
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	assert.Equal(t, 2048, ec.acked)
+	assert.Equal(t, 1, ec.dupAcks)
+	assert.Equal(t, 512, ec.rxPortalSz)
+	assert.Equal(t, 1, ec.rtts)
+	assert.True(t, ec.rtt >= 1250*time.Microsecond)
+	assert.Equal(t, 2048, txp.txPortalSz)
+}
+
+type eventCongestionController struct {
+	window     int
+	acked      int
+	dupAcks    int
+	retxs      int
+	rtts       int
+	rtt        time.Duration
+	rxPortalSz int
+}
+
+func (self *eventCongestionController) Ack(sz int)    { self.acked += sz }
+func (self *eventCongestionController) DuplicateAck() { self.dupAcks++ }
+func (self *eventCongestionController) Retx()         { self.retxs++ }
+func (self *eventCongestionController) Rtt(rtt time.Duration) {
+	self.rtts++
+	self.rtt = rtt
+}
+func (self *eventCongestionController) RxPortalSz(sz int) { self.rxPortalSz = sz }
+func (self *eventCongestionController) Available(txPortalSz, segmentSz int) int {
+	return self.window - (txPortalSz + segmentSz)
+}
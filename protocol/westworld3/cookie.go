@@ -0,0 +1,89 @@
+package westworld3
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+const (
+	cookieTsSz  = 4
+	cookieMacSz = 12
+	cookieSz    = cookieTsSz + cookieMacSz
+)
+
+var errCookieExpired = errors.New("cookie expired")
+
+/*
+ * cookieMinter issues the stateless address validation cookies a listener requires in HELLOs before it creates any
+ * per-peer state. A cookie is a millisecond timestamp and a truncated HMAC over that timestamp and the peer's address,
+ * keyed by a secret that never leaves the listener. The retry carrying a cookie is smaller than 3 times the smallest
+ * HELLO, so a spoofed HELLO is never amplified beyond that.
+ */
+type cookieMinter struct {
+	secret   []byte
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+func newCookieMinter(lifetimeMs int) (*cookieMinter, error) {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "cookie secret")
+	}
+	return &cookieMinter{
+		secret:   secret,
+		lifetime: time.Duration(lifetimeMs) * time.Millisecond,
+		now:      time.Now,
+	}, nil
+}
+
+func (self *cookieMinter) mint(peer net.Addr) []byte {
+	cookie := make([]byte, cookieSz)
+	util.WriteUint32(cookie, self.nowMs())
+	copy(cookie[cookieTsSz:], self.mac(cookie[:cookieTsSz], peer))
+	return cookie
+}
+
+/*
+ * validate returns errCookieExpired for an authentic cookie older than its lifetime, so that the peer can be issued a
+ * fresh one.
+ */
+func (self *cookieMinter) validate(cookie []byte, peer net.Addr) error {
+	if len(cookie) != cookieSz {
+		return errors.Errorf("invalid cookie size [%d]", len(cookie))
+	}
+	if !hmac.Equal(cookie[cookieTsSz:], self.mac(cookie[:cookieTsSz], peer)) {
+		return errors.New("invalid cookie")
+	}
+	// wraps every ~49 days; a timestamp from the future also appears expired
+	ageMs := self.nowMs() - util.ReadUint32(cookie)
+	if time.Duration(ageMs)*time.Millisecond > self.lifetime {
+		return errCookieExpired
+	}
+	return nil
+}
+
+func (self *cookieMinter) mac(ts []byte, peer net.Addr) []byte {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write(ts)
+	if udpPeer, ok := peer.(*net.UDPAddr); ok {
+		port := make([]byte, 2)
+		util.WriteUint16(port, uint16(udpPeer.Port))
+		mac.Write(udpPeer.IP.To16())
+		mac.Write(port)
+		mac.Write([]byte(udpPeer.Zone))
+	} else {
+		mac.Write([]byte(peer.Network()))
+		mac.Write([]byte(peer.String()))
+	}
+	return mac.Sum(nil)[:cookieMacSz]
+}
+
+func (self *cookieMinter) nowMs() uint32 {
+	return uint32(self.now().UnixNano() / int64(time.Millisecond))
+}
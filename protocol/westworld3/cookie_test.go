@@ -0,0 +1,121 @@
+package westworld3
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCookieMinter(t *testing.T) {
+	cm, err := newCookieMinter(10000)
+	assert.NoError(t, err)
+	clock := &testClock{t: time.Unix(1000, 0)}
+	cm.now = clock.now
+
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6262}
+	cookie := cm.mint(peer)
+	assert.Equal(t, cookieSz, len(cookie))
+	assert.NoError(t, cm.validate(cookie, peer))
+	assert.NoError(t, cm.validate(cookie, &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6262}))
+
+	// bound to the peer address
+	assert.Error(t, cm.validate(cookie, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6262}))
+	assert.Error(t, cm.validate(cookie, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6263}))
+
+	// forged timestamp
+	forged := append([]byte{}, cookie...)
+	forged[0] ^= 0x1
+	assert.Error(t, cm.validate(forged, peer))
+	assert.Error(t, cm.validate(cookie[:cookieSz-1], peer))
+
+	clock.advance(10 * time.Second)
+	assert.NoError(t, cm.validate(cookie, peer))
+	clock.advance(time.Millisecond)
+	assert.Equal(t, errCookieExpired, cm.validate(cookie, peer))
+
+	// another listener's cookie
+	other, err := newCookieMinter(10000)
+	assert.NoError(t, err)
+	assert.Error(t, other.validate(cm.mint(peer), peer))
+}
+
+func TestListenerHelloCookies(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	GetProfile(profileId).HelloCookies = true
+	ci := &recordingInstrument{}
+	GetProfile(profileId).i = ci
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+	assert.Equal(t, int64(2), atomic.LoadInt64(&ci.helloRetries)) // listener sent, dialer received
+	assert.Equal(t, int64(0), atomic.LoadInt64(&ci.helloRejected))
+
+	_, err := conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := lConn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf[:n])
+
+	// a hello without a cookie creates no state, and is answered with a small retry
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer func() { _ = spoofer.Close() }()
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	h := hello{protocolVersion, profileId, 1450, GetProfile(profileId).agreementDigest()}
+	helloWm, err := newHello(0, h, nil, p)
+	assert.NoError(t, err)
+	assert.NoError(t, writeWireMessage(helloWm, newPath(spoofer, l.Addr().(*net.UDPAddr)), nil))
+	assert.NoError(t, spoofer.SetReadDeadline(time.Now().Add(5*time.Second)))
+	retry, _, err := readWireMessage(spoofer, p)
+	assert.NoError(t, err)
+	cookie, err := retry.asRetry()
+	assert.NoError(t, err)
+	assert.True(t, retry.buffer.uz < 3*helloWm.buffer.uz)
+	assert.Equal(t, 1, l.(*listener).peerCount())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&l.(*listener).handshakes))
+
+	// a forged cookie is dropped
+	cookie[len(cookie)-1] ^= 0x1
+	forged, err := newHello(0, h, nil, p)
+	assert.NoError(t, err)
+	assert.NoError(t, forged.setCookie(cookie))
+	assert.NoError(t, writeWireMessage(forged, newPath(spoofer, l.Addr().(*net.UDPAddr)), nil))
+	assert.NoError(t, spoofer.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = readWireMessage(spoofer, p)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ci.helloRejected))
+	assert.Equal(t, 1, l.(*listener).peerCount())
+}
+
+func TestListenerHelloCookiesUnderLoad(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).HelloCookieThresh = 1
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	ll := l.(*listener)
+
+	h := hello{protocolVersion, profileId, 1450, GetProfile(profileId).agreementDigest()}
+	helloWm, err := newHello(0, h, nil, ll.pool)
+	assert.NoError(t, err)
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	assert.True(t, ll.admit(helloWm, peer))
+
+	atomic.AddInt32(&ll.handshakes, 1)
+	defer atomic.AddInt32(&ll.handshakes, -1)
+	helloWm, err = newHello(0, h, nil, ll.pool)
+	assert.NoError(t, err)
+	assert.False(t, ll.admit(helloWm, peer))
+
+	helloWm, err = newHello(0, h, nil, ll.pool)
+	assert.NoError(t, err)
+	assert.NoError(t, helloWm.setCookie(ll.cookies.mint(peer)))
+	assert.True(t, ll.admit(helloWm, peer))
+}
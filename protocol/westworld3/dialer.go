@@ -23,12 +23,30 @@ func Dial(addr *net.UDPAddr, profileId byte) (conn net.Conn, err error) {
 		return nil, errors.Wrap(err, "tx buffer")
 	}
 
-	var dConn *dialerConn
-	dConn, err = newDialerConn(lConn, addr, profile)
+	return dial(lConn, addr, profile, profileId)
+}
+
+/*
+ * DialPacket establishes a westworld3 connection to addr over a caller-supplied packet connection, which may carry any
+ * unreliable datagram transport. The connection reads every datagram arriving on conn, so conn must not be shared, and
+ * closes conn when it is closed (or fails to connect).
+ */
+func DialPacket(conn net.PacketConn, addr net.Addr, profileId byte) (net.Conn, error) {
+	profile, found := profileRegistry[profileId]
+	if !found {
+		return nil, errors.Errorf("no profile [%d]", profileId)
+	}
+	return dial(conn, addr, profile, profileId)
+}
+
+func dial(conn net.PacketConn, addr net.Addr, profile *Profile, profileId byte) (net.Conn, error) {
+	dConn, err := newDialerConn(conn, addr, profile, profileId)
 	if err != nil {
+		_ = conn.Close()
 		return nil, errors.Wrap(err, "create dialer conn")
 	}
 	if err = dConn.hello(); err != nil {
+		_ = conn.Close()
 		return nil, errors.Wrap(err, "hello")
 	}
 
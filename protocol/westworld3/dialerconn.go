@@ -6,48 +6,75 @@ import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"math"
 	"math/big"
 	"net"
 	"time"
 )
 
+// helloMaxRetries bounds the cookies a dialer will accept from a listener before giving up
+const helloMaxRetries = 3
+
 type dialerConn struct {
-	conn     *net.UDPConn
-	peer     *net.UDPAddr
-	seq      *util.Sequence
-	txPortal *txPortal
-	rxPortal *rxPortal
-	closer   *closer
-	pool     *pool
-	profile  *Profile
-	ii       InstrumentInstance
-}
-
-func newDialerConn(conn *net.UDPConn, peer *net.UDPAddr, profile *Profile) (*dialerConn, error) {
-	sSeq := int64(0)
+	conn      net.PacketConn
+	peer      net.Addr
+	path      *path
+	seq       *util.Sequence
+	txPortal  *txPortal
+	rxPortal  *rxPortal
+	closer    *closer
+	sealer    *sealer
+	defrag    *reassembler
+	pool      *pool
+	profile   *Profile
+	profileId byte
+	ii        InstrumentInstance
+}
+
+func newDialerConn(conn net.PacketConn, peer net.Addr, profile *Profile, profileId byte) (*dialerConn, error) {
+	sSeq := int64(profile.startSeq)
 	if profile.RandomizeSeq {
-		randSeq, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+		randSeq, err := rand.Int(rand.Reader, big.NewInt(int64(seqMask)))
 		if err != nil {
 			return nil, errors.Wrap(err, "random sequence")
 		}
 		sSeq = randSeq.Int64()
 	}
 	dc := &dialerConn{
-		conn:    conn,
-		peer:    peer,
-		seq:     util.NewSequence(int32(sSeq)),
-		profile: profile,
+		conn:      conn,
+		peer:      peer,
+		path:      newPath(conn, peer),
+		seq:       util.NewSequence(int32(sSeq)),
+		profile:   profile.clone(), // registered profiles are shared; the listener may also downgrade parameters during hello
+		profileId: profileId,
 	}
+	profile = dc.profile
 	id := fmt.Sprintf("dialerConn_%s_%s", conn.LocalAddr(), peer)
 	dc.ii = profile.i.NewInstance(id, peer)
-	dc.pool = newPool(id, uint32(dataStart+profile.MaxSegmentSz), dc.ii)
+	sealer, err := newSealer(id, profile, dc.ii)
+	if err != nil {
+		return nil, errors.Wrap(err, "sealer")
+	}
+	dc.sealer = sealer
+	bufferSz := dataStart + profile.MaxSegmentSz
+	if sealer != nil {
+		bufferSz += sealOverhead // received messages are opened in place
+	}
+	dc.pool = newPool(id, uint32(bufferSz), dc.ii)
+	dc.defrag = newReassembler(dc.pool)
 	closeHook := func() {
 		dc.ii.Shutdown()
+		// the dialer owns its packet conn; closing it stops the rxer
+		if err := dc.conn.Close(); err != nil {
+			logrus.Errorf("error closing packet conn (%v)", err)
+		}
 	}
 	dc.closer = newCloser(dc.seq, dc.profile, closeHook)
-	dc.txPortal = newTxPortal(conn, peer, dc.closer, profile, dc.pool, dc.ii)
-	dc.rxPortal = newRxPortal(conn, peer, dc.txPortal, dc.seq, dc.closer, profile, dc.ii)
+	dc.txPortal = newTxPortal(dc.path, peer, dc.closer, profile, dc.pool, dc.ii)
+	dc.rxPortal = newRxPortal(dc.path, peer, dc.txPortal, dc.seq, dc.closer, profile, dc.ii)
+	dc.txPortal.rxPortal = dc.rxPortal
+	dc.txPortal.sealer = dc.sealer
+	dc.txPortal.monitor.sealer = dc.sealer
+	dc.rxPortal.sealer = dc.sealer
 	dc.closer.txPortal = dc.txPortal
 	dc.closer.rxPortal = dc.rxPortal
 	return dc, nil
@@ -66,6 +93,33 @@ func (self *dialerConn) Close() error {
 	return self.txPortal.sendClose(self.seq)
 }
 
+func (self *dialerConn) CloseWrite() error {
+	logrus.Infof("close write requested")
+	return self.txPortal.sendFin(self.seq)
+}
+
+func (self *dialerConn) CloseRead() error {
+	logrus.Infof("close read requested")
+	self.rxPortal.closeRead()
+	return nil
+}
+
+/*
+ * SendDatagram sends p to the peer as a single unreliable, unordered datagram of at most MaxSegmentSz bytes (less the
+ * seal and connection id, where used). With PmtuDiscovery, datagrams are limited to the segment size currently
+ * discovered for the path, which starts at PmtuMinSegmentSz.
+ */
+func (self *dialerConn) SendDatagram(p []byte) error {
+	return self.txPortal.sendDatagram(p)
+}
+
+/*
+ * ReceiveDatagram returns the next datagram sent by the peer with SendDatagram.
+ */
+func (self *dialerConn) ReceiveDatagram() ([]byte, error) {
+	return self.rxPortal.receiveDatagram()
+}
+
 func (self *dialerConn) RemoteAddr() net.Addr {
 	return self.peer
 }
@@ -74,16 +128,20 @@ func (self *dialerConn) LocalAddr() net.Addr {
 	return self.conn.LocalAddr()
 }
 
-func (self *dialerConn) SetDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetDeadline(t time.Time) error {
+	self.rxPortal.setReadDeadline(t)
+	self.txPortal.setWriteDeadline(t)
+	return nil
 }
 
-func (self *dialerConn) SetReadDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetReadDeadline(t time.Time) error {
+	self.rxPortal.setReadDeadline(t)
+	return nil
 }
 
-func (self *dialerConn) SetWriteDeadline(_ time.Time) error {
-	return errors.New("not implemented")
+func (self *dialerConn) SetWriteDeadline(t time.Time) error {
+	self.txPortal.setWriteDeadline(t)
+	return nil
 }
 
 func (self *dialerConn) rxer() {
@@ -91,18 +149,37 @@ func (self *dialerConn) rxer() {
 	defer logrus.Warn("exited")
 
 	for {
-		wm, peer, err := readWireMessage(self.conn, self.pool)
+		buffer, peer, err := readBuffer(self.conn, self.pool)
 		if err != nil {
+			if self.txPortal.isClosed() {
+				return
+			}
 			logrus.Errorf("error reading (%v)", err)
 			self.ii.ReadError(self.peer, err)
 			self.closer.emergencyStop()
 			return
 		}
+		wm, ok := decodeWireMessage(buffer, self.sealer, peer, self.ii)
+		if !ok {
+			continue
+		}
 		self.ii.WireMessageRx(peer, wm)
 
+		if wm.messageType() == FRAGMENT {
+			reassembled, err := self.defrag.add(wm)
+			if err != nil {
+				logrus.Errorf("error reassembling (%v)", err)
+				continue
+			}
+			if reassembled == nil {
+				continue
+			}
+			wm = reassembled
+		}
+
 		switch wm.messageType() {
 		case DATA:
-			_, rttTs, err := wm.asData()
+			_, rttTs, acks, rxPortalSz, err := wm.asData()
 			if err != nil {
 				logrus.Errorf("as data error (%v)", err)
 				continue
@@ -110,6 +187,12 @@ func (self *dialerConn) rxer() {
 			if rttTs != nil {
 				self.txPortal.rtt(*rttTs)
 			}
+			if len(acks) > 0 {
+				self.txPortal.updateRxPortalSz(int(rxPortalSz))
+				if err := self.txPortal.ack(acks); err != nil {
+					logrus.Errorf("error acking inline (%v)", err)
+				}
+			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error rx-ing (%v)", err)
 				continue
@@ -139,11 +222,22 @@ func (self *dialerConn) rxer() {
 				continue
 			}
 			self.txPortal.updateRxPortalSz(rxPortalSz)
+			// pmtu and path messages are reported by the txPortal, rather than as keepalives
+			pmtu := wm.hasFlag(PMTU_PROBE) || wm.hasFlag(PMTU_ACK)
+			if pmtu {
+				self.txPortal.pmtu(wm)
+			}
+			challenge := wm.hasFlag(CHALLENGE)
+			if challenge {
+				self.txPortal.pathResponse(wm)
+			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error forwarding keepalive to rxPortal (%v)", err)
 				continue
 			}
-			self.ii.RxKeepalive(peer, wm)
+			if !pmtu && !challenge {
+				self.ii.RxKeepalive(peer, wm)
+			}
 			wm.buffer.unref()
 
 		case CLOSE:
@@ -151,6 +245,12 @@ func (self *dialerConn) rxer() {
 				logrus.Errorf("error rx-ing close (%v)", err)
 			}
 
+		case DATAGRAM:
+			if err := self.rxPortal.rx(wm); err != nil {
+				logrus.Errorf("error rx-ing datagram (%v)", err)
+				wm.buffer.unref()
+			}
+
 		default:
 			logrus.Errorf("unexpected message type: %d", wm.mt)
 			self.ii.UnexpectedMessageType(peer, wm.mt)
@@ -159,20 +259,54 @@ func (self *dialerConn) rxer() {
 	}
 }
 
+/*
+ * newHello creates the dialer's HELLO, echoing the listener's cookie when it has been asked to retry with one.
+ */
+func (self *dialerConn) newHello(seq int32, cookie []byte) (*wireMessage, error) {
+	hello, err := newHello(seq, hello{protocolVersion, self.profileId, uint16(self.profile.MaxSegmentSz), self.profile.agreementDigest()}, nil, self.pool)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating hello message")
+	}
+	if self.profile.RttProbeWide {
+		hello.setWideRtt()
+	}
+	if self.profile.ConnectionIds {
+		if err := hello.setConnectionId(0); err != nil {
+			hello.buffer.unref()
+			return nil, errors.Wrap(err, "error requesting connection id")
+		}
+	}
+	if cookie != nil {
+		if err := hello.setCookie(cookie); err != nil {
+			hello.buffer.unref()
+			return nil, errors.Wrap(err, "error adding cookie to hello")
+		}
+	}
+	if self.sealer != nil {
+		if err := hello.appendKeyExchange(self.sealer.keyExchange()); err != nil {
+			hello.buffer.unref()
+			return nil, errors.Wrap(err, "error adding key exchange to hello")
+		}
+	}
+	return hello, nil
+}
+
 func (self *dialerConn) hello() error {
 	logrus.Infof("starting hello process")
 	defer logrus.Infof("completed hello process")
 
 	helloSeq := self.seq.Next()
-	hello, err := newHello(helloSeq, hello{protocolVersion, 0}, nil, self.pool)
+	hello, err := self.newHello(helloSeq, nil)
 	if err != nil {
-		return errors.Wrap(err, "error creating hello message")
+		return err
 	}
-	defer hello.buffer.unref()
+	defer func() { hello.buffer.unref() }()
 
 	count := 0
+	retries := 0
 	for {
-		if err := writeWireMessage(hello, self.conn, self.peer); err != nil {
+		sent := time.Now()
+		if err := writeWireMessage(hello, self.path, nil); err != nil {
 			return errors.Wrap(err, "write hello")
 		}
 		self.ii.WireMessageTx(self.peer, hello)
@@ -192,6 +326,31 @@ func (self *dialerConn) hello() error {
 			return errors.Wrap(err, "clear read deadline")
 		}
 
+		if helloAck.messageType() == REFUSE {
+			reason, err := helloAck.asRefuse()
+			if err != nil {
+				return errors.Wrap(err, "invalid refuse")
+			}
+			if reason == refuseRetry && retries < helloMaxRetries {
+				cookie, err := helloAck.asRetry()
+				if err != nil {
+					return errors.Wrap(err, "invalid retry")
+				}
+				cookieHello, err := self.newHello(helloSeq, cookie)
+				if err != nil {
+					return err
+				}
+				hello.buffer.unref()
+				hello = cookieHello
+				self.ii.HelloRetry(self.peer)
+				retries++
+				continue
+			}
+			err = errors.Errorf("refused by listener (%s)", reason)
+			self.ii.ConnectionError(self.peer, err)
+			return err
+		}
+
 		h, acks, err := helloAck.asHello()
 		if err != nil {
 			return errors.Wrap(err, "unexpected response")
@@ -202,6 +361,43 @@ func (self *dialerConn) hello() error {
 		}
 
 		if len(acks) == 1 && acks[0].start == acks[0].end && acks[0].start == helloSeq {
+			if int(h.maxSegmentSz) > self.profile.MaxSegmentSz || int(h.maxSegmentSz) < minSegmentSz {
+				return errors.Errorf("unacceptable segment size from listener [%d]", h.maxSegmentSz)
+			}
+			// the listener may agree to its own profile; its portals then only interoperate with ours when the
+			// agreement-relevant settings match
+			if h.digest != self.profile.agreementDigest() {
+				err := errors.Errorf("listener agreed to profile [%d] with different settings", h.profile)
+				self.ii.ConnectionError(self.peer, err)
+				return err
+			}
+			self.profile.MaxSegmentSz = int(h.maxSegmentSz)
+			self.txPortal.rttWide = self.profile.RttProbeWide && helloAck.wideRtt()
+
+			if self.sealer != nil {
+				kx, err := helloAck.asKeyExchange()
+				if err != nil {
+					return errors.Wrap(err, "invalid key exchange")
+				}
+				if err := self.sealer.establish(kx, true); err != nil {
+					self.ii.ConnectionError(self.peer, err)
+					return errors.Wrap(err, "establish keys")
+				}
+			}
+
+			if self.profile.ConnectionIds {
+				cid, found, err := helloAck.asConnectionId()
+				if err != nil {
+					return errors.Wrap(err, "invalid connection id")
+				}
+				if found {
+					if cid&connectionIdMark == 0 {
+						return errors.Errorf("unacceptable connection id from listener [%x]", cid)
+					}
+					self.path.setConnectionId(cid, newPool(self.pool.id+"_path", self.pool.bufSz+connectionIdSz, self.ii))
+				}
+			}
+
 			// Set next highest sequence
 			self.rxPortal.setAccepted(helloAck.seq)
 
@@ -210,11 +406,15 @@ func (self *dialerConn) hello() error {
 			if err != nil {
 				return errors.Wrap(err, "new final ack")
 			}
-			if err := writeWireMessage(finalAck, self.conn, self.peer); err != nil {
+			if err := writeWireMessage(finalAck, self.path, self.sealer); err != nil {
 				return errors.Wrap(err, "write final ack")
 			}
 			self.ii.WireMessageTx(self.peer, finalAck)
 
+			if count == 0 {
+				self.txPortal.helloRtt(time.Since(sent))
+			}
+
 			go self.rxer()
 			go self.txPortal.start()
 			go self.closer.run()
@@ -0,0 +1,193 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadDeadline(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 64))
+	assert.Error(t, err)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// a read blocked without a deadline is released when a deadline is set
+	assert.NoError(t, conn.SetReadDeadline(time.Time{}))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.SetReadDeadline(time.Now())
+	}()
+	_, err = conn.Read(make([]byte, 64))
+	netErr, ok = err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	// clearing the deadline allows reads to proceed
+	assert.NoError(t, conn.SetReadDeadline(time.Time{}))
+	_, err = lConn.Write([]byte("x"))
+	assert.NoError(t, err)
+	n, err := conn.Read(make([]byte, 64))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestWriteDeadline(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, conn, _ := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	// nobody reads the listener side, so the portal eventually fills and blocks the writer
+	assert.NoError(t, conn.SetWriteDeadline(time.Now().Add(250*time.Millisecond)))
+	data := make([]byte, 64*1024*1024)
+	n, err := conn.Write(data)
+	assert.Error(t, err)
+	assert.True(t, n < len(data))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	_, err = conn.Write([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestCloseWrite(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	request := make([]byte, 256*1024)
+	for i := range request {
+		request[i] = byte(i)
+	}
+	_, err := conn.Write(request)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*dialerConn).CloseWrite())
+	assert.NoError(t, conn.(*dialerConn).CloseWrite())
+	_, err = conn.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	// the listener reads the whole request, then end of stream
+	rx, err := ioutil.ReadAll(lConn)
+	assert.NoError(t, err)
+	assert.Equal(t, request, rx)
+	_, err = lConn.Read(make([]byte, 64))
+	assert.Equal(t, io.EOF, err)
+
+	// the reply still flows back to the half-closed dialer
+	_, err = lConn.Write([]byte("reply"))
+	assert.NoError(t, err)
+	assert.NoError(t, lConn.(*listenerConn).CloseWrite())
+	rx, err = ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), rx)
+}
+
+func TestCloseRead(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	// a reader blocked on the listener is released
+	read := make(chan error, 1)
+	go func() {
+		_, err := lConn.Read(make([]byte, 64))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, lConn.(*listenerConn).CloseRead())
+	select {
+	case err := <-read:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("read not released")
+	}
+
+	// writes to the closed side are acknowledged and discarded, well beyond the portal size
+	assert.NoError(t, conn.SetWriteDeadline(time.Now().Add(10*time.Second)))
+	_, err := conn.Write(make([]byte, 8*1024*1024))
+	assert.NoError(t, err)
+
+	// the other direction is unaffected
+	_, err = lConn.Write([]byte("x"))
+	assert.NoError(t, err)
+	n, err := conn.Read(make([]byte, 64))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestDatagrams(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	dConn := conn.(*dialerConn)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, dConn.SendDatagram([]byte{byte(i)}))
+	}
+	assert.Error(t, dConn.SendDatagram(make([]byte, dConn.profile.MaxSegmentSz+1)))
+
+	// datagrams are not tracked for retransmission
+	dConn.txPortal.lock.Lock()
+	assert.Equal(t, 0, dConn.txPortal.tree.Size())
+	assert.Equal(t, 0, dConn.txPortal.monitor.waitlist.Size())
+	dConn.txPortal.lock.Unlock()
+
+	lc := lConn.(*listenerConn)
+	assert.NoError(t, lc.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for i := 0; i < 10; i++ {
+		data, err := lc.ReceiveDatagram()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, data)
+	}
+
+	// the stream is unaffected
+	_, err := lc.Write([]byte("stream"))
+	assert.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("stream"), buf[:n])
+
+	assert.NoError(t, lc.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = lc.ReceiveDatagram()
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+}
+
+func TestDatagramDeadlineChanged(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, conn, _ := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	dConn := conn.(*dialerConn)
+	received := make(chan error, 1)
+	go func() {
+		_, err := dConn.ReceiveDatagram()
+		received <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a deadline set while blocked releases the receive
+	assert.NoError(t, dConn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	select {
+	case err := <-received:
+		assert.Equal(t, os.ErrDeadlineExceeded, err)
+	case <-time.After(time.Second):
+		t.Fatal("receive not released")
+	}
+}
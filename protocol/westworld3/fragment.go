@@ -0,0 +1,147 @@
+package westworld3
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// fragmentHeaderSz is the fragment index and count, preceding each part of the message
+	fragmentHeaderSz = 2
+	// maxFragments bounds the parts a message can be split into
+	maxFragments = 16
+	// maxReassemblies bounds the partially received messages a receiver holds
+	maxReassemblies = 64
+)
+
+/*
+ * writeFragmented transmits an encoded message as FRAGMENT messages carrying at most segmentSz bytes each. Messages are
+ * only fragmented when they were sent before the path mtu shrank below their size, and are being retransmitted; sequence
+ * numbers are assigned per message, so they cannot be segmented again. Each fragment is sealed separately.
+ */
+func writeFragmented(wm *wireMessage, segmentSz int, path *path, s *sealer, p *pool) error {
+	partSz := segmentSz - fragmentHeaderSz
+	if partSz < 1 {
+		return errors.Errorf("segment too small for fragment [%d]", segmentSz)
+	}
+	data := wm.buffer.data[:wm.buffer.uz]
+	count := (len(data) + partSz - 1) / partSz
+	if count > maxFragments {
+		return errors.Errorf("too many fragments [%d > %d]", count, maxFragments)
+	}
+	for i := 0; i < count; i++ {
+		part := data[i*partSz:]
+		if len(part) > partSz {
+			part = part[:partSz]
+		}
+		fragment := &wireMessage{
+			seq:    wm.seq,
+			mt:     FRAGMENT,
+			buffer: p.get(),
+		}
+		fragment.buffer.data[dataStart] = byte(i)
+		fragment.buffer.data[dataStart+1] = byte(count)
+		copy(fragment.buffer.data[dataStart+fragmentHeaderSz:], part)
+		if _, err := fragment.encodeHeader(uint16(fragmentHeaderSz + len(part))); err != nil {
+			fragment.buffer.unref()
+			return errors.Wrap(err, "fragment")
+		}
+		err := writeWireMessage(fragment, path, s)
+		fragment.buffer.unref()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reassembly struct {
+	parts    [][]byte
+	received int
+	started  time.Time
+}
+
+/*
+ * reassembler collects FRAGMENT messages, keyed by the sequence of the message they carry. Lost fragments are recovered
+ * when the whole message is retransmitted, so an incomplete reassembly is replaced by the next one for its sequence, or
+ * evicted (oldest first) when maxReassemblies are pending. Used only from a connection's rxer.
+ */
+type reassembler struct {
+	pool    *pool
+	partial map[int32]*reassembly
+}
+
+func newReassembler(p *pool) *reassembler {
+	return &reassembler{pool: p, partial: make(map[int32]*reassembly)}
+}
+
+/*
+ * add consumes a FRAGMENT, returning the message it completes (in a buffer from the reassembler's pool), or nil.
+ */
+func (self *reassembler) add(wm *wireMessage) (*wireMessage, error) {
+	defer wm.buffer.unref()
+
+	if wm.buffer.uz < dataStart+fragmentHeaderSz {
+		return nil, errors.Errorf("short buffer for fragment decode [%d < %d]", wm.buffer.uz, dataStart+fragmentHeaderSz)
+	}
+	i := int(wm.buffer.data[dataStart])
+	count := int(wm.buffer.data[dataStart+1])
+	if count < 2 || count > maxFragments || i >= count {
+		return nil, errors.Errorf("invalid fragment [%d/%d]", i, count)
+	}
+
+	r, found := self.partial[wm.seq]
+	if !found || len(r.parts) != count {
+		if !found && len(self.partial) >= maxReassemblies {
+			self.evict()
+		}
+		r = &reassembly{parts: make([][]byte, count), started: time.Now()}
+		self.partial[wm.seq] = r
+	}
+	if r.parts[i] != nil {
+		return nil, nil
+	}
+	part := wm.buffer.data[dataStart+fragmentHeaderSz : wm.buffer.uz]
+	r.parts[i] = append([]byte(nil), part...)
+	r.received++
+	if r.received < count {
+		return nil, nil
+	}
+	delete(self.partial, wm.seq)
+
+	buffer := self.pool.get()
+	for _, part := range r.parts {
+		if buffer.uz+uint32(len(part)) > buffer.sz {
+			buffer.unref()
+			return nil, errors.Errorf("reassembled message too large [%d]", buffer.sz)
+		}
+		copy(buffer.data[buffer.uz:], part)
+		buffer.uz += uint32(len(part))
+	}
+	if buffer.uz < dataStart {
+		buffer.unref()
+		return nil, errors.Errorf("short reassembled message [%d]", buffer.uz)
+	}
+	reassembled, err := decodeHeader(buffer)
+	if err != nil {
+		buffer.unref()
+		return nil, errors.Wrap(err, "decode reassembled")
+	}
+	if reassembled.messageType() == FRAGMENT || reassembled.seq != wm.seq {
+		buffer.unref()
+		return nil, errors.Errorf("invalid reassembled message [#%d %s]", reassembled.seq, reassembled.messageType())
+	}
+	return reassembled, nil
+}
+
+func (self *reassembler) evict() {
+	var oldest int32
+	var oldestStarted time.Time
+	for seq, r := range self.partial {
+		if oldestStarted.IsZero() || r.started.Before(oldestStarted) {
+			oldest = seq
+			oldestStarted = r.started
+		}
+	}
+	delete(self.partial, oldest)
+}
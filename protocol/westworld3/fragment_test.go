@@ -0,0 +1,89 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	rx, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer func() { _ = rx.Close() }()
+	tx, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer func() { _ = tx.Close() }()
+
+	p := newPool("test", dataStart+4000, NewNilInstrument().NewInstance("", nil))
+	data := make([]byte, 3500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	wm, err := newData(33, nil, nil, 0, data, p)
+	assert.NoError(t, err)
+	assert.NoError(t, writeFragmented(wm, 1000, newPath(tx, rx.LocalAddr().(*net.UDPAddr)), nil, p))
+
+	var fragments []*wireMessage
+	assert.NoError(t, rx.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for i := 0; i < 4; i++ {
+		fragment, _, err := readWireMessage(rx, p)
+		assert.NoError(t, err)
+		assert.Equal(t, FRAGMENT, fragment.messageType())
+		assert.Equal(t, int32(33), fragment.seq)
+		assert.True(t, fragment.buffer.uz <= dataStart+1000)
+		fragments = append(fragments, fragment)
+	}
+	rand.Shuffle(len(fragments), func(i, j int) { fragments[i], fragments[j] = fragments[j], fragments[i] })
+
+	r := newReassembler(p)
+	for i, fragment := range fragments {
+		if i < len(fragments)-1 {
+			fragment.buffer.ref() // duplicated
+			reassembled, err := r.add(fragment)
+			assert.NoError(t, err)
+			assert.Nil(t, reassembled)
+		}
+
+		reassembled, err := r.add(fragment)
+		assert.NoError(t, err)
+		if i < len(fragments)-1 {
+			assert.Nil(t, reassembled)
+			continue
+		}
+		if assert.NotNil(t, reassembled) {
+			assert.Equal(t, int32(33), reassembled.seq)
+			out, _, _, _, err := reassembled.asData()
+			assert.NoError(t, err)
+			assert.Equal(t, data, out)
+		}
+	}
+	assert.Equal(t, 0, len(r.partial))
+}
+
+func TestReassemblerEvict(t *testing.T) {
+	p := newPool("test", dataStart+1000, NewNilInstrument().NewInstance("", nil))
+	r := newReassembler(p)
+	for seq := int32(0); seq < maxReassemblies+1; seq++ {
+		fragment := &wireMessage{seq: seq, mt: FRAGMENT, buffer: p.get()}
+		fragment.buffer.data[dataStart] = 0
+		fragment.buffer.data[dataStart+1] = 2
+		_, err := fragment.encodeHeader(fragmentHeaderSz + 1)
+		assert.NoError(t, err)
+		reassembled, err := r.add(fragment)
+		assert.NoError(t, err)
+		assert.Nil(t, reassembled)
+	}
+	assert.Equal(t, maxReassemblies, len(r.partial))
+	_, found := r.partial[0]
+	assert.False(t, found)
+
+	invalid := &wireMessage{seq: 0, mt: FRAGMENT, buffer: p.get()}
+	invalid.buffer.data[dataStart] = 2
+	invalid.buffer.data[dataStart+1] = 2
+	_, err := invalid.encodeHeader(fragmentHeaderSz)
+	assert.NoError(t, err)
+	_, err = r.add(invalid)
+	assert.Error(t, err)
+}
@@ -3,27 +3,73 @@ package westworld3
 import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
 )
 
+/*
+ * hello carries the dialer's requested profile, or the listener's agreed profile in the reply. digest summarizes the
+ * profile's agreement-relevant fields (see Profile.agreementDigest), so that a listener only adopts a registered profile
+ * when both ends hold the same settings under its id.
+ */
 type hello struct {
-	version uint32
-	profile uint8
+	version      uint32
+	profile      uint8
+	maxSegmentSz uint16
+	digest       uint32
 }
 
+const helloSz = 11
+
 func encodeHello(hello hello, data []byte) (n uint32, err error) {
 	dataSz := len(data)
-	if dataSz < 5 {
-		return 0, errors.Errorf("hello too large [%d < 5]", dataSz)
+	if dataSz < helloSz {
+		return 0, errors.Errorf("hello too large [%d < %d]", dataSz, helloSz)
 	}
 	util.WriteUint32(data, hello.version)
 	data[4] = hello.profile
-	return 5, nil
+	util.WriteUint16(data[5:], hello.maxSegmentSz)
+	util.WriteUint32(data[7:], hello.digest)
+	return helloSz, nil
 }
 
 func decodeHello(data []byte) (hello, uint32, error) {
 	dataSz := len(data)
-	if dataSz < 5 {
-		return hello{}, 0, errors.Errorf("short hello buffer [%d < 4]", dataSz)
+	if dataSz < helloSz {
+		return hello{}, 0, errors.Errorf("short hello buffer [%d < %d]", dataSz, helloSz)
+	}
+	return hello{util.ReadUint32(data), data[4], util.ReadUint16(data[5:]), util.ReadUint32(data[7:])}, helloSz, nil
+}
+
+/*
+ * keyExchange optionally follows the hello in a HELLO, carrying the cipher suite and ephemeral public key of a sealed
+ * connection.
+ */
+type keyExchange struct {
+	suite     cipherSuite
+	publicKey []byte
+}
+
+const keyExchangeSz = 1 + curve25519.PointSize
+
+func encodeKeyExchange(kx keyExchange, data []byte) (n uint32, err error) {
+	dataSz := len(data)
+	if dataSz < keyExchangeSz {
+		return 0, errors.Errorf("key exchange too large [%d < %d]", dataSz, keyExchangeSz)
+	}
+	if len(kx.publicKey) != curve25519.PointSize {
+		return 0, errors.Errorf("invalid public key size [%d]", len(kx.publicKey))
+	}
+	data[0] = byte(kx.suite)
+	copy(data[1:], kx.publicKey)
+	return keyExchangeSz, nil
+}
+
+func decodeKeyExchange(data []byte) (keyExchange, uint32, error) {
+	dataSz := len(data)
+	if dataSz < keyExchangeSz {
+		return keyExchange{}, 0, errors.Errorf("short key exchange buffer [%d < %d]", dataSz, keyExchangeSz)
 	}
-	return hello{util.ReadUint32(data), data[4]}, 5, nil
+	publicKey := make([]byte, curve25519.PointSize)
+	copy(publicKey, data[1:keyExchangeSz])
+	return keyExchange{cipherSuite(data[0]), publicKey}, keyExchangeSz, nil
 }
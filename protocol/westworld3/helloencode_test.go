@@ -8,10 +8,10 @@ import (
 )
 
 func TestHelloEncodeDecode(t *testing.T) {
-	data := make([]byte, 5)
-	sz, err := encodeHello(hello{9006, 0xF}, data)
+	data := make([]byte, helloSz)
+	sz, err := encodeHello(hello{9006, 0xF, 1450, 0xc0ffee}, data)
 	assert.NoError(t, err)
-	assert.Equal(t, uint32(5), sz)
+	assert.Equal(t, uint32(helloSz), sz)
 
 	fmt.Println(hex.Dump(data))
 
@@ -19,4 +19,11 @@ func TestHelloEncodeDecode(t *testing.T) {
 	assert.NoError(t, err2)
 	assert.Equal(t, uint32(9006), outHello.version)
 	assert.Equal(t, uint8(0xF), outHello.profile)
+	assert.Equal(t, uint16(1450), outHello.maxSegmentSz)
+	assert.Equal(t, uint32(0xc0ffee), outHello.digest)
+
+	_, err = encodeHello(hello{9006, 0xF, 1450, 0xc0ffee}, data[:helloSz-1])
+	assert.Error(t, err)
+	_, _, err = decodeHello(data[:helloSz-1])
+	assert.Error(t, err)
 }
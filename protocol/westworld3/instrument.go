@@ -3,45 +3,64 @@ package westworld3
 import (
 	"github.com/pkg/errors"
 	"net"
+	"time"
 )
 
 type Instrument interface {
-	NewInstance(id string, peer *net.UDPAddr) InstrumentInstance
+	NewInstance(id string, peer net.Addr) InstrumentInstance
 }
 
 type InstrumentInstance interface {
 	// connection
-	Listener(addr *net.UDPAddr)
-	Hello(peer *net.UDPAddr)
-	Connected(peer *net.UDPAddr)
-	ConnectionError(peer *net.UDPAddr, err error)
-	Closed(peer *net.UDPAddr)
+	Listener(addr net.Addr)
+	Hello(peer net.Addr)
+	Connected(peer net.Addr)
+	ConnectionError(peer net.Addr, err error)
+	HelloRetry(peer net.Addr)
+	HelloRejected(peer net.Addr, err error)
+	ConnectionMigrated(peer net.Addr, to net.Addr)
+	Closed(peer net.Addr)
 
 	// wire
-	WireMessageTx(peer *net.UDPAddr, wm *wireMessage)
-	WireMessageRetx(peer *net.UDPAddr, wm *wireMessage)
-	WireMessageRx(peer *net.UDPAddr, wm *wireMessage)
-	UnknownPeer(peer *net.UDPAddr)
-	ReadError(peer *net.UDPAddr, err error)
-	UnexpectedMessageType(peer *net.UDPAddr, mt messageType)
+	WireMessageTx(peer net.Addr, wm *wireMessage)
+	WireMessageRetx(peer net.Addr, wm *wireMessage)
+	WireMessageRx(peer net.Addr, wm *wireMessage)
+	UnknownPeer(peer net.Addr)
+	ReadError(peer net.Addr, err error)
+	UnsealError(peer net.Addr, err error)
+	UnexpectedMessageType(peer net.Addr, mt messageType)
 
 	// control
-	TxAck(peer *net.UDPAddr, wm *wireMessage)
-	RxAck(peer *net.UDPAddr, wm *wireMessage)
-	TxKeepalive(peer *net.UDPAddr, wm *wireMessage)
-	RxKeepalive(peer *net.UDPAddr, wm *wireMessage)
+	TxAck(peer net.Addr, wm *wireMessage)
+	RxAck(peer net.Addr, wm *wireMessage)
+	TxKeepalive(peer net.Addr, wm *wireMessage)
+	RxKeepalive(peer net.Addr, wm *wireMessage)
+	TxPmtuProbe(peer net.Addr, sz int)
+	RxPmtuProbe(peer net.Addr, sz int)
+	TxPmtuAck(peer net.Addr, sz int)
+	RxPmtuAck(peer net.Addr, sz int)
+	TxPathChallenge(peer net.Addr, to net.Addr)
+	RxPathChallenge(peer net.Addr)
+	TxPathResponse(peer net.Addr)
+	RxPathResponse(peer net.Addr, from net.Addr)
 
 	// txPortal
-	TxPortalCapacityChanged(peer *net.UDPAddr, capacity int)
-	TxPortalSzChanged(peer *net.UDPAddr, capacity int)
-	TxPortalRxSzChanged(peer *net.UDPAddr, sz int)
-	NewRetxMs(peer *net.UDPAddr, retxMs int)
-	NewRetxScale(peer *net.UDPAddr, retxScale float64)
-	DuplicateAck(peer *net.UDPAddr, ack int32)
+	TxPortalCapacityChanged(peer net.Addr, capacity int)
+	TxPortalSzChanged(peer net.Addr, capacity int)
+	TxPortalRxSzChanged(peer net.Addr, sz int)
+	TxPortalPacingRateChanged(peer net.Addr, rate int)
+	NewRetxMs(peer net.Addr, retxMs int)
+	NewRetxScale(peer net.Addr, retxScale float64)
+	NewRttEstimate(peer net.Addr, srtt, rttvar time.Duration)
+	PathMtuChanged(peer net.Addr, mtu int)
+	PathMtuBlackHole(peer net.Addr)
+	DuplicateAck(peer net.Addr, ack int32)
+	FastRetx(peer net.Addr, wm *wireMessage)
+	TimedRetx(peer net.Addr, wm *wireMessage)
 
 	// rxPortal
-	RxPortalSzChanged(peer *net.UDPAddr, capacity int)
-	DuplicateRx(peer *net.UDPAddr, wm *wireMessage)
+	RxPortalSzChanged(peer net.Addr, capacity int)
+	DuplicateRx(peer net.Addr, wm *wireMessage)
 
 	// allocation
 	Allocate(id string)
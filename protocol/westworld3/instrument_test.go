@@ -0,0 +1,102 @@
+package westworld3
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * recordingInstrument counts the instrument events which tests assert on, across every instance (both ends of a
+ * connection, when they share a profile). Counters are read with atomic loads; retxMs is guarded by lock.
+ */
+type recordingInstrument struct {
+	helloRetries   int64
+	helloRejected  int64
+	migrations     int64
+	txAcks         int64
+	pmtuProbes     int64
+	pmtuAcks       int64
+	pathChallenges int64
+	pathResponses  int64
+	pacingRate     int64
+	rttEstimates   int64
+	pathMtu        int64
+	blackHoles     int64
+	fastRetxs      int64
+	timedRetxs     int64
+	lock           sync.Mutex
+	retxMs         []int
+}
+
+func (self *recordingInstrument) NewInstance(_ string, _ net.Addr) InstrumentInstance {
+	return &recordingInstrumentInstance{i: self}
+}
+
+type recordingInstrumentInstance struct {
+	nilInstrumentInstance
+	i *recordingInstrument
+}
+
+func (self *recordingInstrumentInstance) HelloRetry(net.Addr) {
+	atomic.AddInt64(&self.i.helloRetries, 1)
+}
+
+func (self *recordingInstrumentInstance) HelloRejected(net.Addr, error) {
+	atomic.AddInt64(&self.i.helloRejected, 1)
+}
+
+func (self *recordingInstrumentInstance) ConnectionMigrated(net.Addr, net.Addr) {
+	atomic.AddInt64(&self.i.migrations, 1)
+}
+
+func (self *recordingInstrumentInstance) TxAck(net.Addr, *wireMessage) {
+	atomic.AddInt64(&self.i.txAcks, 1)
+}
+
+func (self *recordingInstrumentInstance) TxPmtuProbe(net.Addr, int) {
+	atomic.AddInt64(&self.i.pmtuProbes, 1)
+}
+
+func (self *recordingInstrumentInstance) RxPmtuAck(net.Addr, int) {
+	atomic.AddInt64(&self.i.pmtuAcks, 1)
+}
+
+func (self *recordingInstrumentInstance) TxPathChallenge(net.Addr, net.Addr) {
+	atomic.AddInt64(&self.i.pathChallenges, 1)
+}
+
+func (self *recordingInstrumentInstance) RxPathResponse(net.Addr, net.Addr) {
+	atomic.AddInt64(&self.i.pathResponses, 1)
+}
+
+func (self *recordingInstrumentInstance) TxPortalPacingRateChanged(_ net.Addr, rate int) {
+	atomic.StoreInt64(&self.i.pacingRate, int64(rate))
+}
+
+func (self *recordingInstrumentInstance) NewRetxMs(_ net.Addr, retxMs int) {
+	self.i.lock.Lock()
+	self.i.retxMs = append(self.i.retxMs, retxMs)
+	self.i.lock.Unlock()
+}
+
+func (self *recordingInstrumentInstance) NewRttEstimate(net.Addr, time.Duration, time.Duration) {
+	atomic.AddInt64(&self.i.rttEstimates, 1)
+}
+
+func (self *recordingInstrumentInstance) PathMtuChanged(_ net.Addr, mtu int) {
+	atomic.StoreInt64(&self.i.pathMtu, int64(mtu))
+}
+
+func (self *recordingInstrumentInstance) PathMtuBlackHole(net.Addr) {
+	atomic.AddInt64(&self.i.blackHoles, 1)
+}
+
+func (self *recordingInstrumentInstance) FastRetx(net.Addr, *wireMessage) {
+	atomic.AddInt64(&self.i.fastRetxs, 1)
+}
+
+func (self *recordingInstrumentInstance) TimedRetx(net.Addr, *wireMessage) {
+	atomic.AddInt64(&self.i.timedRetxs, 1)
+}
@@ -0,0 +1,173 @@
+package westworld3
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// ledbatBaseIntervalMs is the span of each bucket of the base delay history
+	ledbatBaseIntervalMs = 60 * 1000
+	// ledbatMinCwndSegments is the smallest window, in segments, the controller will yield down to
+	ledbatMinCwndSegments = 2
+	// ledbatMinTarget floors the target on paths with a base delay near 0ms, where the rtt samples jitter by more than a
+	// fraction of the base delay
+	ledbatMinTarget = 5 * time.Millisecond
+)
+
+/*
+ * ledbatCongestionController implements a scavenger ("background") sending mode, after LEDBAT (RFC 6817). It yields to
+ * competing traffic by treating rising queueing delay as congestion, before any loss occurs.
+ *
+ * Queueing delay is estimated from the rtt probes: the current delay is the average of the last RttProbeAvg samples,
+ * and the base delay is the minimum sample seen over the last LedbatBaseHistory minutes. The target queueing delay is
+ * LedbatTargetGain times the base delay (at least ledbatMinTarget), so the controller yields at the same relative
+ * queue growth on short and long paths. While the queueing delay is below the target the window grows, at most as
+ * quickly as standard congestion avoidance; above the target it shrinks in proportion to the excess. Retransmissions
+ * halve the window, at most once per rtt.
+ */
+type ledbatCongestionController struct {
+	cwnd         float64
+	rxPortalSz   int
+	rttSamples   []time.Duration
+	baseHistory  []time.Duration
+	baseStart    time.Time
+	lastDecrease time.Time
+	profile      *Profile
+	peer         net.Addr
+	ii           InstrumentInstance
+	now          func() time.Time
+}
+
+func newLedbatCongestionController(profile *Profile, peer net.Addr, ii InstrumentInstance) CongestionController {
+	return &ledbatCongestionController{
+		cwnd:       float64(profile.TxPortalStartSz),
+		rxPortalSz: -1,
+		profile:    profile,
+		peer:       peer,
+		ii:         ii,
+		now:        time.Now,
+	}
+}
+
+func (self *ledbatCongestionController) Ack(sz int) {
+	if sz < 1 {
+		return
+	}
+	offTarget := 1.0
+	if queueingDelay, ok := self.queueingDelay(); ok {
+		target := float64(self.target())
+		offTarget = (target - float64(queueingDelay)) / target
+	}
+	cwnd := self.cwnd + self.profile.LedbatGain*offTarget*float64(sz)*float64(self.profile.MaxSegmentSz)/self.cwnd
+	self.updateCwnd(cwnd)
+}
+
+func (self *ledbatCongestionController) DuplicateAck() {}
+
+func (self *ledbatCongestionController) Retx() {
+	now := self.now()
+	if now.Sub(self.lastDecrease) < self.currentDelay() {
+		return
+	}
+	self.lastDecrease = now
+	self.updateCwnd(self.cwnd / 2)
+}
+
+func (self *ledbatCongestionController) Rtt(rtt time.Duration) {
+	self.rttSamples = append(self.rttSamples, rtt)
+	if len(self.rttSamples) > self.profile.RttProbeAvg {
+		self.rttSamples = self.rttSamples[1:]
+	}
+
+	now := self.now()
+	if len(self.baseHistory) < 1 || now.Sub(self.baseStart) >= ledbatBaseIntervalMs*time.Millisecond {
+		self.baseHistory = append(self.baseHistory, rtt)
+		if len(self.baseHistory) > self.profile.LedbatBaseHistory {
+			self.baseHistory = self.baseHistory[1:]
+		}
+		self.baseStart = now
+	} else if last := len(self.baseHistory) - 1; rtt < self.baseHistory[last] {
+		self.baseHistory[last] = rtt
+	}
+}
+
+func (self *ledbatCongestionController) RxPortalSz(sz int) {
+	self.rxPortalSz = sz
+}
+
+func (self *ledbatCongestionController) Available(txPortalSz, segmentSz int) int {
+	available := int(self.cwnd) - (txPortalSz + segmentSz)
+	if rxAvailable := self.profile.TxPortalMaxSz - (self.rxPortalSz + segmentSz); rxAvailable < available {
+		available = rxAvailable
+	}
+	return available
+}
+
+func (self *ledbatCongestionController) Capacity() int {
+	return int(self.cwnd)
+}
+
+/*
+ * queueingDelay is the current delay over the base delay. It is unavailable until the first rtt probe returns, and
+ * never negative; the averaged current delay may still include samples from before the base delay rose.
+ */
+func (self *ledbatCongestionController) queueingDelay() (time.Duration, bool) {
+	if len(self.rttSamples) < 1 {
+		return 0, false
+	}
+	var current time.Duration
+	for _, rtt := range self.rttSamples {
+		current += rtt
+	}
+	current /= time.Duration(len(self.rttSamples))
+
+	base := self.baseDelay()
+	if current < base {
+		return 0, true
+	}
+	return current - base, true
+}
+
+func (self *ledbatCongestionController) baseDelay() time.Duration {
+	base := self.baseHistory[0]
+	for _, rtt := range self.baseHistory[1:] {
+		if rtt < base {
+			base = rtt
+		}
+	}
+	return base
+}
+
+/*
+ * target is the queueing delay the controller yields above. It is only meaningful once an rtt probe has returned.
+ */
+func (self *ledbatCongestionController) target() time.Duration {
+	target := time.Duration(self.profile.LedbatTargetGain * float64(self.baseDelay()))
+	if target < ledbatMinTarget {
+		target = ledbatMinTarget
+	}
+	return target
+}
+
+func (self *ledbatCongestionController) currentDelay() time.Duration {
+	if len(self.rttSamples) < 1 {
+		return time.Duration(self.profile.RetxStartMs) * time.Millisecond
+	}
+	return self.rttSamples[len(self.rttSamples)-1]
+}
+
+func (self *ledbatCongestionController) updateCwnd(cwnd float64) {
+	minCwnd := float64(ledbatMinCwndSegments * self.profile.MaxSegmentSz)
+	if cwnd < minCwnd {
+		cwnd = minCwnd
+	}
+	if cwnd > float64(self.profile.TxPortalMaxSz) {
+		cwnd = float64(self.profile.TxPortalMaxSz)
+	}
+	oldCapacity := int(self.cwnd)
+	self.cwnd = cwnd
+	if int(self.cwnd) != oldCapacity {
+		self.ii.TxPortalCapacityChanged(self.peer, int(self.cwnd))
+	}
+}
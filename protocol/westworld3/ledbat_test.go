@@ -0,0 +1,186 @@
+package westworld3
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLedbatBelowTarget(t *testing.T) {
+	cc, _ := newTestLedbat()
+	start := cc.cwnd
+
+	// no delay samples yet; grows like congestion avoidance
+	cc.Ack(cc.profile.MaxSegmentSz)
+	assert.InDelta(t, start+float64(cc.profile.MaxSegmentSz*cc.profile.MaxSegmentSz)/start, cc.cwnd, 0.001)
+
+	// queueing delay well below target continues to grow
+	cc.Rtt(20 * time.Millisecond)
+	cc.Rtt(25 * time.Millisecond)
+	qd, ok := cc.queueingDelay()
+	assert.True(t, ok)
+	assert.Equal(t, 2500*time.Microsecond, qd)
+	for i := 0; i < 1000; i++ {
+		cc.Ack(cc.profile.MaxSegmentSz)
+	}
+	assert.True(t, cc.cwnd > start)
+	assert.Equal(t, int(cc.cwnd)-cc.profile.MaxSegmentSz, cc.Available(0, cc.profile.MaxSegmentSz))
+}
+
+func TestLedbatAboveTarget(t *testing.T) {
+	cc, _ := newTestLedbat()
+	cc.updateCwnd(float64(cc.profile.TxPortalStartSz))
+	minCwnd := float64(ledbatMinCwndSegments * cc.profile.MaxSegmentSz)
+
+	// base delay 100ms, current delay 100ms + 2 * target
+	cc.Rtt(100 * time.Millisecond)
+	target := cc.target()
+	assert.Equal(t, 25*time.Millisecond, target)
+	for i := 0; i < cc.profile.RttProbeAvg; i++ {
+		cc.Rtt(100*time.Millisecond + 2*target)
+	}
+	qd, _ := cc.queueingDelay()
+	assert.Equal(t, 2*target, qd)
+
+	last := cc.cwnd
+	for i := 0; i < 100; i++ {
+		cc.Ack(cc.profile.MaxSegmentSz)
+		assert.True(t, cc.cwnd < last)
+		last = cc.cwnd
+	}
+
+	// yields all the way down to the minimum window, below the portal minimum other controllers hold
+	for i := 0; i < 100000; i++ {
+		cc.Ack(cc.profile.MaxSegmentSz)
+	}
+	assert.Equal(t, minCwnd, cc.cwnd)
+	assert.True(t, cc.cwnd < float64(cc.profile.TxPortalMinSz))
+
+	// queue drains; growth resumes
+	for i := 0; i < cc.profile.RttProbeAvg; i++ {
+		cc.Rtt(100 * time.Millisecond)
+	}
+	cc.Ack(cc.profile.MaxSegmentSz)
+	assert.True(t, cc.cwnd > minCwnd)
+}
+
+func TestLedbatTarget(t *testing.T) {
+	cc, _ := newTestLedbat()
+
+	// the same queue growth yields on a short path, and not on a long one
+	cc.Rtt(10 * time.Millisecond)
+	cc.Rtt(30 * time.Millisecond)
+	assert.Equal(t, ledbatMinTarget, cc.target())
+	qd, _ := cc.queueingDelay()
+	assert.True(t, qd > cc.target())
+
+	cc, _ = newTestLedbat()
+	cc.Rtt(200 * time.Millisecond)
+	cc.Rtt(220 * time.Millisecond)
+	assert.Equal(t, time.Duration(cc.profile.LedbatTargetGain*200)*time.Millisecond, cc.target())
+	qd, _ = cc.queueingDelay()
+	assert.True(t, qd < cc.target())
+
+	// loopback and lan paths measure a base delay of 0ms
+	cc, _ = newTestLedbat()
+	cc.Rtt(0)
+	assert.Equal(t, ledbatMinTarget, cc.target())
+}
+
+func TestLedbatRetx(t *testing.T) {
+	cc, clock := newTestLedbat()
+	cc.updateCwnd(float64(cc.profile.TxPortalMaxSz))
+	cc.Rtt(40 * time.Millisecond)
+
+	cc.Retx()
+	assert.Equal(t, float64(cc.profile.TxPortalMaxSz/2), cc.cwnd)
+
+	// at most one decrease per rtt
+	cc.Retx()
+	clock.advance(20 * time.Millisecond)
+	cc.Retx()
+	assert.Equal(t, float64(cc.profile.TxPortalMaxSz/2), cc.cwnd)
+
+	clock.advance(20 * time.Millisecond)
+	cc.Retx()
+	assert.Equal(t, float64(cc.profile.TxPortalMaxSz/4), cc.cwnd)
+
+	// duplicate acks are not a congestion signal
+	cc.DuplicateAck()
+	assert.Equal(t, float64(cc.profile.TxPortalMaxSz/4), cc.cwnd)
+}
+
+func TestLedbatBaseHistory(t *testing.T) {
+	cc, clock := newTestLedbat()
+	cc.profile.LedbatBaseHistory = 2
+
+	cc.Rtt(10 * time.Millisecond)
+	cc.Rtt(30 * time.Millisecond)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, cc.baseHistory)
+
+	clock.advance(ledbatBaseIntervalMs * time.Millisecond)
+	cc.Rtt(30 * time.Millisecond)
+	cc.Rtt(25 * time.Millisecond)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 25 * time.Millisecond}, cc.baseHistory)
+
+	// a route change raising the base delay ages out the old minimum
+	clock.advance(ledbatBaseIntervalMs * time.Millisecond)
+	cc.Rtt(40 * time.Millisecond)
+	assert.Equal(t, []time.Duration{25 * time.Millisecond, 40 * time.Millisecond}, cc.baseHistory)
+	clock.advance(ledbatBaseIntervalMs * time.Millisecond)
+	cc.Rtt(40 * time.Millisecond)
+	assert.Equal(t, []time.Duration{40 * time.Millisecond, 40 * time.Millisecond}, cc.baseHistory)
+	qd, _ := cc.queueingDelay()
+	assert.Equal(t, time.Duration(0), qd)
+}
+
+func TestListenerPriorityClasses(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	lId := registerTestProfile(t)
+	GetProfile(lId).RetxAddMs = 50
+
+	bp := NewBaselineProfile()
+	bp.CongestionController = "ledbat"
+	bp.RetxAddMs = 50
+	bId, err := AddProfile(bp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, bId) })
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, lId)
+	defer func() { _ = l.Close() }()
+	_, isBaseline := conn.(*dialerConn).txPortal.cc.(*baselineCongestionController)
+	assert.True(t, isBaseline)
+	_, isBaseline = lConn.(*listenerConn).txPortal.cc.(*baselineCongestionController)
+	assert.True(t, isBaseline)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	bConn, err := Dial(l.Addr().(*net.UDPAddr), bId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var blConn net.Conn
+	select {
+	case blConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	_, isLedbat := bConn.(*dialerConn).txPortal.cc.(*ledbatCongestionController)
+	assert.True(t, isLedbat)
+	_, isLedbat = blConn.(*listenerConn).txPortal.cc.(*ledbatCongestionController)
+	assert.True(t, isLedbat)
+}
+
+func newTestLedbat() (*ledbatCongestionController, *testClock) {
+	profile := NewBaselineProfile()
+	clock := &testClock{t: time.Unix(1000, 0)}
+	cc := newLedbatCongestionController(profile, nil, NewNilInstrument().NewInstance("test", nil)).(*ledbatCongestionController)
+	cc.now = clock.now
+	return cc, clock
+}
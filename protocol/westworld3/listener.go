@@ -1,12 +1,16 @@
 package westworld3
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/emirpasic/gods/trees/btree"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type listener struct {
@@ -14,11 +18,18 @@ type listener struct {
 	profile     *Profile
 	profileId   byte
 	peers       *btree.Tree
+	ids         map[uint32]*listenerConn
 	acceptQueue chan net.Conn
-	conn        *net.UDPConn
-	addr        *net.UDPAddr
+	conn        net.PacketConn
+	addr        net.Addr
 	pool        *pool
+	cookies     *cookieMinter
+	ipRate      *rateLimiter // only used by run
+	subnetRate  *rateLimiter // only used by run
+	handshakes  int32        // in progress, from admission until accepted
 	ii          InstrumentInstance
+	closed      bool
+	closeCh     chan struct{}
 }
 
 func Listen(addr *net.UDPAddr, profileId byte) (net.Listener, error) {
@@ -38,32 +49,100 @@ func Listen(addr *net.UDPAddr, profileId byte) (net.Listener, error) {
 	if err := conn.SetWriteBuffer(profile.TxBufferSz); err != nil {
 		return nil, errors.Wrap(err, "set tx buffer size")
 	}
+	return listen(conn, profile, profileId)
+}
+
+/*
+ * ListenPacket accepts westworld3 connections over a caller-supplied packet connection, which may carry any unreliable
+ * datagram transport. The listener reads every datagram arriving on conn, and closes conn when it is closed.
+ */
+func ListenPacket(conn net.PacketConn, profileId byte) (net.Listener, error) {
+	profile, found := profileRegistry[profileId]
+	if !found {
+		return nil, errors.Errorf("profile [%d] not found in registry", int(profileId))
+	}
+	return listen(conn, profile, profileId)
+}
+
+func listen(conn net.PacketConn, profile *Profile, profileId byte) (net.Listener, error) {
+	cookies, err := newCookieMinter(profile.HelloCookieLifetimeMs)
+	if err != nil {
+		return nil, errors.Wrap(err, "cookies")
+	}
 	l := &listener{
 		lock:        new(sync.Mutex),
 		profile:     profile,
 		profileId:   profileId,
 		peers:       btree.NewWith(profile.ListenerPeersTreeLen, addrComparator),
+		ids:         make(map[uint32]*listenerConn),
 		acceptQueue: make(chan net.Conn, profile.AcceptQueueLen),
 		conn:        conn,
-		addr:        addr,
+		addr:        conn.LocalAddr(),
+		cookies:     cookies,
+		closeCh:     make(chan struct{}),
+	}
+	if profile.ListenerIpHelloRate > 0 {
+		l.ipRate = newRateLimiter(profile.ListenerIpHelloRate, profile.ListenerIpHelloBurst, profile.ListenerHelloRateBuckets)
 	}
-	listenerId := fmt.Sprintf("listener_%s", addr)
-	l.ii = profile.i.NewInstance(listenerId, addr)
-	l.pool = newPool(listenerId, uint32(dataStart+profile.MaxSegmentSz), l.ii)
+	if profile.ListenerSubnetHelloRate > 0 {
+		l.subnetRate = newRateLimiter(profile.ListenerSubnetHelloRate, profile.ListenerSubnetHelloBurst, profile.ListenerHelloRateBuckets)
+	}
+	listenerId := fmt.Sprintf("listener_%s", l.addr)
+	l.ii = profile.i.NewInstance(listenerId, l.addr)
+	// peers may have negotiated sealed connections, whose messages are opened in place once queued, and connection ids
+	l.pool = newPool(listenerId, uint32(dataStart+profile.MaxSegmentSz+sealOverhead+connectionIdSz), l.ii)
 	go l.run()
 	return l, nil
 }
 
 func (self *listener) Accept() (net.Conn, error) {
-	conn, ok := <-self.acceptQueue
-	if !ok {
+	select {
+	case conn, ok := <-self.acceptQueue:
+		if !ok {
+			return nil, errors.New("listener closed")
+		}
+		return conn, nil
+
+	case <-self.closeCh:
 		return nil, errors.New("listener closed")
 	}
-	return conn, nil
 }
 
 func (self *listener) Close() error {
-	return errors.Errorf("close not implemented")
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return errors.New("listener already closed")
+	}
+	self.closed = true
+	close(self.closeCh)
+	var peers []*listenerConn
+	for _, v := range self.peers.Values() {
+		peers = append(peers, v.(*listenerConn))
+	}
+	self.lock.Unlock()
+
+	logrus.Infof("closing listener [%s], draining %d peers", self.addr, len(peers))
+
+	for _, lc := range peers {
+		if err := lc.Close(); err != nil {
+			logrus.Errorf("error closing peer [%s] (%v)", lc.peer, err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Duration(self.profile.ListenerCloseTimeoutMs) * time.Millisecond)
+	for self.peerCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(self.profile.CloseCheckMs) * time.Millisecond)
+	}
+
+	for _, lc := range peers {
+		lc.closer.emergencyStop()
+	}
+
+	if err := self.conn.Close(); err != nil {
+		return errors.Wrap(err, "close conn")
+	}
+	return nil
 }
 
 func (self *listener) Addr() net.Addr {
@@ -76,16 +155,21 @@ func (self *listener) run() {
 	defer func() { self.ii.Shutdown() }()
 
 	for {
-		if wm, peer, err := readWireMessage(self.conn, self.pool); err == nil {
-			conn, found := self.peers.Get(peer)
-			if found {
-				lc := conn.(*listenerConn)
-				lc.queue(wm)
+		if buffer, peer, err := readBuffer(self.conn, self.pool); err == nil {
+			lc, validated := self.route(buffer, peer)
+			if lc != nil && validated {
+				lc.queue(buffer)
 
-			} else {
+			} else if lc != nil {
+				lc.queueUnvalidated(buffer, peer)
+
+			} else if wm, ok := decodeWireMessage(buffer, nil, peer, self.ii); ok {
 				self.ii.WireMessageRx(peer, wm)
-				if wm.messageType() == HELLO {
-					go self.hello(wm, peer)
+				if wm.messageType() == HELLO && !self.isClosed() {
+					if self.admit(wm, peer) {
+						atomic.AddInt32(&self.handshakes, 1)
+						go self.hello(wm, peer)
+					}
 
 				} else {
 					self.ii.UnknownPeer(peer)
@@ -93,50 +177,365 @@ func (self *listener) run() {
 				}
 			}
 		} else {
+			if self.isClosed() {
+				return
+			}
 			self.ii.ReadError(peer, err)
 		}
 	}
 }
 
-func (self *listener) hello(hello *wireMessage, peer *net.UDPAddr) {
+/*
+ * route finds the connection a datagram belongs to, by the peer's address or else by the connection id it starts with,
+ * stripping the connection id. A connection found only by its id is being reached from a new address, which has not
+ * been validated.
+ */
+func (self *listener) route(buffer *buffer, peer net.Addr) (lc *listenerConn, validated bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if conn, found := self.peers.Get(peer); found {
+		lc = conn.(*listenerConn)
+		if lc.cid != 0 && readConnectionId(buffer) == lc.cid {
+			stripConnectionId(buffer) // HELLO retransmissions are sent before the dialer has its connection id
+		}
+		return lc, true
+	}
+	if cid := readConnectionId(buffer); cid != 0 {
+		if lc, found := self.ids[cid]; found {
+			stripConnectionId(buffer)
+			return lc, false
+		}
+	}
+	return nil, false
+}
+
+/*
+ * migrate moves a connection to the validated address peer, unless the connection has closed, or another connection
+ * holds the address.
+ */
+func (self *listener) migrate(lc *listenerConn, peer net.Addr) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, found := self.ids[lc.cid]; !found {
+		return false
+	}
+	if conn, found := self.peers.Get(peer); found && conn.(*listenerConn) != lc {
+		return false
+	}
+	from := lc.path.addr()
+	if conn, found := self.peers.Get(from); found && conn.(*listenerConn) == lc {
+		self.peers.Remove(from)
+	}
+	self.peers.Put(peer, lc)
+	lc.path.migrate(peer)
+	return true
+}
+
+/*
+ * connectionId returns a connection id not in use by any other connection. Called with the lock held.
+ */
+func (self *listener) connectionId() (uint32, error) {
+	for {
+		cid, err := newConnectionId()
+		if err != nil {
+			return 0, err
+		}
+		if _, found := self.ids[cid]; !found {
+			return cid, nil
+		}
+	}
+}
+
+/*
+ * admit decides whether a HELLO from an unknown peer may start a handshake, before any per-peer state is created. The
+ * peer's address is validated by cookie when required, and then must pass admission control; peers refused by
+ * admission control are sent the reason.
+ */
+func (self *listener) admit(hello *wireMessage, peer net.Addr) bool {
+	if !self.validateCookie(hello, peer) {
+		return false
+	}
+	if reason := self.admission(peer); reason != 0 {
+		hello.buffer.unref()
+		self.refuse(peer, reason)
+		self.ii.HelloRejected(peer, errors.Errorf("refused (%s)", reason))
+		return false
+	}
+	return true
+}
+
+/*
+ * validateCookie checks the cookie echoed in a HELLO. Cookies are required when the profile enables them, or while
+ * HelloCookieThresh or more handshakes are in progress. A HELLO without a current cookie is answered with a retry
+ * carrying a fresh one; a HELLO with a forged cookie is dropped.
+ */
+func (self *listener) validateCookie(hello *wireMessage, peer net.Addr) bool {
+	pending := int(atomic.LoadInt32(&self.handshakes))
+	if !self.profile.HelloCookies && (self.profile.HelloCookieThresh < 1 || pending < self.profile.HelloCookieThresh) {
+		return true
+	}
+
+	cookie, err := hello.asCookie()
+	if err == nil && cookie != nil {
+		err = self.cookies.validate(cookie, peer)
+		if err == nil {
+			return true
+		}
+	}
+	hello.buffer.unref()
+
+	if cookie == nil || err == errCookieExpired {
+		self.retry(peer)
+	} else {
+		self.ii.HelloRejected(peer, err)
+	}
+	return false
+}
+
+/*
+ * admission applies the profile's accept filter, peer limit and handshake rate limits, in that order. Handshakes in
+ * progress count towards ListenerMaxPeers.
+ */
+func (self *listener) admission(peer net.Addr) refuseReason {
+	if self.profile.acceptFilter != nil && !self.profile.acceptFilter(peer) {
+		return refuseDenied
+	}
+	if self.profile.ListenerMaxPeers > 0 {
+		if self.peerCount()+int(atomic.LoadInt32(&self.handshakes)) >= self.profile.ListenerMaxPeers {
+			return refuseBusy
+		}
+	}
+	now := time.Now()
+	ip := addrIP(peer)
+	if self.ipRate != nil {
+		key := peer.String() // transports without IP addresses are limited per source address
+		if ip != nil {
+			key = ip.To16().String()
+		}
+		if !self.ipRate.allow(key, now) {
+			return refuseRateLimited
+		}
+	}
+	if self.subnetRate != nil && ip != nil {
+		if !self.subnetRate.allow(subnetKey(ip, self.profile.ListenerSubnetV4Prefix, self.profile.ListenerSubnetV6Prefix), now) {
+			return refuseRateLimited
+		}
+	}
+	return 0
+}
+
+func (self *listener) hello(hello *wireMessage, peer net.Addr) {
+	defer atomic.AddInt32(&self.handshakes, -1)
+
+	h, _, err := hello.asHello()
+	if err != nil {
+		hello.buffer.unref()
+		self.ii.ConnectionError(peer, errors.Wrap(err, "expected hello"))
+		return
+	}
+	kx, err := hello.asKeyExchange()
+	if err != nil {
+		hello.buffer.unref()
+		self.ii.ConnectionError(peer, errors.Wrap(err, "invalid key exchange"))
+		return
+	}
+	profile, agreed, reason := self.negotiate(h)
+	if reason == 0 {
+		reason = self.negotiateEncryption(profile, kx)
+	}
+	if reason != 0 {
+		hello.buffer.unref()
+		self.refuse(peer, reason)
+		self.ii.HelloRejected(peer, errors.Errorf("refused (%s)", reason))
+		return
+	}
+
+	_, requested, err := hello.asConnectionId()
+	if err != nil {
+		hello.buffer.unref()
+		self.ii.ConnectionError(peer, errors.Wrap(err, "invalid connection id"))
+		return
+	}
+
+	var conn *listenerConn
 	hook := func() {
 		self.lock.Lock()
-		self.peers.Remove(peer)
+		addr := conn.path.addr() // the connection may have migrated
+		if lc, found := self.peers.Get(addr); found && lc.(*listenerConn) == conn {
+			self.peers.Remove(addr)
+		}
+		if conn.cid != 0 {
+			delete(self.ids, conn.cid)
+		}
 		logrus.Infof("remaining peers: %d", self.peers.Size())
 		self.lock.Unlock()
-		logrus.Infof("removed peer [%s]", peer)
+		logrus.Infof("removed peer [%s]", addr)
 	}
-	conn, err := newListenerConn(self, self.conn, peer, self.profile, hook)
+	conn, err = newListenerConn(self, self.conn, peer, profile, hook)
 	if err != nil {
+		hello.buffer.unref()
 		self.ii.ConnectionError(peer, err)
 		return
 	}
 
 	self.lock.Lock()
+	if self.closed {
+		// Close has already taken its snapshot of peers to drain; a connection added now would never be closed
+		self.lock.Unlock()
+		hello.buffer.unref()
+		self.ii.ConnectionError(peer, errors.New("listener closed"))
+		return
+	}
+	if requested && profile.ConnectionIds {
+		if conn.cid, err = self.connectionId(); err != nil {
+			self.lock.Unlock()
+			hello.buffer.unref()
+			self.ii.ConnectionError(peer, err)
+			return
+		}
+		self.ids[conn.cid] = conn
+	}
 	self.peers.Put(peer, conn)
 	self.lock.Unlock()
 
-	if err := conn.hello(hello); err != nil {
+	if err := conn.hello(hello, agreed, kx); err != nil {
 		logrus.Errorf("error connecting (%v)", err)
 		self.ii.ConnectionError(peer, err)
+		conn.closer.emergencyStop()
 		return
 	}
 
-	self.acceptQueue <- conn
+	select {
+	case self.acceptQueue <- conn:
+		self.ii.Connected(peer)
 
-	self.ii.Connected(peer)
+	case <-self.closeCh:
+		if err := conn.Close(); err != nil {
+			logrus.Errorf("error closing unaccepted peer [%s] (%v)", peer, err)
+		}
+	}
 }
 
+/*
+ * negotiate selects the profile for a new connection from the hello advertised by the dialer. The requested profile is
+ * accepted when it is registered here with the same segment size and agreement digest, so that both ends hold the same
+ * settings under its id. Otherwise the listener's own profile is used, with its segment size downgraded to fit the
+ * dialer, unless HelloRequireProfile is set. A dialer refuses a listener profile whose agreement digest differs from its
+ * own.
+ */
+func (self *listener) negotiate(h hello) (*Profile, hello, refuseReason) {
+	if h.version != protocolVersion {
+		return nil, hello{}, refuseVersion
+	}
+	if int(h.maxSegmentSz) < minSegmentSz {
+		return nil, hello{}, refuseProfile
+	}
+
+	if p, found := profileRegistry[h.profile]; found {
+		if p.MaxSegmentSz == int(h.maxSegmentSz) && p.MaxSegmentSz <= self.profile.MaxSegmentSz && p.agreementDigest() == h.digest {
+			return p, hello{protocolVersion, h.profile, h.maxSegmentSz, h.digest}, 0
+		}
+	}
+	if self.profile.HelloRequireProfile {
+		return nil, hello{}, refuseProfile
+	}
+
+	p := self.profile
+	if int(h.maxSegmentSz) < p.MaxSegmentSz {
+		p = p.clone()
+		p.MaxSegmentSz = int(h.maxSegmentSz)
+	}
+	return p, hello{protocolVersion, self.profileId, uint16(p.MaxSegmentSz), p.agreementDigest()}, 0
+}
+
+/*
+ * negotiateEncryption requires the dialer to request the cipher suite of the negotiated profile, so that a listener
+ * never seals a connection the dialer cannot open. A listener whose own profile is encrypted refuses cleartext
+ * connections, even for registered cleartext profiles.
+ */
+func (self *listener) negotiateEncryption(profile *Profile, kx *keyExchange) refuseReason {
+	suite, err := cipherSuiteFor(profile.Encryption)
+	if err != nil {
+		return refuseEncryption
+	}
+	requested := cipherNone
+	if kx != nil {
+		requested = kx.suite
+	}
+	if requested != suite {
+		return refuseEncryption
+	}
+	if listenerSuite, _ := cipherSuiteFor(self.profile.Encryption); suite == cipherNone && listenerSuite != cipherNone {
+		return refuseEncryption
+	}
+	return 0
+}
+
+func (self *listener) refuse(peer net.Addr, reason refuseReason) {
+	refuse, err := newRefuse(reason, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating refuse (%v)", err)
+		return
+	}
+	defer refuse.buffer.unref()
+	if err := writeWireMessage(refuse, newPath(self.conn, peer), nil); err != nil {
+		logrus.Errorf("error sending refuse to [%s] (%v)", peer, err)
+		return
+	}
+	self.ii.WireMessageTx(peer, refuse)
+}
+
+func (self *listener) retry(peer net.Addr) {
+	retry, err := newRetry(self.cookies.mint(peer), self.pool)
+	if err != nil {
+		logrus.Errorf("error creating retry (%v)", err)
+		return
+	}
+	defer retry.buffer.unref()
+	if err := writeWireMessage(retry, newPath(self.conn, peer), nil); err != nil {
+		logrus.Errorf("error sending retry to [%s] (%v)", peer, err)
+		return
+	}
+	self.ii.WireMessageTx(peer, retry)
+	self.ii.HelloRetry(peer)
+}
+
+func (self *listener) peerCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.peers.Size()
+}
+
+func (self *listener) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+/*
+ * addrComparator orders UDP peers by their 16-byte IP representation (so that IPv4 and IPv4-mapped IPv6 forms of the
+ * same address compare equal), then by port, then by IPv6 zone. Peers on other transports follow, ordered by network
+ * and then address.
+ */
 func addrComparator(i, j interface{}) int {
-	ai := i.(*net.UDPAddr)
-	aj := j.(*net.UDPAddr)
-	for l := 0; l < 4; l++ {
-		if ai.IP[l] < aj.IP[l] {
+	ai, iUdp := i.(*net.UDPAddr)
+	aj, jUdp := j.(*net.UDPAddr)
+	if !iUdp || !jUdp {
+		if iUdp {
 			return -1
 		}
-		if ai.IP[l] > aj.IP[l] {
+		if jUdp {
 			return 1
 		}
+		if c := strings.Compare(i.(net.Addr).Network(), j.(net.Addr).Network()); c != 0 {
+			return c
+		}
+		return strings.Compare(i.(net.Addr).String(), j.(net.Addr).String())
+	}
+	if c := bytes.Compare(ai.IP.To16(), aj.IP.To16()); c != 0 {
+		return c
 	}
 	if ai.Port < aj.Port {
 		return -1
@@ -144,5 +543,5 @@ func addrComparator(i, j interface{}) int {
 	if ai.Port > aj.Port {
 		return 1
 	}
-	return 0
+	return strings.Compare(ai.Zone, aj.Zone)
 }
@@ -0,0 +1,417 @@
+package westworld3
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerClose(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+
+	_, err := conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	start := time.Now()
+	assert.NoError(t, l.Close())
+	assert.True(t, time.Since(start) < time.Duration(GetProfile(profileId).ListenerCloseTimeoutMs)*time.Millisecond)
+	assert.Equal(t, 0, l.(*listener).peerCount())
+
+	_, err = l.Accept()
+	assert.Error(t, err)
+
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Error(t, l.Close())
+}
+
+func TestListenerCloseLateHello(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	ll := l.(*listener)
+
+	// a handshake which was admitted before Close took its snapshot of peers is not added to them afterwards
+	ll.lock.Lock()
+	ll.closed = true
+	ll.lock.Unlock()
+	wm, err := newHello(0, hello{version: protocolVersion, profile: profileId, maxSegmentSz: 1450}, nil, ll.pool)
+	assert.NoError(t, err)
+	go ll.hello(wm, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, ll.peerCount())
+
+	ll.lock.Lock()
+	ll.closed = false
+	ll.lock.Unlock()
+}
+
+func TestAddrComparator(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6262}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6262}
+	assert.Equal(t, 0, addrComparator(v4, mapped))
+
+	a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6262}
+	b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 6262}
+	assert.Equal(t, -1, addrComparator(a, b))
+	assert.Equal(t, 1, addrComparator(b, a))
+	assert.NotEqual(t, 0, addrComparator(a, v4))
+
+	eth0 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}
+	eth1 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth1"}
+	assert.Equal(t, -1, addrComparator(eth0, eth1))
+	assert.Equal(t, 0, addrComparator(eth0, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 6262, Zone: "eth0"}))
+
+	// peers on other transports follow UDP peers
+	assert.Equal(t, -1, addrComparator(v4, memAddr("a")))
+	assert.Equal(t, 1, addrComparator(memAddr("a"), v4))
+	assert.Equal(t, -1, addrComparator(memAddr("a"), memAddr("b")))
+	assert.Equal(t, 0, addrComparator(memAddr("a"), memAddr("a")))
+}
+
+func TestListenerIPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+	profileId := registerTestProfile(t)
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv6loopback}, profileId)
+	defer func() { _ = l.Close() }()
+
+	assert.True(t, lConn.RemoteAddr().(*net.UDPAddr).IP.Equal(net.IPv6loopback))
+	assert.True(t, conn.RemoteAddr().(*net.UDPAddr).IP.Equal(net.IPv6loopback))
+
+	_, err := conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = lConn.Write([]byte("world"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+}
+
+func TestListenerDualStackPeers(t *testing.T) {
+	skipWithoutIPv6(t)
+	profileId := registerTestProfile(t)
+	l, conn6, lConn6 := connectTestPair(t, &net.UDPAddr{IP: net.IPv6unspecified}, profileId)
+	defer func() { _ = l.Close() }()
+
+	// a second peer arriving over ipv4 is presented as an ipv4-mapped address, and must not collide with the first
+	port := l.Addr().(*net.UDPAddr).Port
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	conn4, err := Dial(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, profileId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var lConn4 net.Conn
+	select {
+	case lConn4 = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	assert.Equal(t, 2, l.(*listener).peerCount())
+
+	_, err = conn6.Write([]byte("six"))
+	assert.NoError(t, err)
+	_, err = conn4.Write([]byte("for"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(lConn6, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "six", string(buf))
+	_, err = io.ReadFull(lConn4, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "for", string(buf))
+}
+
+/*
+ * TestListenerIPv6Metrics checks that instrument ids built from IPv6 addresses name the metrics written for each peer.
+ */
+func TestListenerIPv6Metrics(t *testing.T) {
+	skipWithoutIPv6(t)
+	profileId := registerTestProfile(t)
+	path := t.TempDir()
+	// snapshots disabled; only the ids are checked, and the snapshotters would race with writeAllSamples
+	i, err := NewMetricsInstrument(map[string]interface{}{"path": path, "snapshot_ms": 50, "enabled": false})
+	assert.NoError(t, err)
+	GetProfile(profileId).i = i
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv6loopback}, profileId)
+	defer func() { _ = l.Close() }()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, i.(*metricsInstrument).writeAllSamples())
+	entries, err := ioutil.ReadDir(path)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, id := range []string{
+		fmt.Sprintf("listener_%s", l.Addr()),
+		fmt.Sprintf("listenerConn_%s_%s", l.Addr(), lConn.RemoteAddr()),
+		fmt.Sprintf("dialerConn_%s_%s", conn.LocalAddr(), conn.RemoteAddr()),
+	} {
+		prefix := strings.ReplaceAll(id+"_", ":", "-")
+		found := false
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				found = true
+				_, err := os.Stat(filepath.Join(path, name, "metrics.id"))
+				assert.NoError(t, err)
+			}
+		}
+		assert.True(t, found, "no metrics for [%s] in %v", id, names)
+	}
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("ipv6 loopback unavailable (%v)", err)
+	}
+	_ = conn.Close()
+}
+
+func registerTestProfile(t *testing.T) byte {
+	logrus.SetLevel(logrus.ErrorLevel)
+	p := NewBaselineProfile()
+	p.CloseWaitMs = 100
+	p.CloseCheckMs = 50
+	p.ListenerCloseTimeoutMs = 2000
+	id, err := AddProfile(p)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, id) })
+	return id
+}
+
+func connectTestPair(t *testing.T, addr *net.UDPAddr, profileId byte) (l net.Listener, conn net.Conn, lConn net.Conn) {
+	l, err := Listen(addr, profileId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err = Dial(l.Addr().(*net.UDPAddr), profileId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	select {
+	case lConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	return l, conn, lConn
+}
+
+func TestListenerNegotiate(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	lp := NewBaselineProfile()
+	lp.MaxSegmentSz = 1000
+	lId, err := AddProfile(lp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, lId) })
+
+	small := NewBaselineProfile()
+	small.MaxSegmentSz = 800
+	smallId, err := AddProfile(small)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, smallId) })
+
+	l := &listener{profile: lp, profileId: lId}
+	smallDigest := small.agreementDigest()
+
+	// registered profile with matching segment size and digest is accepted as-is
+	p, agreed, reason := l.negotiate(hello{protocolVersion, smallId, 800, smallDigest})
+	assert.Equal(t, refuseReason(0), reason)
+	assert.Equal(t, small, p)
+	assert.Equal(t, hello{protocolVersion, smallId, 800, smallDigest}, agreed)
+
+	// unknown profile falls back to the listener profile, downgraded to the dialer's segment size
+	p, agreed, reason = l.negotiate(hello{protocolVersion, 250, 900, 0})
+	assert.Equal(t, refuseReason(0), reason)
+	assert.Equal(t, 900, p.MaxSegmentSz)
+	assert.Equal(t, 1000, lp.MaxSegmentSz)
+	assert.Equal(t, hello{protocolVersion, lId, 900, lp.agreementDigest()}, agreed)
+
+	// larger dialer segment size is clamped to the listener's
+	p, agreed, reason = l.negotiate(hello{protocolVersion, 250, 1450, 0})
+	assert.Equal(t, refuseReason(0), reason)
+	assert.Equal(t, lp, p)
+	assert.Equal(t, hello{protocolVersion, lId, 1000, lp.agreementDigest()}, agreed)
+
+	// the dialer holds different settings under the same id, so the listener profile is used
+	wide := small.clone()
+	wide.RttProbeWide = !small.RttProbeWide
+	assert.NotEqual(t, smallDigest, wide.agreementDigest())
+	p, agreed, reason = l.negotiate(hello{protocolVersion, smallId, 800, wide.agreementDigest()})
+	assert.Equal(t, refuseReason(0), reason)
+	assert.Equal(t, 800, p.MaxSegmentSz)
+	assert.Equal(t, hello{protocolVersion, lId, 800, lp.agreementDigest()}, agreed)
+
+	_, _, reason = l.negotiate(hello{protocolVersion + 1, smallId, 800, smallDigest})
+	assert.Equal(t, refuseVersion, reason)
+
+	_, _, reason = l.negotiate(hello{protocolVersion, smallId, minSegmentSz - 1, smallDigest})
+	assert.Equal(t, refuseProfile, reason)
+
+	lp.HelloRequireProfile = true
+	_, _, reason = l.negotiate(hello{protocolVersion, 250, 900, 0})
+	assert.Equal(t, refuseProfile, reason)
+	_, _, reason = l.negotiate(hello{protocolVersion, smallId, 800, wide.agreementDigest()})
+	assert.Equal(t, refuseProfile, reason)
+	_, _, reason = l.negotiate(hello{protocolVersion, smallId, 800, smallDigest})
+	assert.Equal(t, refuseReason(0), reason)
+}
+
+func TestListenerSegmentSzDowngrade(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	dp := NewBaselineProfile()
+	dp.MaxSegmentSz = 1450
+	dp.RetxAddMs = 50
+	dId, err := AddProfile(dp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, dId) })
+
+	lp := NewBaselineProfile()
+	lp.MaxSegmentSz = 1000
+	lp.RetxAddMs = 50
+	lp.CloseWaitMs = 100
+	lp.CloseCheckMs = 50
+	lp.ListenerCloseTimeoutMs = 2000
+	lId, err := AddProfile(lp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, lId) })
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, lId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := Dial(l.Addr().(*net.UDPAddr), dId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var lConn net.Conn
+	select {
+	case lConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+
+	assert.Equal(t, 1000, conn.(*dialerConn).profile.MaxSegmentSz)
+	assert.Equal(t, 1000, lConn.(*listenerConn).profile.MaxSegmentSz)
+	assert.Equal(t, 1450, dp.MaxSegmentSz)
+
+	data := make([]byte, 8*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() { _, _ = conn.Write(data) }()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestListenerRefuseProfile(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	lp := NewBaselineProfile()
+	lp.MaxSegmentSz = 1000
+	lp.HelloRequireProfile = true
+	lId, err := AddProfile(lp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, lId) })
+
+	dp := NewBaselineProfile()
+	dp.MaxSegmentSz = 1450
+	dId, err := AddProfile(dp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, dId) })
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, lId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	// dialer profile is known to the listener, but exceeds its segment size
+	start := time.Now()
+	_, err = Dial(l.Addr().(*net.UDPAddr), dId)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), "refused")
+	assert.True(t, time.Since(start) < time.Duration(dp.ConnectionSetupTimeoutMs)*time.Millisecond)
+	assert.Equal(t, 0, l.(*listener).peerCount())
+}
+
+func TestListenerProfileMismatch(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	dp := NewBaselineProfile()
+	dp.MaxSegmentSz = 1450
+	dp.ConnectionSetupTimeoutMs = 500
+	dId, err := AddProfile(dp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, dId) })
+
+	// the dialer's profile does not fit the listener, which agrees to its own profile with different settings
+	lp := NewBaselineProfile()
+	lp.MaxSegmentSz = 1000
+	lp.RttProbeWide = !dp.RttProbeWide
+	lp.ConnectionSetupTimeoutMs = 500
+	lp.CloseWaitMs = 100
+	lp.CloseCheckMs = 50
+	lp.ListenerCloseTimeoutMs = 2000
+	lId, err := AddProfile(lp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, lId) })
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, lId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	_, err = Dial(l.Addr().(*net.UDPAddr), dId)
+	assert.Error(t, err)
+}
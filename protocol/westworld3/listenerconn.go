@@ -6,56 +6,90 @@ import (
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"math"
 	"math/big"
 	"net"
 	"time"
 )
 
 type listenerConn struct {
-	listener *listener
-	conn     *net.UDPConn
-	peer     *net.UDPAddr
-	rxQueue  chan *wireMessage
-	seq      *util.Sequence
-	txPortal *txPortal
-	rxPortal *rxPortal
-	closer   *closer
-	pool     *pool
-	profile  *Profile
-	ii       InstrumentInstance
-}
-
-func newListenerConn(listener *listener, conn *net.UDPConn, peer *net.UDPAddr, profile *Profile, callerHook func()) (*listenerConn, error) {
-	startSeq := int64(0)
+	listener    *listener
+	conn        net.PacketConn
+	peer        net.Addr
+	path        *path
+	cid         uint32 // assigned by the listener during hello, 0 without a connection id
+	rxQueue     chan *buffer
+	unvalidated chan *pathDatagram
+	challenge   *pathChallenge // only used by rxer
+	seq         *util.Sequence
+	txPortal    *txPortal
+	rxPortal    *rxPortal
+	closer      *closer
+	sealer      *sealer
+	defrag      *reassembler
+	pool        *pool
+	profile     *Profile
+	ii          InstrumentInstance
+}
+
+/*
+ * pathDatagram is a datagram carrying a connection's id, received from an address other than the connection's path.
+ */
+type pathDatagram struct {
+	buffer *buffer
+	peer   net.Addr
+}
+
+type pathChallenge struct {
+	token int64
+	peer  net.Addr
+	sent  time.Time
+}
+
+// unvalidatedQueueLen bounds the datagrams from new addresses waiting on a connection's rxer; the rest are dropped
+const unvalidatedQueueLen = 16
+
+func newListenerConn(listener *listener, conn net.PacketConn, peer net.Addr, profile *Profile, callerHook func()) (*listenerConn, error) {
+	profile = profile.clone() // registered profiles are shared between connections; never mutate them
+	startSeq := int64(profile.startSeq)
 	if profile.RandomizeSeq {
-		randomSeq, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt32))
+		randomSeq, err := rand.Int(rand.Reader, big.NewInt(int64(seqMask)))
 		if err != nil {
 			return nil, errors.Wrap(err, "randomize sequence")
 		}
 		startSeq = randomSeq.Int64()
 	}
 	lc := &listenerConn{
-		listener: listener,
-		conn:     conn,
-		peer:     peer,
-		rxQueue:  make(chan *wireMessage, profile.ListenerRxQueueLen),
-		seq:      util.NewSequence(int32(startSeq)),
-		profile:  profile,
+		listener:    listener,
+		conn:        conn,
+		peer:        peer,
+		path:        newPath(conn, peer),
+		rxQueue:     make(chan *buffer, profile.ListenerRxQueueLen),
+		unvalidated: make(chan *pathDatagram, unvalidatedQueueLen),
+		seq:         util.NewSequence(int32(startSeq)),
+		profile:     profile,
 	}
 	id := fmt.Sprintf("listenerConn_%s_%s", listener.addr, peer)
 	lc.ii = profile.i.NewInstance(id, peer)
+	sealer, err := newSealer(id, profile, lc.ii)
+	if err != nil {
+		return nil, errors.Wrap(err, "sealer")
+	}
+	lc.sealer = sealer
 	lc.pool = newPool(id, uint32(dataStart+profile.MaxSegmentSz), lc.ii)
+	lc.defrag = newReassembler(lc.pool)
 	closeHook := func() {
 		lc.ii.Shutdown()
-		close(lc.rxQueue)
 		if callerHook != nil {
 			callerHook()
 		}
 	}
 	lc.closer = newCloser(lc.seq, lc.profile, closeHook)
-	lc.txPortal = newTxPortal(conn, peer, lc.closer, profile, lc.pool, lc.ii)
-	lc.rxPortal = newRxPortal(conn, peer, lc.txPortal, lc.seq, lc.closer, profile, lc.ii)
+	lc.txPortal = newTxPortal(lc.path, peer, lc.closer, profile, lc.pool, lc.ii)
+	lc.rxPortal = newRxPortal(lc.path, peer, lc.txPortal, lc.seq, lc.closer, profile, lc.ii)
+	lc.txPortal.rxPortal = lc.rxPortal
+	lc.txPortal.sealer = lc.sealer
+	lc.txPortal.monitor.sealer = lc.sealer
+	lc.rxPortal.sealer = lc.sealer
 	lc.closer.txPortal = lc.txPortal
 	lc.closer.rxPortal = lc.rxPortal
 	return lc, nil
@@ -74,8 +108,35 @@ func (self *listenerConn) Close() error {
 	return self.txPortal.sendClose(self.seq)
 }
 
+func (self *listenerConn) CloseWrite() error {
+	logrus.Infof("close write requested")
+	return self.txPortal.sendFin(self.seq)
+}
+
+func (self *listenerConn) CloseRead() error {
+	logrus.Infof("close read requested")
+	self.rxPortal.closeRead()
+	return nil
+}
+
+/*
+ * SendDatagram sends p to the peer as a single unreliable, unordered datagram of at most MaxSegmentSz bytes (less the
+ * seal and connection id, where used). With PmtuDiscovery, datagrams are limited to the segment size currently
+ * discovered for the path, which starts at PmtuMinSegmentSz.
+ */
+func (self *listenerConn) SendDatagram(p []byte) error {
+	return self.txPortal.sendDatagram(p)
+}
+
+/*
+ * ReceiveDatagram returns the next datagram sent by the peer with SendDatagram.
+ */
+func (self *listenerConn) ReceiveDatagram() ([]byte, error) {
+	return self.rxPortal.receiveDatagram()
+}
+
 func (self *listenerConn) RemoteAddr() net.Addr {
-	return self.peer
+	return self.path.addr()
 }
 
 func (self *listenerConn) LocalAddr() net.Addr {
@@ -83,19 +144,35 @@ func (self *listenerConn) LocalAddr() net.Addr {
 }
 
 func (self *listenerConn) SetDeadline(t time.Time) error {
+	self.rxPortal.setReadDeadline(t)
+	self.txPortal.setWriteDeadline(t)
 	return nil
 }
 
 func (self *listenerConn) SetReadDeadline(t time.Time) error {
+	self.rxPortal.setReadDeadline(t)
 	return nil
 }
 
 func (self *listenerConn) SetWriteDeadline(t time.Time) error {
+	self.txPortal.setWriteDeadline(t)
 	return nil
 }
 
-func (self *listenerConn) queue(wm *wireMessage) {
-	self.rxQueue <- wm
+func (self *listenerConn) queue(buffer *buffer) {
+	select {
+	case self.rxQueue <- buffer:
+	case <-self.closer.closed:
+		buffer.unref()
+	}
+}
+
+func (self *listenerConn) queueUnvalidated(buffer *buffer, peer net.Addr) {
+	select {
+	case self.unvalidated <- &pathDatagram{buffer, peer}:
+	default:
+		buffer.unref()
+	}
 }
 
 func (self *listenerConn) rxer() {
@@ -103,15 +180,36 @@ func (self *listenerConn) rxer() {
 	defer logrus.Warn("exited")
 
 	for {
-		wm, ok := <-self.rxQueue
-		if !ok {
+		var buffer *buffer
+		select {
+		case buffer = <-self.rxQueue:
+		case pd := <-self.unvalidated:
+			self.rxUnvalidated(pd)
+			continue
+		case <-self.closer.closed:
 			return
 		}
+		wm, ok := decodeWireMessage(buffer, self.sealer, self.peer, self.ii)
+		if !ok {
+			continue
+		}
 		self.ii.WireMessageRx(self.peer, wm)
 
+		if wm.messageType() == FRAGMENT {
+			reassembled, err := self.defrag.add(wm)
+			if err != nil {
+				logrus.Errorf("error reassembling (%v)", err)
+				continue
+			}
+			if reassembled == nil {
+				continue
+			}
+			wm = reassembled
+		}
+
 		switch wm.messageType() {
 		case DATA:
-			_, rttTs, err := wm.asData()
+			_, rttTs, acks, rxPortalSz, err := wm.asData()
 			if err != nil {
 				logrus.Errorf("as data error (%v)", err)
 				continue
@@ -119,6 +217,12 @@ func (self *listenerConn) rxer() {
 			if rttTs != nil {
 				self.txPortal.rtt(*rttTs)
 			}
+			if len(acks) > 0 {
+				self.txPortal.updateRxPortalSz(int(rxPortalSz))
+				if err := self.txPortal.ack(acks); err != nil {
+					logrus.Errorf("error acking inline (%v)", err)
+				}
+			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error rx-ing (%v)", err)
 				continue
@@ -148,11 +252,18 @@ func (self *listenerConn) rxer() {
 				continue
 			}
 			self.txPortal.updateRxPortalSz(rxPortalSz)
+			// pmtu messages are reported by the txPortal, rather than as keepalives
+			pmtu := wm.hasFlag(PMTU_PROBE) || wm.hasFlag(PMTU_ACK)
+			if pmtu {
+				self.txPortal.pmtu(wm)
+			}
 			if err := self.rxPortal.rx(wm); err != nil {
 				logrus.Errorf("error forwarding keepalive to rxPortal (%v)", err)
 				continue
 			}
-			self.ii.RxKeepalive(self.peer, wm)
+			if !pmtu {
+				self.ii.RxKeepalive(self.peer, wm)
+			}
 			wm.buffer.unref()
 
 		case CLOSE:
@@ -160,6 +271,12 @@ func (self *listenerConn) rxer() {
 				logrus.Errorf("error rx-ing close (%v)", err)
 			}
 
+		case DATAGRAM:
+			if err := self.rxPortal.rx(wm); err != nil {
+				logrus.Errorf("error rx-ing datagram (%v)", err)
+				wm.buffer.unref()
+			}
+
 		default:
 			logrus.Errorf("unexpected message type: %d", wm.mt)
 			self.ii.UnexpectedMessageType(self.peer, wm.mt)
@@ -168,27 +285,97 @@ func (self *listenerConn) rxer() {
 	}
 }
 
-func (self *listenerConn) hello(wm *wireMessage) error {
+/*
+ * rxUnvalidated handles a datagram carrying this connection's id from a new address. Nothing is accepted from the new
+ * address until it echoes a CHALLENGE sent there, when the connection migrates to it. Challenges to an address are
+ * repeated at most every PathChallengeMs.
+ */
+func (self *listenerConn) rxUnvalidated(pd *pathDatagram) {
+	wm, ok := decodeWireMessage(pd.buffer, self.sealer, pd.peer, self.ii)
+	if !ok {
+		return
+	}
+	defer wm.buffer.unref()
+	self.ii.WireMessageRx(pd.peer, wm)
+
+	pending := self.challenge != nil && addrComparator(self.challenge.peer, pd.peer) == 0
+	if pending && wm.messageType() == KEEPALIVE && wm.hasFlag(RESPONSE) {
+		if token, err := wm.asPathToken(); err == nil && token == self.challenge.token {
+			self.challenge = nil
+			self.ii.RxPathResponse(self.peer, pd.peer)
+			from := self.path.addr()
+			if self.listener.migrate(self, pd.peer) {
+				logrus.Infof("migrated [%s] -> [%s]", from, pd.peer)
+				self.ii.ConnectionMigrated(from, pd.peer)
+			}
+			return
+		}
+	}
+	if pending && time.Since(self.challenge.sent) < time.Duration(self.profile.PathChallengeMs)*time.Millisecond {
+		return
+	}
+
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		logrus.Errorf("error creating path challenge token (%v)", err)
+		return
+	}
+	challenge := &pathChallenge{token: util.ReadInt64(data), peer: pd.peer, sent: time.Now()}
+	if err := self.txPortal.pathChallenge(challenge.token, newPath(self.conn, pd.peer)); err != nil {
+		logrus.Errorf("error sending path challenge to [%s] (%v)", pd.peer, err)
+		return
+	}
+	self.challenge = challenge
+}
+
+func (self *listenerConn) hello(wm *wireMessage, agreed hello, kx *keyExchange) error {
 	logrus.Infof("starting hello process")
 	defer logrus.Infof("completed hello process")
 
 	// Receive Hello
-	if hello, _, err := wm.asHello(); err == nil {
+	if _, _, err := wm.asHello(); err == nil {
 		self.rxPortal.setAccepted(wm.seq)
+		self.txPortal.rttWide = self.profile.RttProbeWide && wm.wideRtt()
 		wm.buffer.unref()
 
+		if self.sealer != nil {
+			if err := self.sealer.establish(kx, false); err != nil {
+				err = errors.Wrap(err, "establish keys")
+				self.ii.ConnectionError(self.peer, err)
+				return err
+			}
+		}
+
 		helloAckSeq := self.seq.Next()
-		helloAck, err := newHello(helloAckSeq, hello, &ack{wm.seq, wm.seq}, self.pool)
+		helloAck, err := newHello(helloAckSeq, agreed, &ack{wm.seq, wm.seq}, self.pool)
 		if err != nil {
 			err = errors.Wrap(err, "new hello")
 			self.ii.ConnectionError(self.peer, err)
 			return err
 		}
 		defer helloAck.buffer.unref()
+		if self.cid != 0 {
+			if err := helloAck.setConnectionId(self.cid); err != nil {
+				err = errors.Wrap(err, "connection id")
+				self.ii.ConnectionError(self.peer, err)
+				return err
+			}
+		}
+		if self.txPortal.rttWide {
+			helloAck.setWideRtt()
+		}
+		if self.sealer != nil {
+			if err := helloAck.appendKeyExchange(self.sealer.keyExchange()); err != nil {
+				err = errors.Wrap(err, "key exchange")
+				self.ii.ConnectionError(self.peer, err)
+				return err
+			}
+		}
 
 		for i := 0; i < 5; i++ {
 			// Send Hello Ack
-			if err := writeWireMessage(helloAck, self.conn, self.peer); err != nil {
+			sent := time.Now()
+			if err := writeWireMessage(helloAck, self.path, nil); err != nil {
 				err = errors.Wrap(err, "write hello ack")
 				self.ii.ConnectionError(self.peer, err)
 				return err
@@ -197,11 +384,15 @@ func (self *listenerConn) hello(wm *wireMessage) error {
 
 			// Receive Response Ack
 			select {
-			case ackWm, ok := <-self.rxQueue:
+			case <-self.closer.closed:
+				err = errors.New("closed during hello")
+				self.ii.ConnectionError(self.peer, err)
+				return err
+
+			case buffer := <-self.rxQueue:
+				ackWm, ok := decodeWireMessage(buffer, self.sealer, self.peer, self.ii)
 				if !ok {
-					err = errors.New("rx queue closed")
-					self.ii.ConnectionError(self.peer, err)
-					return err
+					continue
 				}
 				defer ackWm.buffer.unref()
 				self.ii.WireMessageRx(self.peer, ackWm)
@@ -217,6 +408,10 @@ func (self *listenerConn) hello(wm *wireMessage) error {
 							continue
 						}
 
+						if i == 0 {
+							self.txPortal.helloRtt(time.Since(sent))
+						}
+
 						// connection established, now we can start
 						go self.rxer()
 						go self.txPortal.start()
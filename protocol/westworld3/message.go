@@ -5,6 +5,7 @@ import (
 	"github.com/pkg/errors"
 	"net"
 	"strings"
+	"time"
 )
 
 type wireMessage struct {
@@ -22,28 +23,49 @@ const (
 	DATA
 	KEEPALIVE
 	CLOSE
+	REFUSE
+	DATAGRAM
+	FRAGMENT // part of a message retransmitted after the path mtu shrank below its size
 )
 
 const messageTypeMask = byte(0x7)
 
+/*
+ * Flags occupy the bits above the message type, and are interpreted per message type, so a bit may mean something
+ * different on each type:
+ *
+ *   HELLO      INLINE_ACK, COOKIE, CONN_ID
+ *   ACK        RTT, RTT_US
+ *   DATA       RTT, INLINE_ACK, FIN, RTT_US
+ *   KEEPALIVE  CHALLENGE, RESPONSE, PMTU_PROBE, PMTU_ACK
+ *
+ * All eight types are assigned, so new kinds of message are carried as flags on an existing type (as KEEPALIVE carries
+ * the pmtu and path messages). 0x80 remains free on every type but HELLO.
+ */
 type messageFlag uint8
 
 const (
 	// 0x8 ... 0x80
 	RTT        messageFlag = 0x8
 	INLINE_ACK messageFlag = 0x10
+	FIN        messageFlag = 0x20 // DATA; end of the sender's stream, delivered in sequence
+	COOKIE     messageFlag = 0x40 // HELLO; echoes the listener's address validation cookie
+	RTT_US     messageFlag = 0x40 // DATA, ACK; the rtt probe is a wide (microsecond) timestamp
+	PMTU_PROBE messageFlag = 0x20 // KEEPALIVE; padded to the probed size, answered with PMTU_ACK
+	PMTU_ACK   messageFlag = 0x40 // KEEPALIVE; confirms the size of a PMTU_PROBE received by the peer
+	CONN_ID    messageFlag = 0x80 // HELLO; requests (dialer) or assigns (listener) a connection id
+	CHALLENGE  messageFlag = 0x8  // KEEPALIVE; path challenge, validating the peer's new address
+	RESPONSE   messageFlag = 0x10 // KEEPALIVE; path response, echoing the token of a CHALLENGE
 )
 
 const dataStart = 7
 
-func readWireMessage(conn *net.UDPConn, pool *pool) (wm *wireMessage, peer *net.UDPAddr, err error) {
-	buffer := pool.get()
-	var n int
-	n, peer, err = conn.ReadFromUDP(buffer.data)
+func readWireMessage(conn net.PacketConn, pool *pool) (wm *wireMessage, peer net.Addr, err error) {
+	var buffer *buffer
+	buffer, peer, err = readBuffer(conn, pool)
 	if err != nil {
-		return nil, peer, errors.Wrap(err, "peer read")
+		return nil, peer, err
 	}
-	buffer.uz = uint32(n)
 
 	wm, err = decodeHeader(buffer)
 	if err != nil {
@@ -53,20 +75,57 @@ func readWireMessage(conn *net.UDPConn, pool *pool) (wm *wireMessage, peer *net.
 	return
 }
 
-func writeWireMessage(wm *wireMessage, conn *net.UDPConn, peer *net.UDPAddr) error {
-	if wm.buffer.uz < dataStart {
-		return errors.New("truncated buffer")
+func readBuffer(conn net.PacketConn, pool *pool) (*buffer, net.Addr, error) {
+	buffer := pool.get()
+	n, peer, err := conn.ReadFrom(buffer.data)
+	if err != nil {
+		return nil, peer, errors.Wrap(err, "peer read")
 	}
+	buffer.uz = uint32(n)
+	return buffer, peer, nil
+}
 
-	n, err := conn.WriteToUDP(wm.buffer.data[:wm.buffer.uz], peer)
+/*
+ * decodeWireMessage opens a received buffer when the connection is sealed, and decodes its header. Failures are
+ * reported to the instrument, and the buffer is returned to its pool.
+ */
+func decodeWireMessage(buffer *buffer, s *sealer, peer net.Addr, ii InstrumentInstance) (*wireMessage, bool) {
+	if s != nil {
+		if err := s.open(buffer); err != nil {
+			ii.UnsealError(peer, err)
+			buffer.unref()
+			return nil, false
+		}
+	}
+	wm, err := decodeHeader(buffer)
 	if err != nil {
-		return errors.Wrap(err, "peer write")
+		ii.ReadError(peer, errors.Wrap(err, "decode"))
+		buffer.unref()
+		return nil, false
 	}
-	if uint32(n) != wm.buffer.uz {
-		return errors.Errorf("short peer write [%d != %d]", n, wm.buffer.uz)
+	return wm, true
+}
+
+/*
+ * writeWireMessage seals the message with s, unless s is nil (as it is during hello, and for connections without
+ * encryption).
+ */
+func writeWireMessage(wm *wireMessage, p *path, s *sealer) error {
+	if wm.buffer.uz < dataStart {
+		return errors.New("truncated buffer")
 	}
 
-	return nil
+	data := wm.buffer.data[:wm.buffer.uz]
+	if s != nil {
+		sealed := s.pool.get()
+		defer sealed.unref()
+		var err error
+		if data, err = s.seal(sealed.data[:0], data); err != nil {
+			return errors.Wrap(err, "seal")
+		}
+	}
+
+	return p.write(data)
 }
 
 func newHello(seq int32, h hello, a *ack, p *pool) (wm *wireMessage, err error) {
@@ -92,34 +151,184 @@ func (self *wireMessage) asHello() (h hello, a []ack, err error) {
 	if self.messageType() != HELLO {
 		return hello{}, nil, errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
 	}
-	i := uint32(0)
+	i, err := self.helloAcksStart()
+	if err != nil {
+		return hello{}, nil, err
+	}
 	if self.hasFlag(INLINE_ACK) {
-		a, i, err = decodeAcks(self.buffer.data[dataStart:])
+		var acksSz uint32
+		a, acksSz, err = decodeAcks(self.buffer.data[i:])
 		if err != nil {
 			return hello{}, nil, errors.Wrap(err, "error decoding acks")
 		}
+		i += acksSz
 	}
-	h, _, err = decodeHello(self.buffer.data[dataStart+i:])
+	h, _, err = decodeHello(self.buffer.data[i:])
 	if err != nil {
 		return hello{}, nil, errors.Wrap(err, "error decoding hello")
 	}
 	return
 }
 
-func newAck(acks []ack, rxPortalSz int32, rtt *uint16, p *pool) (wm *wireMessage, err error) {
+/*
+ * appendKeyExchange extends a HELLO with the sender's cipher suite and public key.
+ */
+func (self *wireMessage) appendKeyExchange(kx keyExchange) error {
+	if self.messageType() != HELLO {
+		return errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	data := make([]byte, keyExchangeSz)
+	if _, err := encodeKeyExchange(kx, data); err != nil {
+		return errors.Wrap(err, "error encoding key exchange")
+	}
+	if err := self.appendData(data); err != nil {
+		return err
+	}
+	util.WriteUint16(self.buffer.data[5:dataStart], uint16(self.buffer.uz-dataStart))
+	return nil
+}
+
+/*
+ * asKeyExchange returns the key exchange following the hello in a HELLO, or nil when the sender did not request
+ * encryption.
+ */
+func (self *wireMessage) asKeyExchange() (*keyExchange, error) {
+	if self.messageType() != HELLO {
+		return nil, errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	i, err := self.helloAcksStart()
+	if err != nil {
+		return nil, err
+	}
+	if self.hasFlag(INLINE_ACK) {
+		_, acksSz, err := decodeAcks(self.buffer.data[i:])
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding acks")
+		}
+		i += acksSz
+	}
+	i += helloSz
+	if self.buffer.uz <= i {
+		return nil, nil
+	}
+	kx, _, err := decodeKeyExchange(self.buffer.data[i:self.buffer.uz])
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding key exchange")
+	}
+	return &kx, nil
+}
+
+/*
+ * setCookie inserts the listener's cookie at the start of a HELLO, ahead of any acks.
+ */
+func (self *wireMessage) setCookie(cookie []byte) error {
+	if self.messageType() != HELLO {
+		return errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	if self.hasFlag(COOKIE) {
+		return errors.New("hello already has cookie")
+	}
+	if len(cookie) > 0xff {
+		return errors.Errorf("cookie too large [%d]", len(cookie))
+	}
+	if err := self.insertData(append([]byte{byte(len(cookie))}, cookie...)); err != nil {
+		return err
+	}
+	self.setFlag(COOKIE)
+	self.buffer.data[4] = byte(self.mt)
+	util.WriteUint16(self.buffer.data[5:dataStart], uint16(self.buffer.uz-dataStart))
+	return nil
+}
+
+/*
+ * asCookie returns the cookie echoed in a HELLO, or nil when it carries none.
+ */
+func (self *wireMessage) asCookie() ([]byte, error) {
+	if self.messageType() != HELLO {
+		return nil, errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	if !self.hasFlag(COOKIE) {
+		return nil, nil
+	}
+	if self.buffer.uz < dataStart+1 || self.buffer.uz < dataStart+1+uint32(self.buffer.data[dataStart]) {
+		return nil, errors.Errorf("short buffer for cookie decode [%d]", self.buffer.uz)
+	}
+	return self.buffer.data[dataStart+1 : dataStart+1+uint32(self.buffer.data[dataStart])], nil
+}
+
+/*
+ * setConnectionId inserts a connection id at the start of a HELLO, ahead of any acks. A dialer requests a connection id
+ * with 0, and the listener assigns one in its response. Any cookie must be set afterwards.
+ */
+func (self *wireMessage) setConnectionId(cid uint32) error {
+	if self.messageType() != HELLO {
+		return errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	if self.hasFlag(CONN_ID) || self.hasFlag(COOKIE) {
+		return errors.New("connection id must be set once, before cookie")
+	}
+	data := make([]byte, connectionIdSz)
+	util.WriteUint32(data, cid)
+	if err := self.insertData(data); err != nil {
+		return err
+	}
+	self.setFlag(CONN_ID)
+	self.buffer.data[4] = byte(self.mt)
+	util.WriteUint16(self.buffer.data[5:dataStart], uint16(self.buffer.uz-dataStart))
+	return nil
+}
+
+/*
+ * asConnectionId returns the connection id in a HELLO, and whether it carries one.
+ */
+func (self *wireMessage) asConnectionId() (uint32, bool, error) {
+	if self.messageType() != HELLO {
+		return 0, false, errors.Errorf("unexpected message type [%d], expected HELLO", self.messageType())
+	}
+	if !self.hasFlag(CONN_ID) {
+		return 0, false, nil
+	}
+	i, err := self.cookieEnd()
+	if err != nil {
+		return 0, false, err
+	}
+	if self.buffer.uz < i+connectionIdSz {
+		return 0, false, errors.Errorf("short buffer for connection id decode [%d < %d]", self.buffer.uz, i+connectionIdSz)
+	}
+	return util.ReadUint32(self.buffer.data[i:]), true, nil
+}
+
+func (self *wireMessage) helloAcksStart() (uint32, error) {
+	i, err := self.cookieEnd()
+	if err != nil {
+		return 0, err
+	}
+	if self.hasFlag(CONN_ID) {
+		i += connectionIdSz
+	}
+	return i, nil
+}
+
+func (self *wireMessage) cookieEnd() (uint32, error) {
+	if !self.hasFlag(COOKIE) {
+		return dataStart, nil
+	}
+	cookie, err := self.asCookie()
+	if err != nil {
+		return 0, err
+	}
+	return dataStart + 1 + uint32(len(cookie)), nil
+}
+
+func newAck(acks []ack, rxPortalSz int32, rtt *rttProbe, p *pool) (wm *wireMessage, err error) {
 	wm = &wireMessage{
 		seq:    -1,
 		mt:     ACK,
 		buffer: p.get(),
 	}
-	rttSz := uint32(0)
-	if rtt != nil {
-		if wm.buffer.sz < dataStart+2 {
-			return nil, errors.Errorf("short buffer for ack [%d < %d]", wm.buffer.sz, dataStart+2)
-		}
-		wm.setFlag(RTT)
-		util.WriteUint16(wm.buffer.data[dataStart:], *rtt)
-		rttSz = 2
+	rttSz, err := wm.encodeRtt(rtt)
+	if err != nil {
+		return nil, err
 	}
 	acksSz := uint32(0)
 	if len(acks) > 0 {
@@ -135,19 +344,15 @@ func newAck(acks []ack, rxPortalSz int32, rtt *uint16, p *pool) (wm *wireMessage
 	return wm.encodeHeader(uint16(rttSz + acksSz + 4))
 }
 
-func (self *wireMessage) asAck() (a []ack, rxPortalSz int32, rtt *uint16, err error) {
+func (self *wireMessage) asAck() (a []ack, rxPortalSz int32, rtt *rttProbe, err error) {
 	if self.messageType() != ACK {
 		return nil, 0, nil, errors.Errorf("unexpected message type [%d], expected ACK", self.messageType())
 	}
-	i := uint32(0)
-	if self.hasFlag(RTT) {
-		if self.buffer.uz < dataStart+2 {
-			return nil, 0, nil, errors.Errorf("short buffer for ack decode [%d < %d]", self.buffer.uz, dataStart+2)
-		}
-		rtt = new(uint16)
-		*rtt = util.ReadUint16(self.buffer.data[dataStart:])
-		i += 2
+	rtt, err = self.decodeRtt()
+	if err != nil {
+		return nil, 0, nil, err
 	}
+	i := self.rttSz()
 	var acksSz uint32
 	a, acksSz, err = decodeAcks(self.buffer.data[dataStart+i:])
 	if err != nil {
@@ -161,54 +366,175 @@ func (self *wireMessage) asAck() (a []ack, rxPortalSz int32, rtt *uint16, err er
 	return
 }
 
-func newData(seq int32, rtt *uint16, data []byte, p *pool) (wm *wireMessage, err error) {
+func newData(seq int32, rtt *rttProbe, acks []ack, rxPortalSz int32, data []byte, p *pool) (wm *wireMessage, err error) {
 	dataSz := uint32(len(data))
 	wm = &wireMessage{
 		seq:    seq,
 		mt:     DATA,
 		buffer: p.get(),
 	}
-	rttSz := uint32(0)
-	if rtt != nil {
-		if wm.buffer.sz < dataStart+2 {
-			return nil, errors.Errorf("short buffer for rtt [%d < %d]", wm.buffer.sz, wm.buffer.sz+dataStart+2)
+	rttSz, err := wm.encodeRtt(rtt)
+	if err != nil {
+		return nil, err
+	}
+	acksSz := uint32(0)
+	if len(acks) > 0 {
+		wm.setFlag(INLINE_ACK)
+		acksSz, err = encodeAcks(acks, wm.buffer.data[dataStart+rttSz:])
+		if err != nil {
+			return nil, errors.Wrap(err, "error encoding inline acks")
 		}
-		wm.setFlag(RTT)
-		util.WriteUint16(wm.buffer.data[dataStart:], *rtt)
-		rttSz = 2
+		if wm.buffer.sz < dataStart+rttSz+acksSz+4 {
+			return nil, errors.Errorf("short buffer for inline acks [%d < %d]", wm.buffer.sz, dataStart+rttSz+acksSz+4)
+		}
+		util.WriteInt32(wm.buffer.data[dataStart+rttSz+acksSz:], rxPortalSz)
+		acksSz += 4
 	}
-	if wm.buffer.sz < dataStart+rttSz+dataSz {
-		return nil, errors.Errorf("short buffer for data [%d < %d]", wm.buffer.sz, dataStart+rttSz+dataSz)
+	if wm.buffer.sz < dataStart+rttSz+acksSz+dataSz {
+		return nil, errors.Errorf("short buffer for data [%d < %d]", wm.buffer.sz, dataStart+rttSz+acksSz+dataSz)
 	}
-	copy(wm.buffer.data[dataStart+rttSz:], data)
-	return wm.encodeHeader(uint16(rttSz + dataSz))
+	copy(wm.buffer.data[dataStart+rttSz+acksSz:], data)
+	return wm.encodeHeader(uint16(rttSz + acksSz + dataSz))
 }
 
-func (self *wireMessage) asData() (data []byte, rtt *uint16, err error) {
+func (self *wireMessage) asData() (data []byte, rtt *rttProbe, acks []ack, rxPortalSz int32, err error) {
 	if self.messageType() != DATA {
-		return nil, nil, errors.Errorf("unexpected message type [%d], expected DATA", self.messageType())
+		return nil, nil, nil, 0, errors.Errorf("unexpected message type [%d], expected DATA", self.messageType())
 	}
-	rttSz := uint32(0)
-	if self.hasFlag(RTT) {
-		if self.buffer.uz < dataStart+2 {
-			return nil, nil, errors.Errorf("short buffer for data decode [%d < %d]", self.buffer.uz, dataStart+2)
+	rtt, err = self.decodeRtt()
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	rttSz := self.rttSz()
+	acksSz := uint32(0)
+	if self.hasFlag(INLINE_ACK) {
+		acks, acksSz, err = decodeAcks(self.buffer.data[dataStart+rttSz : self.buffer.uz])
+		if err != nil {
+			return nil, nil, nil, 0, errors.Wrap(err, "error decoding inline acks")
 		}
-		rtt = new(uint16)
-		*rtt = util.ReadUint16(self.buffer.data[dataStart:])
-		rttSz = 2
+		if self.buffer.uz < dataStart+rttSz+acksSz+4 {
+			return nil, nil, nil, 0, errors.Errorf("short buffer for inline rxPortalSz decode [%d < %d]", self.buffer.uz, dataStart+rttSz+acksSz+4)
+		}
+		rxPortalSz = util.ReadInt32(self.buffer.data[dataStart+rttSz+acksSz:])
+		acksSz += 4
+	}
+	return self.buffer.data[dataStart+rttSz+acksSz : self.buffer.uz], rtt, acks, rxPortalSz, nil
+}
+
+/*
+ * encodeRtt writes the rtt probe (if any) at the start of a DATA or ACK message, returning its size.
+ */
+func (self *wireMessage) encodeRtt(rtt *rttProbe) (uint32, error) {
+	if rtt == nil {
+		return 0, nil
+	}
+	if self.buffer.sz < dataStart+rtt.sz() {
+		return 0, errors.Errorf("short buffer for rtt [%d < %d]", self.buffer.sz, dataStart+rtt.sz())
+	}
+	self.setFlag(RTT)
+	if rtt.wide {
+		self.setFlag(RTT_US)
+		util.WriteUint32(self.buffer.data[dataStart:], rtt.ts)
+	} else {
+		util.WriteUint16(self.buffer.data[dataStart:], uint16(rtt.ts))
+	}
+	return rtt.sz(), nil
+}
+
+func (self *wireMessage) decodeRtt() (*rttProbe, error) {
+	sz := self.rttSz()
+	if sz == 0 {
+		return nil, nil
+	}
+	if self.buffer.uz < dataStart+sz {
+		return nil, errors.Errorf("short buffer for rtt decode [%d < %d]", self.buffer.uz, dataStart+sz)
+	}
+	if sz == 4 {
+		return &rttProbe{util.ReadUint32(self.buffer.data[dataStart:]), true}, nil
+	}
+	return &rttProbe{uint32(util.ReadUint16(self.buffer.data[dataStart:])), false}, nil
+}
+
+func (self *wireMessage) rttSz() uint32 {
+	if !self.hasFlag(RTT) {
+		return 0
+	}
+	if self.hasFlag(RTT_US) {
+		return 4
+	}
+	return 2
+}
+
+/*
+ * restampRtt replaces the rtt probe of a DATA message being retransmitted, keeping its width.
+ */
+func (self *wireMessage) restampRtt(clock *rttClock, now time.Time) {
+	if self.hasFlag(RTT) {
+		_, _ = self.encodeRtt(clock.probe(self.hasFlag(RTT_US), now))
 	}
-	return self.buffer.data[dataStart+rttSz : self.buffer.uz], rtt, nil
+}
+
+/*
+ * setWideRtt marks a HELLO as requesting wide rtt probes (from the dialer), or agreeing to them (from the listener).
+ */
+func (self *wireMessage) setWideRtt() {
+	self.setFlag(RTT)
+	self.buffer.data[4] = byte(self.mt)
+}
+
+func (self *wireMessage) wideRtt() bool {
+	return self.messageType() == HELLO && self.hasFlag(RTT)
+}
+
+/*
+ * newFin creates an empty DATA message marking the end of the sender's stream. It is sequenced and retransmitted like
+ * any other DATA, so the peer observes the end of stream only after everything written before it.
+ */
+func newFin(seq int32, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    seq,
+		mt:     DATA,
+		buffer: p.get(),
+	}
+	wm.setFlag(FIN)
+	return wm.encodeHeader(0)
 }
 
 func (self *wireMessage) asDataSize() (sz uint32, err error) {
 	if self.messageType() != DATA {
 		return 0, errors.Errorf("unexpected message type [%d], expected DATA", self.messageType())
 	}
-	rttSz := uint32(0)
-	if self.hasFlag(RTT) {
-		rttSz = 2
+	headerSz := dataStart + self.rttSz()
+	if self.hasFlag(INLINE_ACK) {
+		acksSz, err := decodedAcksSz(self.buffer.data[headerSz:self.buffer.uz])
+		if err != nil {
+			return 0, errors.Wrap(err, "error sizing inline acks")
+		}
+		headerSz += acksSz + 4
+	}
+	if self.buffer.uz < headerSz {
+		return 0, errors.Errorf("short buffer for data size [%d < %d]", self.buffer.uz, headerSz)
+	}
+	return self.buffer.uz - headerSz, nil
+}
+
+/*
+ * stripInlineAcks removes the inline ACK region from a DATA message, so that retransmissions do not repeat stale ACKs.
+ */
+func (self *wireMessage) stripInlineAcks() error {
+	if !self.hasFlag(INLINE_ACK) {
+		return nil
+	}
+	rttSz := self.rttSz()
+	acksSz, err := decodedAcksSz(self.buffer.data[dataStart+rttSz : self.buffer.uz])
+	if err != nil {
+		return errors.Wrap(err, "error sizing inline acks")
 	}
-	return self.buffer.uz - (dataStart + rttSz), nil
+	acksSz += 4
+	copy(self.buffer.data[dataStart+rttSz:], self.buffer.data[dataStart+rttSz+acksSz:self.buffer.uz])
+	self.clearFlag(INLINE_ACK)
+	_, err = self.encodeHeader(uint16(self.buffer.uz - dataStart - acksSz))
+	return err
 }
 
 func newKeepalive(rxPortalSz int, p *pool) (wm *wireMessage, err error) {
@@ -232,10 +558,206 @@ func (self *wireMessage) asKeepalive() (rxPortalSz int, err error) {
 	return rxPortalSz, nil
 }
 
+/*
+ * newPmtuProbe creates a KEEPALIVE padded to carry sz bytes after the header, the size of a DATA message with a full
+ * segment of sz. The probed size precedes the padding, so the peer can confirm it.
+ */
+func newPmtuProbe(sz int, rxPortalSz int, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     KEEPALIVE,
+		buffer: p.get(),
+	}
+	if sz < 6 || wm.buffer.sz < dataStart+uint32(sz) {
+		return nil, errors.Errorf("invalid probe size [%d]", sz)
+	}
+	wm.setFlag(PMTU_PROBE)
+	util.WriteInt32(wm.buffer.data[dataStart:], int32(rxPortalSz))
+	util.WriteUint16(wm.buffer.data[dataStart+4:], uint16(sz))
+	padding := wm.buffer.data[dataStart+6 : dataStart+sz]
+	for i := range padding {
+		padding[i] = 0
+	}
+	return wm.encodeHeader(uint16(sz))
+}
+
+func newPmtuAck(sz int, rxPortalSz int, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     KEEPALIVE,
+		buffer: p.get(),
+	}
+	wm.setFlag(PMTU_ACK)
+	util.WriteInt32(wm.buffer.data[dataStart:], int32(rxPortalSz))
+	util.WriteUint16(wm.buffer.data[dataStart+4:], uint16(sz))
+	return wm.encodeHeader(6)
+}
+
+/*
+ * asPmtu returns the size carried by a PMTU_PROBE or PMTU_ACK. A probe is only valid when it arrived at that size.
+ */
+func (self *wireMessage) asPmtu() (sz int, err error) {
+	if self.messageType() != KEEPALIVE || !(self.hasFlag(PMTU_PROBE) || self.hasFlag(PMTU_ACK)) {
+		return 0, errors.Errorf("unexpected message [%s %s], expected pmtu KEEPALIVE", self.messageType(), self.mt.FlagsString())
+	}
+	if self.buffer.uz < dataStart+6 {
+		return 0, errors.Errorf("short buffer for pmtu decode [%d < %d]", self.buffer.uz, dataStart+6)
+	}
+	sz = int(util.ReadUint16(self.buffer.data[dataStart+4:]))
+	if self.hasFlag(PMTU_PROBE) && self.buffer.uz != uint32(dataStart+sz) {
+		return 0, errors.Errorf("truncated pmtu probe [%d != %d]", self.buffer.uz, dataStart+sz)
+	}
+	return sz, nil
+}
+
+/*
+ * newPathChallenge creates a KEEPALIVE asking the peer to echo token, proving that it can be reached at the address the
+ * challenge is sent to.
+ */
+func newPathChallenge(token int64, rxPortalSz int, p *pool) (wm *wireMessage, err error) {
+	return newPathMessage(CHALLENGE, token, rxPortalSz, p)
+}
+
+func newPathResponse(token int64, rxPortalSz int, p *pool) (wm *wireMessage, err error) {
+	return newPathMessage(RESPONSE, token, rxPortalSz, p)
+}
+
+func newPathMessage(flag messageFlag, token int64, rxPortalSz int, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     KEEPALIVE,
+		buffer: p.get(),
+	}
+	wm.setFlag(flag)
+	util.WriteInt32(wm.buffer.data[dataStart:], int32(rxPortalSz))
+	util.WriteInt64(wm.buffer.data[dataStart+4:], token)
+	return wm.encodeHeader(12)
+}
+
+/*
+ * asPathToken returns the token carried by a CHALLENGE or RESPONSE.
+ */
+func (self *wireMessage) asPathToken() (int64, error) {
+	if self.messageType() != KEEPALIVE || !(self.hasFlag(CHALLENGE) || self.hasFlag(RESPONSE)) {
+		return 0, errors.Errorf("unexpected message [%s %s], expected path KEEPALIVE", self.messageType(), self.mt.FlagsString())
+	}
+	if self.buffer.uz < dataStart+12 {
+		return 0, errors.Errorf("short buffer for path token decode [%d < %d]", self.buffer.uz, dataStart+12)
+	}
+	return util.ReadInt64(self.buffer.data[dataStart+4:]), nil
+}
+
 func newClose(seq int32, p *pool) (wm *wireMessage, err error) {
 	return (&wireMessage{seq: seq, mt: CLOSE, buffer: p.get()}).encodeHeader(0)
 }
 
+type refuseReason uint8
+
+const (
+	refuseVersion refuseReason = iota + 1
+	refuseProfile
+	refuseEncryption
+	refuseRetry
+	refuseDenied
+	refuseBusy
+	refuseRateLimited
+)
+
+func (self refuseReason) String() string {
+	switch self {
+	case refuseVersion:
+		return "unsupported protocol version"
+	case refuseProfile:
+		return "profile not acceptable"
+	case refuseEncryption:
+		return "encryption not acceptable"
+	case refuseRetry:
+		return "retry with cookie"
+	case refuseDenied:
+		return "denied by listener"
+	case refuseBusy:
+		return "listener at capacity"
+	case refuseRateLimited:
+		return "handshake rate exceeded"
+	default:
+		return "unknown reason"
+	}
+}
+
+func newRefuse(reason refuseReason, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     REFUSE,
+		buffer: p.get(),
+	}
+	if wm.buffer.sz < dataStart+1 {
+		return nil, errors.Errorf("short buffer for refuse [%d < %d]", wm.buffer.sz, dataStart+1)
+	}
+	wm.buffer.data[dataStart] = byte(reason)
+	return wm.encodeHeader(1)
+}
+
+/*
+ * newRetry refuses a HELLO that did not carry a valid cookie, supplying one for the dialer to echo.
+ */
+func newRetry(cookie []byte, p *pool) (wm *wireMessage, err error) {
+	wm, err = newRefuse(refuseRetry, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := wm.appendData(cookie); err != nil {
+		return nil, err
+	}
+	return wm.encodeHeader(uint16(1 + len(cookie)))
+}
+
+func (self *wireMessage) asRetry() ([]byte, error) {
+	reason, err := self.asRefuse()
+	if err != nil {
+		return nil, err
+	}
+	if reason != refuseRetry {
+		return nil, errors.Errorf("unexpected refuse reason [%s], expected retry", reason)
+	}
+	cookie := make([]byte, self.buffer.uz-(dataStart+1))
+	copy(cookie, self.buffer.data[dataStart+1:self.buffer.uz])
+	return cookie, nil
+}
+
+func (self *wireMessage) asRefuse() (refuseReason, error) {
+	if self.messageType() != REFUSE {
+		return 0, errors.Errorf("unexpected message type [%d], expected REFUSE", self.messageType())
+	}
+	if self.buffer.uz < dataStart+1 {
+		return 0, errors.Errorf("short buffer for refuse decode [%d < %d]", self.buffer.uz, dataStart+1)
+	}
+	return refuseReason(self.buffer.data[dataStart]), nil
+}
+
+/*
+ * newDatagram creates an unsequenced message carrying an unreliable datagram. Datagrams are neither acknowledged nor
+ * retransmitted.
+ */
+func newDatagram(data []byte, p *pool) (wm *wireMessage, err error) {
+	wm = &wireMessage{
+		seq:    -1,
+		mt:     DATAGRAM,
+		buffer: p.get(),
+	}
+	if wm.buffer.sz < dataStart+uint32(len(data)) {
+		return nil, errors.Errorf("short buffer for datagram [%d < %d]", wm.buffer.sz, dataStart+len(data))
+	}
+	copy(wm.buffer.data[dataStart:], data)
+	return wm.encodeHeader(uint16(len(data)))
+}
+
+func (self *wireMessage) asDatagram() ([]byte, error) {
+	if self.messageType() != DATAGRAM {
+		return nil, errors.Errorf("unexpected message type [%d], expected DATAGRAM", self.messageType())
+	}
+	return self.buffer.data[dataStart:self.buffer.uz], nil
+}
+
 func (self *wireMessage) encodeHeader(dataSz uint16) (*wireMessage, error) {
 	if self.buffer.sz < uint32(dataStart+dataSz) {
 		return nil, errors.Errorf("short buffer for encode [%d < %d]", self.buffer.sz, dataStart+dataSz)
@@ -296,7 +818,7 @@ func (self *wireMessage) setFlag(flag messageFlag) {
 }
 
 func (self *wireMessage) clearFlag(flag messageFlag) {
-	self.mt = messageType(uint8(self.mt) ^ uint8(flag))
+	self.mt = messageType(uint8(self.mt) &^ uint8(flag))
 }
 
 func (self *wireMessage) hasFlag(flag messageFlag) bool {
@@ -318,18 +840,53 @@ func (mt messageType) String() string {
 		return "KEEPALIVE"
 	case CLOSE:
 		return "CLOSE"
+	case REFUSE:
+		return "REFUSE"
+	case DATAGRAM:
+		return "DATAGRAM"
+	case FRAGMENT:
+		return "FRAGMENT"
 	default:
 		return "???"
 	}
 }
 
 func (mt messageType) FlagsString() string {
+	t := messageType(byte(mt) & messageTypeMask)
 	flags := ""
 	if messageFlag(mt)&INLINE_ACK == INLINE_ACK {
-		flags += " INLINE_ACK"
+		if t == KEEPALIVE {
+			flags += " RESPONSE"
+		} else {
+			flags += " INLINE_ACK"
+		}
 	}
 	if messageFlag(mt)&RTT == RTT {
-		flags += " RTT"
+		if t == KEEPALIVE {
+			flags += " CHALLENGE"
+		} else {
+			flags += " RTT"
+		}
+	}
+	if messageFlag(mt)&FIN == FIN {
+		if t == KEEPALIVE {
+			flags += " PMTU_PROBE"
+		} else {
+			flags += " FIN"
+		}
+	}
+	if messageFlag(mt)&COOKIE == COOKIE {
+		switch t {
+		case HELLO:
+			flags += " COOKIE"
+		case KEEPALIVE:
+			flags += " PMTU_ACK"
+		default:
+			flags += " RTT_US"
+		}
+	}
+	if messageFlag(mt)&CONN_ID == CONN_ID {
+		flags += " CONN_ID"
 	}
 	return strings.TrimSpace(flags)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -19,10 +20,10 @@ var wireMessageBenchmarkPool *pool
 
 func TestHello(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	wm, err := newHello(11, hello{protocolVersion, 6}, nil, p)
+	wm, err := newHello(11, hello{protocolVersion, 6, 1450, 0xc0ffee}, nil, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
-	assert.Equal(t, uint32(dataStart+5), wm.buffer.uz)
+	assert.Equal(t, uint32(dataStart+helloSz), wm.buffer.uz)
 
 	wmOut, err := decodeHeader(wm.buffer)
 	assert.NoError(t, err)
@@ -32,15 +33,16 @@ func TestHello(t *testing.T) {
 	assert.Equal(t, HELLO, wmOut.messageType())
 	assert.Equal(t, protocolVersion, h.version)
 	assert.Equal(t, uint8(6), h.profile)
+	assert.Equal(t, uint16(1450), h.maxSegmentSz)
 	assert.Equal(t, 0, len(a))
 }
 
 func TestHelloResponse(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	wm, err := newHello(12, hello{protocolVersion, 6}, &ack{11, 11}, p)
+	wm, err := newHello(12, hello{protocolVersion, 6, 1450, 0xc0ffee}, &ack{11, 11}, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
-	assert.Equal(t, uint32(dataStart+4+5), wm.buffer.uz)
+	assert.Equal(t, uint32(dataStart+4+helloSz), wm.buffer.uz)
 	assert.True(t, wm.hasFlag(INLINE_ACK))
 
 	wmOut, err := decodeHeader(wm.buffer)
@@ -56,9 +58,136 @@ func TestHelloResponse(t *testing.T) {
 	assert.Equal(t, int32(11), a[0].end)
 }
 
+func TestHelloKeyExchange(t *testing.T) {
+	p := newPool("test", dataStart+128, NewNilInstrument().NewInstance("", nil))
+	publicKey := make([]byte, keyExchangeSz-1)
+	for i := range publicKey {
+		publicKey[i] = byte(i)
+	}
+
+	wm, err := newHello(12, hello{protocolVersion, 6, 1450, 0xc0ffee}, &ack{11, 11}, p)
+	assert.NoError(t, err)
+	kx, err := wm.asKeyExchange()
+	assert.NoError(t, err)
+	assert.Nil(t, kx)
+
+	assert.NoError(t, wm.appendKeyExchange(keyExchange{cipherAesGcm, publicKey}))
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	h, a, err := wmOut.asHello()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1450), h.maxSegmentSz)
+	assert.Equal(t, []ack{{11, 11}}, a)
+	kx, err = wmOut.asKeyExchange()
+	assert.NoError(t, err)
+	assert.Equal(t, &keyExchange{cipherAesGcm, publicKey}, kx)
+}
+
+func TestHelloCookie(t *testing.T) {
+	p := newPool("test", dataStart+128, NewNilInstrument().NewInstance("", nil))
+	cookie := []byte("0123456789abcdef")
+	publicKey := make([]byte, keyExchangeSz-1)
+
+	wm, err := newHello(12, hello{protocolVersion, 6, 1450, 0xc0ffee}, &ack{11, 11}, p)
+	assert.NoError(t, err)
+	c, err := wm.asCookie()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+	assert.NoError(t, wm.setCookie(cookie))
+	assert.Error(t, wm.setCookie(cookie))
+	assert.NoError(t, wm.appendKeyExchange(keyExchange{cipherChaCha20Poly1305, publicKey}))
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "INLINE_ACK COOKIE", wmOut.mt.FlagsString())
+	c, err = wmOut.asCookie()
+	assert.NoError(t, err)
+	assert.Equal(t, cookie, c)
+	h, a, err := wmOut.asHello()
+	assert.NoError(t, err)
+	assert.Equal(t, hello{protocolVersion, 6, 1450, 0xc0ffee}, h)
+	assert.Equal(t, []ack{{11, 11}}, a)
+	kx, err := wmOut.asKeyExchange()
+	assert.NoError(t, err)
+	assert.Equal(t, &keyExchange{cipherChaCha20Poly1305, publicKey}, kx)
+}
+
+func TestHelloConnectionId(t *testing.T) {
+	p := newPool("test", dataStart+128, NewNilInstrument().NewInstance("", nil))
+	cookie := []byte("0123456789abcdef")
+
+	wm, err := newHello(12, hello{protocolVersion, 6, 1450, 0xc0ffee}, &ack{11, 11}, p)
+	assert.NoError(t, err)
+	_, found, err := wm.asConnectionId()
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, wm.setConnectionId(0x80c0ffee))
+	assert.Error(t, wm.setConnectionId(0x80c0ffee))
+	assert.NoError(t, wm.setCookie(cookie))
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "INLINE_ACK COOKIE CONN_ID", wmOut.mt.FlagsString())
+	cid, found, err := wmOut.asConnectionId()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint32(0x80c0ffee), cid)
+	c, err := wmOut.asCookie()
+	assert.NoError(t, err)
+	assert.Equal(t, cookie, c)
+	h, a, err := wmOut.asHello()
+	assert.NoError(t, err)
+	assert.Equal(t, hello{protocolVersion, 6, 1450, 0xc0ffee}, h)
+	assert.Equal(t, []ack{{11, 11}}, a)
+
+	cookieFirst, err := newHello(12, hello{protocolVersion, 6, 1450, 0xc0ffee}, nil, p)
+	assert.NoError(t, err)
+	assert.NoError(t, cookieFirst.setCookie(cookie))
+	assert.Error(t, cookieFirst.setConnectionId(0))
+}
+
+func TestRetry(t *testing.T) {
+	p := newPool("test", dataStart+128, NewNilInstrument().NewInstance("", nil))
+	wm, err := newRetry([]byte("cookie"), p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	reason, err := wmOut.asRefuse()
+	assert.NoError(t, err)
+	assert.Equal(t, refuseRetry, reason)
+	cookie, err := wmOut.asRetry()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cookie"), cookie)
+
+	refuse, err := newRefuse(refuseProfile, p)
+	assert.NoError(t, err)
+	_, err = refuse.asRetry()
+	assert.Error(t, err)
+}
+
+func TestRefuse(t *testing.T) {
+	p := newPool("test", dataStart+1, NewNilInstrument().NewInstance("", nil))
+	wm, err := newRefuse(refuseProfile, p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, REFUSE, wmOut.messageType())
+	reason, err := wmOut.asRefuse()
+	assert.NoError(t, err)
+	assert.Equal(t, refuseProfile, reason)
+}
+
 func TestAck(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
-	rtt := uint16(332)
+	rtt := rttProbe{332, false}
 	wm, err := newAck([]ack{{1, 1}, {3, 5}}, 10240, &rtt, p)
 	assert.NoError(t, err)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
@@ -79,6 +208,23 @@ func TestAck(t *testing.T) {
 	assert.Equal(t, rtt, *rttOut)
 }
 
+func TestAckWideRtt(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	rtt := rttProbe{0x12345678, true}
+	wm, err := newAck([]ack{{1, 1}}, 10240, &rtt, p)
+	assert.NoError(t, err)
+	assert.True(t, wm.hasFlag(RTT_US))
+	assert.Equal(t, "RTT RTT_US", wm.mt.FlagsString())
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	a, rxPortalSz, rttOut, err := wmOut.asAck()
+	assert.NoError(t, err)
+	assert.Equal(t, []ack{{1, 1}}, a)
+	assert.Equal(t, int32(10240), rxPortalSz)
+	assert.Equal(t, &rtt, rttOut)
+}
+
 func TestAckNoRTT(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
 	wm, err := newAck([]ack{{63, 64}}, 0, nil, p)
@@ -100,23 +246,100 @@ func TestAckNoRTT(t *testing.T) {
 
 func TestData(t *testing.T) {
 	p := newPool("tooSmall", 1024, NewNilInstrument().NewInstance("", nil))
-	_, err := newData(64, nil, wireMessageBenchmarkData[:], p)
+	_, err := newData(64, nil, nil, 0, wireMessageBenchmarkData[:], p)
 	assert.Error(t, err)
 	p = newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
-	rttIn := new(uint16)
-	*rttIn = 200
-	wm, err2 := newData(64, rttIn, wireMessageBenchmarkData[:], p)
+	rttIn := &rttProbe{200, false}
+	wm, err2 := newData(64, rttIn, nil, 0, wireMessageBenchmarkData[:], p)
 	assert.NoError(t, err2)
 	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
 
 	wmOut, err := decodeHeader(wm.buffer)
 	assert.NoError(t, err)
-	data, rttOut, err := wmOut.asData()
+	data, rttOut, acksOut, _, err := wmOut.asData()
+	assert.NoError(t, err)
+	assert.Equal(t, rttIn, rttOut)
+	assert.Nil(t, acksOut)
+	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
+}
+
+func TestDataInlineAcks(t *testing.T) {
+	p := newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
+	rttIn := &rttProbe{200, false}
+	acksIn := []ack{{10, 12}, {15, 15}}
+	wm, err := newData(64, rttIn, acksIn, 4096, wireMessageBenchmarkData[:], p)
+	assert.NoError(t, err)
+	assert.True(t, wm.hasFlag(INLINE_ACK))
+	fmt.Println(hex.Dump(wm.buffer.data[:64]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	data, rttOut, acksOut, rxPortalSz, err := wmOut.asData()
+	assert.NoError(t, err)
+	assert.Equal(t, rttIn, rttOut)
+	assert.Equal(t, acksIn, acksOut)
+	assert.Equal(t, int32(4096), rxPortalSz)
+	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
+
+	sz, err := wmOut.asDataSize()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(len(wireMessageBenchmarkData)), sz)
+}
+
+func TestClearFlag(t *testing.T) {
+	wm := &wireMessage{mt: DATA}
+	wm.setFlag(RTT)
+	wm.clearFlag(INLINE_ACK)
+	assert.False(t, wm.hasFlag(INLINE_ACK))
+	assert.True(t, wm.hasFlag(RTT))
+	wm.clearFlag(RTT)
+	wm.clearFlag(RTT)
+	assert.Equal(t, DATA, wm.mt)
+}
+
+func TestStripInlineAcks(t *testing.T) {
+	p := newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
+	rttIn := &rttProbe{200, false}
+	wm, err := newData(64, rttIn, []ack{{10, 12}}, 4096, wireMessageBenchmarkData[:], p)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wm.stripInlineAcks())
+	assert.False(t, wm.hasFlag(INLINE_ACK))
+	assert.True(t, wm.hasFlag(RTT))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	data, rttOut, acksOut, _, err := wmOut.asData()
 	assert.NoError(t, err)
 	assert.Equal(t, rttIn, rttOut)
+	assert.Nil(t, acksOut)
 	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
 }
 
+func TestDataWideRtt(t *testing.T) {
+	p := newPool("test", 24*1024, NewNilInstrument().NewInstance("", nil))
+	rttIn := &rttProbe{0xfffffffe, true}
+	wm, err := newData(64, rttIn, []ack{{10, 12}}, 4096, wireMessageBenchmarkData[:], p)
+	assert.NoError(t, err)
+	assert.NoError(t, wm.stripInlineAcks())
+
+	clock := &rttClock{epoch: time.Now().Add(-time.Second)}
+	now := time.Now()
+	wm.restampRtt(clock, now)
+	assert.True(t, wm.hasFlag(RTT_US))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	data, rttOut, _, _, err := wmOut.asData()
+	assert.NoError(t, err)
+	assert.Equal(t, clock.probe(true, now), rttOut)
+	assert.EqualValues(t, wireMessageBenchmarkData[:], data)
+
+	sz, err := wmOut.asDataSize()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(len(wireMessageBenchmarkData)), sz)
+}
+
 func TestKeepalive(t *testing.T) {
 	p := newPool("test", dataStart+4, NewNilInstrument().NewInstance("", nil))
 	wm, err := newKeepalive(23411, p)
@@ -144,6 +367,41 @@ func TestClose(t *testing.T) {
 	assert.Equal(t, CLOSE, wmOut.mt)
 }
 
+func TestFin(t *testing.T) {
+	p := newPool("test", dataStart, NewNilInstrument().NewInstance("", nil))
+	wm, err := newFin(10234, p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, wm.seq, wmOut.seq)
+	assert.Equal(t, DATA, wmOut.messageType())
+	assert.True(t, wmOut.hasFlag(FIN))
+	assert.Equal(t, "FIN", wmOut.mt.FlagsString())
+	sz, err := wmOut.asDataSize()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), sz)
+}
+
+func TestDatagram(t *testing.T) {
+	p := newPool("test", dataStart+16, NewNilInstrument().NewInstance("", nil))
+	wm, err := newDatagram([]byte("datagram"), p)
+	assert.NoError(t, err)
+	fmt.Println(hex.Dump(wm.buffer.data[:wm.buffer.uz]))
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(-1), wmOut.seq)
+	assert.Equal(t, DATAGRAM, wmOut.messageType())
+	data, err := wmOut.asDatagram()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("datagram"), data)
+
+	_, err = newDatagram(make([]byte, 17), p)
+	assert.Error(t, err)
+}
+
 func TestWireMessageInsertData(t *testing.T) {
 	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
 	wm := &wireMessage{seq: 0, mt: DATA, buffer: p.get()}
@@ -209,3 +467,78 @@ func BenchmarkWireMessageAppendData8(b *testing.B)    { benchmarkWireMessageAppe
 func BenchmarkWireMessageAppendData256(b *testing.B)  { benchmarkWireMessageAppendData(256, 8, b) }
 func BenchmarkWireMessageAppendData1024(b *testing.B) { benchmarkWireMessageAppendData(1024, 8, b) }
 func BenchmarkWireMessageAppendData4096(b *testing.B) { benchmarkWireMessageAppendData(4096, 8, b) }
+
+func TestPmtuProbe(t *testing.T) {
+	p := newPool("test", dataStart+1450, NewNilInstrument().NewInstance("", nil))
+	wm, err := newPmtuProbe(1200, 99, p)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(dataStart+1200), wm.buffer.uz)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, KEEPALIVE, wmOut.messageType())
+	assert.Equal(t, "PMTU_PROBE", wmOut.mt.FlagsString())
+	rxPortalSz, err := wmOut.asKeepalive()
+	assert.NoError(t, err)
+	assert.Equal(t, 99, rxPortalSz)
+	sz, err := wmOut.asPmtu()
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, sz)
+
+	wmOut.buffer.uz--
+	_, err = wmOut.asPmtu()
+	assert.Error(t, err)
+
+	_, err = newPmtuProbe(1451, 99, p)
+	assert.Error(t, err)
+}
+
+func TestPmtuAck(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	wm, err := newPmtuAck(1200, 99, p)
+	assert.NoError(t, err)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "PMTU_ACK", wmOut.mt.FlagsString())
+	rxPortalSz, err := wmOut.asKeepalive()
+	assert.NoError(t, err)
+	assert.Equal(t, 99, rxPortalSz)
+	sz, err := wmOut.asPmtu()
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, sz)
+
+	keepalive, err := newKeepalive(99, p)
+	assert.NoError(t, err)
+	_, err = keepalive.asPmtu()
+	assert.Error(t, err)
+}
+
+func TestPathChallenge(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	wm, err := newPathChallenge(-1234567890123, 99, p)
+	assert.NoError(t, err)
+
+	wmOut, err := decodeHeader(wm.buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, KEEPALIVE, wmOut.messageType())
+	assert.Equal(t, "CHALLENGE", wmOut.mt.FlagsString())
+	rxPortalSz, err := wmOut.asKeepalive()
+	assert.NoError(t, err)
+	assert.Equal(t, 99, rxPortalSz)
+	token, err := wmOut.asPathToken()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1234567890123), token)
+
+	response, err := newPathResponse(token, 99, p)
+	assert.NoError(t, err)
+	assert.Equal(t, "RESPONSE", response.mt.FlagsString())
+	token, err = response.asPathToken()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1234567890123), token)
+
+	keepalive, err := newKeepalive(99, p)
+	assert.NoError(t, err)
+	_, err = keepalive.asPathToken()
+	assert.Error(t, err)
+}
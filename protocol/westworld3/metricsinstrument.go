@@ -77,7 +77,7 @@ func NewMetricsInstrument(config map[string]interface{}) (Instrument, error) {
 	return i, nil
 }
 
-func (self *metricsInstrument) NewInstance(id string, peer *net.UDPAddr) InstrumentInstance {
+func (self *metricsInstrument) NewInstance(id string, peer net.Addr) InstrumentInstance {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 	ii := &metricsInstrumentInstance{id: id, peer: peer, config: self.config, close: make(chan struct{}, 1)}
@@ -151,6 +151,30 @@ func (self *metricsInstrument) writeAllSamples() error {
 		if err := util.WriteSamples("rx_keepalive_msgs", outPath, ii.rxKeepaliveMsgs); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("tx_pmtu_probe_msgs", outPath, ii.txPmtuProbeMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("rx_pmtu_probe_msgs", outPath, ii.rxPmtuProbeMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("tx_pmtu_ack_msgs", outPath, ii.txPmtuAckMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("rx_pmtu_ack_msgs", outPath, ii.rxPmtuAckMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("tx_path_challenge_msgs", outPath, ii.txPathChallengeMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("rx_path_challenge_msgs", outPath, ii.rxPathChallengeMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("tx_path_response_msgs", outPath, ii.txPathResponseMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("rx_path_response_msgs", outPath, ii.rxPathResponseMsgs); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("tx_portal_capacity", outPath, ii.txPortalCapacity); err != nil {
 			return err
 		}
@@ -160,15 +184,36 @@ func (self *metricsInstrument) writeAllSamples() error {
 		if err := util.WriteSamples("tx_portal_rx_sz", outPath, ii.txPortalRxSz); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("tx_portal_pacing_rate", outPath, ii.txPortalPacingRate); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("retx_ms", outPath, ii.retxMs); err != nil {
 			return err
 		}
 		if err := util.WriteSamples("retx_scale", outPath, ii.retxScale); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("srtt_us", outPath, ii.srttUs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("rttvar_us", outPath, ii.rttvarUs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("path_mtu", outPath, ii.pathMtu); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("path_mtu_black_holes", outPath, ii.blackHoles); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("dup_acks", outPath, ii.dupAcks); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("fast_retx_msgs", outPath, ii.fastRetxMsgs); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("timed_retx_msgs", outPath, ii.timedRetxMsgs); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("rx_portal_sz", outPath, ii.rxPortalSz); err != nil {
 			return err
 		}
@@ -178,6 +223,15 @@ func (self *metricsInstrument) writeAllSamples() error {
 		if err := util.WriteSamples("dup_rx_msgs", outPath, ii.dupRxMsgs); err != nil {
 			return err
 		}
+		if err := util.WriteSamples("hello_retries", outPath, ii.helloRetries); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("hello_rejected", outPath, ii.helloRejected); err != nil {
+			return err
+		}
+		if err := util.WriteSamples("migrations", outPath, ii.migrations); err != nil {
+			return err
+		}
 		if err := util.WriteSamples("allocations", outPath, ii.allocations); err != nil {
 			return err
 		}
@@ -202,7 +256,7 @@ func (self *metricsInstrument) clean() {
 
 func (self *metricsInstrument) findClosed() int {
 	for i, ii := range self.instances {
-		if ii.closed {
+		if ii.isClosed() {
 			return i
 		}
 	}
@@ -211,11 +265,12 @@ func (self *metricsInstrument) findClosed() int {
 
 type metricsInstrumentInstance struct {
 	id           string
-	peer         *net.UDPAddr
-	listenerAddr *net.UDPAddr
+	peer         net.Addr
+	listenerAddr net.Addr
 	config       *metricsInstrumentConfig
 	close        chan struct{}
 	closed       bool
+	closeLock    sync.Mutex
 
 	txBytes        []*util.Sample
 	txBytesAccum   int64
@@ -246,19 +301,50 @@ type metricsInstrumentInstance struct {
 	rxKeepaliveBytesAccum int64
 	rxKeepaliveMsgs       []*util.Sample
 	rxKeepaliveMsgsAccum  int64
-
-	txPortalCapacity    []*util.Sample
-	txPortalCapacityVal int64
-	txPortalSz          []*util.Sample
-	txPortalSzVal       int64
-	txPortalRxSz        []*util.Sample
-	txPortalRxSzVal     int64
-	retxMs              []*util.Sample
-	retxMsVal           int64
-	retxScale           []*util.Sample
-	retxScaleVal        int64
-	dupAcks             []*util.Sample
-	dupAcksAccum        int64
+	txPmtuProbeMsgs       []*util.Sample
+	txPmtuProbeMsgsAccum  int64
+	rxPmtuProbeMsgs       []*util.Sample
+	rxPmtuProbeMsgsAccum  int64
+	txPmtuAckMsgs         []*util.Sample
+	txPmtuAckMsgsAccum    int64
+	rxPmtuAckMsgs         []*util.Sample
+	rxPmtuAckMsgsAccum    int64
+
+	txPathChallengeMsgs      []*util.Sample
+	txPathChallengeMsgsAccum int64
+	rxPathChallengeMsgs      []*util.Sample
+	rxPathChallengeMsgsAccum int64
+	txPathResponseMsgs       []*util.Sample
+	txPathResponseMsgsAccum  int64
+	rxPathResponseMsgs       []*util.Sample
+	rxPathResponseMsgsAccum  int64
+
+	txPortalCapacity      []*util.Sample
+	txPortalCapacityVal   int64
+	txPortalSz            []*util.Sample
+	txPortalSzVal         int64
+	txPortalRxSz          []*util.Sample
+	txPortalRxSzVal       int64
+	txPortalPacingRate    []*util.Sample
+	txPortalPacingRateVal int64
+	retxMs                []*util.Sample
+	retxMsVal             int64
+	retxScale             []*util.Sample
+	retxScaleVal          int64
+	srttUs                []*util.Sample
+	srttUsVal             int64
+	rttvarUs              []*util.Sample
+	rttvarUsVal           int64
+	pathMtu               []*util.Sample
+	pathMtuVal            int64
+	blackHoles            []*util.Sample
+	blackHolesAccum       int64
+	dupAcks               []*util.Sample
+	dupAcksAccum          int64
+	fastRetxMsgs          []*util.Sample
+	fastRetxMsgsAccum     int64
+	timedRetxMsgs         []*util.Sample
+	timedRetxMsgsAccum    int64
 
 	rxPortalSz      []*util.Sample
 	rxPortalSzVal   int64
@@ -267,6 +353,13 @@ type metricsInstrumentInstance struct {
 	dupRxMsgs       []*util.Sample
 	dupRxMsgsAccum  int64
 
+	helloRetries       []*util.Sample
+	helloRetriesAccum  int64
+	helloRejected      []*util.Sample
+	helloRejectedAccum int64
+	migrations         []*util.Sample
+	migrationsAccum    int64
+
 	allocations      []*util.Sample
 	allocationsAccum int64
 	errors           []*util.Sample
@@ -276,61 +369,84 @@ type metricsInstrumentInstance struct {
 /*
  * connection
  */
-func (self *metricsInstrumentInstance) Listener(addr *net.UDPAddr) {
+func (self *metricsInstrumentInstance) Listener(addr net.Addr) {
 	self.listenerAddr = addr
 }
 
-func (self *metricsInstrumentInstance) Hello(*net.UDPAddr)                  {}
-func (self *metricsInstrumentInstance) Connected(*net.UDPAddr)              {}
-func (self *metricsInstrumentInstance) ConnectionError(*net.UDPAddr, error) {}
+func (self *metricsInstrumentInstance) Hello(net.Addr)                  {}
+func (self *metricsInstrumentInstance) Connected(net.Addr)              {}
+func (self *metricsInstrumentInstance) ConnectionError(net.Addr, error) {}
 
-func (self *metricsInstrumentInstance) Closed(*net.UDPAddr) {
-	logrus.Infof("closing snapshotter")
-	if !self.closed {
-		self.closed = true
-		close(self.close)
+func (self *metricsInstrumentInstance) HelloRetry(net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.helloRetriesAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) HelloRejected(peer net.Addr, err error) {
+	if self.config.Enabled {
+		logrus.Warnf("hello rejected from [%s] (%v)", peer, err)
+		atomic.AddInt64(&self.helloRejectedAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) ConnectionMigrated(net.Addr, net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.migrationsAccum, 1)
 	}
 }
 
+func (self *metricsInstrumentInstance) Closed(net.Addr) {
+	logrus.Infof("closing snapshotter")
+	self.closeSnapshotter()
+}
+
 /*
  * wire
  */
-func (self *metricsInstrumentInstance) WireMessageTx(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) WireMessageTx(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.txBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.txMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) WireMessageRetx(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) WireMessageRetx(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.retxBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.retxMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) WireMessageRx(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) WireMessageRx(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.rxBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.rxMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) UnknownPeer(peer *net.UDPAddr) {
+func (self *metricsInstrumentInstance) UnknownPeer(peer net.Addr) {
 	if self.config.Enabled {
 		logrus.Errorf("unknown peer (%v)", peer)
 		atomic.AddInt64(&self.errorsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) ReadError(_ *net.UDPAddr, err error) {
+func (self *metricsInstrumentInstance) ReadError(_ net.Addr, err error) {
 	if self.config.Enabled {
 		logrus.Errorf("read error (%v)", err)
 		atomic.AddInt64(&self.errorsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) UnexpectedMessageType(_ *net.UDPAddr, mt messageType) {
+func (self *metricsInstrumentInstance) UnsealError(_ net.Addr, err error) {
+	if self.config.Enabled {
+		logrus.Errorf("unseal error (%v)", err)
+		atomic.AddInt64(&self.errorsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) UnexpectedMessageType(_ net.Addr, mt messageType) {
 	if self.config.Enabled {
 		logrus.Errorf("unexpected message type (%d)", mt)
 		atomic.AddInt64(&self.errorsAccum, 1)
@@ -340,83 +456,168 @@ func (self *metricsInstrumentInstance) UnexpectedMessageType(_ *net.UDPAddr, mt
 /*
  * control
  */
-func (self *metricsInstrumentInstance) TxAck(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) TxAck(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.txAckBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.txAckMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) RxAck(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) RxAck(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.rxAckBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.rxAckMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) TxKeepalive(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) TxKeepalive(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.txKeepaliveBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.txKeepaliveMsgsAccum, 1)
 	}
 }
 
-func (self *metricsInstrumentInstance) RxKeepalive(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) RxKeepalive(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.rxKeepaliveBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.rxKeepaliveMsgsAccum, 1)
 	}
 }
 
+func (self *metricsInstrumentInstance) TxPmtuProbe(net.Addr, int) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.txPmtuProbeMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) RxPmtuProbe(net.Addr, int) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.rxPmtuProbeMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TxPmtuAck(net.Addr, int) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.txPmtuAckMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) RxPmtuAck(net.Addr, int) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.rxPmtuAckMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TxPathChallenge(net.Addr, net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.txPathChallengeMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) RxPathChallenge(net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.rxPathChallengeMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TxPathResponse(net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.txPathResponseMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) RxPathResponse(net.Addr, net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.rxPathResponseMsgsAccum, 1)
+	}
+}
+
 /*
  * txPortal
  */
-func (self *metricsInstrumentInstance) TxPortalCapacityChanged(_ *net.UDPAddr, capacity int) {
+func (self *metricsInstrumentInstance) TxPortalCapacityChanged(_ net.Addr, capacity int) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.txPortalCapacityVal, int64(capacity))
 	}
 }
 
-func (self *metricsInstrumentInstance) TxPortalSzChanged(_ *net.UDPAddr, sz int) {
+func (self *metricsInstrumentInstance) TxPortalSzChanged(_ net.Addr, sz int) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.txPortalSzVal, int64(sz))
 	}
 }
 
-func (self *metricsInstrumentInstance) TxPortalRxSzChanged(_ *net.UDPAddr, sz int) {
+func (self *metricsInstrumentInstance) TxPortalRxSzChanged(_ net.Addr, sz int) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.txPortalRxSzVal, int64(sz))
 	}
 }
 
-func (self *metricsInstrumentInstance) NewRetxMs(_ *net.UDPAddr, ms int) {
+func (self *metricsInstrumentInstance) TxPortalPacingRateChanged(_ net.Addr, rate int) {
+	if self.config.Enabled {
+		atomic.StoreInt64(&self.txPortalPacingRateVal, int64(rate))
+	}
+}
+
+func (self *metricsInstrumentInstance) NewRetxMs(_ net.Addr, ms int) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.retxMsVal, int64(ms))
 	}
 }
 
-func (self *metricsInstrumentInstance) NewRetxScale(_ *net.UDPAddr, retxMs float64) {
+func (self *metricsInstrumentInstance) NewRetxScale(_ net.Addr, retxMs float64) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.retxScaleVal, int64(retxMs*1000.0))
 	}
 }
 
-func (self *metricsInstrumentInstance) DuplicateAck(*net.UDPAddr, int32) {
+func (self *metricsInstrumentInstance) NewRttEstimate(_ net.Addr, srtt, rttvar time.Duration) {
+	if self.config.Enabled {
+		atomic.StoreInt64(&self.srttUsVal, srtt.Microseconds())
+		atomic.StoreInt64(&self.rttvarUsVal, rttvar.Microseconds())
+	}
+}
+
+func (self *metricsInstrumentInstance) PathMtuChanged(_ net.Addr, mtu int) {
+	if self.config.Enabled {
+		atomic.StoreInt64(&self.pathMtuVal, int64(mtu))
+	}
+}
+
+func (self *metricsInstrumentInstance) PathMtuBlackHole(net.Addr) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.blackHolesAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) DuplicateAck(net.Addr, int32) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.dupAcksAccum, 1)
 	}
 }
 
+func (self *metricsInstrumentInstance) FastRetx(net.Addr, *wireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.fastRetxMsgsAccum, 1)
+	}
+}
+
+func (self *metricsInstrumentInstance) TimedRetx(net.Addr, *wireMessage) {
+	if self.config.Enabled {
+		atomic.AddInt64(&self.timedRetxMsgsAccum, 1)
+	}
+}
+
 /*
  * rxPortal
  */
-func (self *metricsInstrumentInstance) RxPortalSzChanged(_ *net.UDPAddr, sz int) {
+func (self *metricsInstrumentInstance) RxPortalSzChanged(_ net.Addr, sz int) {
 	if self.config.Enabled {
 		atomic.StoreInt64(&self.rxPortalSzVal, int64(sz))
 	}
 }
 
-func (self *metricsInstrumentInstance) DuplicateRx(_ *net.UDPAddr, wm *wireMessage) {
+func (self *metricsInstrumentInstance) DuplicateRx(_ net.Addr, wm *wireMessage) {
 	if self.config.Enabled {
 		atomic.AddInt64(&self.dupRxBytesAccum, int64(wm.buffer.uz))
 		atomic.AddInt64(&self.dupRxMsgsAccum, 1)
@@ -436,12 +637,28 @@ func (self *metricsInstrumentInstance) Allocate(string) {
  * instrument lifecycle
  */
 func (self *metricsInstrumentInstance) Shutdown() {
+	self.closeSnapshotter()
+}
+
+/*
+ * closeSnapshotter stops the snapshotter. Both the connection (Closed) and its owner (Shutdown) close the instance, from
+ * different goroutines.
+ */
+func (self *metricsInstrumentInstance) closeSnapshotter() {
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
 	if !self.closed {
 		self.closed = true
 		close(self.close)
 	}
 }
 
+func (self *metricsInstrumentInstance) isClosed() bool {
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
+	return self.closed
+}
+
 func (self *metricsInstrumentInstance) snapshotter(ms int) {
 	logrus.Infof("started")
 	defer logrus.Infof("exited")
@@ -476,15 +693,33 @@ func (self *metricsInstrumentInstance) snapshot() {
 	self.txKeepaliveMsgs = append(self.txKeepaliveMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.txKeepaliveMsgsAccum, 0)})
 	self.rxKeepaliveBytes = append(self.rxKeepaliveBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxKeepaliveBytesAccum, 0)})
 	self.rxKeepaliveMsgs = append(self.rxKeepaliveMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxKeepaliveMsgsAccum, 0)})
+	self.txPmtuProbeMsgs = append(self.txPmtuProbeMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.txPmtuProbeMsgsAccum, 0)})
+	self.rxPmtuProbeMsgs = append(self.rxPmtuProbeMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxPmtuProbeMsgsAccum, 0)})
+	self.txPmtuAckMsgs = append(self.txPmtuAckMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.txPmtuAckMsgsAccum, 0)})
+	self.rxPmtuAckMsgs = append(self.rxPmtuAckMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxPmtuAckMsgsAccum, 0)})
+	self.txPathChallengeMsgs = append(self.txPathChallengeMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.txPathChallengeMsgsAccum, 0)})
+	self.rxPathChallengeMsgs = append(self.rxPathChallengeMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxPathChallengeMsgsAccum, 0)})
+	self.txPathResponseMsgs = append(self.txPathResponseMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.txPathResponseMsgsAccum, 0)})
+	self.rxPathResponseMsgs = append(self.rxPathResponseMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.rxPathResponseMsgsAccum, 0)})
 	self.txPortalCapacity = append(self.txPortalCapacity, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.txPortalCapacityVal)})
 	self.txPortalSz = append(self.txPortalSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.txPortalSzVal)})
 	self.txPortalRxSz = append(self.txPortalRxSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.txPortalRxSzVal)})
+	self.txPortalPacingRate = append(self.txPortalPacingRate, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.txPortalPacingRateVal)})
 	self.retxMs = append(self.retxMs, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxMsVal)})
 	self.retxScale = append(self.retxScale, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.retxScaleVal)})
+	self.srttUs = append(self.srttUs, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.srttUsVal)})
+	self.rttvarUs = append(self.rttvarUs, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.rttvarUsVal)})
+	self.pathMtu = append(self.pathMtu, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.pathMtuVal)})
+	self.blackHoles = append(self.blackHoles, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.blackHolesAccum, 0)})
 	self.dupAcks = append(self.dupAcks, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupAcksAccum, 0)})
+	self.fastRetxMsgs = append(self.fastRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.fastRetxMsgsAccum, 0)})
+	self.timedRetxMsgs = append(self.timedRetxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.timedRetxMsgsAccum, 0)})
 	self.rxPortalSz = append(self.rxPortalSz, &util.Sample{Ts: now, V: atomic.LoadInt64(&self.rxPortalSzVal)})
 	self.dupRxBytes = append(self.dupRxBytes, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxBytesAccum, 0)})
 	self.dupRxMsgs = append(self.dupRxMsgs, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.dupRxMsgsAccum, 0)})
+	self.helloRetries = append(self.helloRetries, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.helloRetriesAccum, 0)})
+	self.helloRejected = append(self.helloRejected, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.helloRejectedAccum, 0)})
+	self.migrations = append(self.migrations, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.migrationsAccum, 0)})
 	self.allocations = append(self.allocations, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.allocationsAccum, 0)})
 	self.errors = append(self.errors, &util.Sample{Ts: now, V: atomic.SwapInt64(&self.errorsAccum, 0)})
 }
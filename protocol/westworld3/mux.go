@@ -0,0 +1,628 @@
+package westworld3
+
+import (
+	"bytes"
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type muxFrameType uint8
+
+const (
+	muxOpen muxFrameType = iota + 1
+	muxData
+	muxWindow
+	muxFin
+	muxReset
+)
+
+const (
+	// muxHeaderSz is the size of a frame header: type (1), stream id (4), and length or window increment (4)
+	muxHeaderSz = 9
+	// muxMaxFrameSz bounds the payload of a single data frame, so streams interleave fairly on the connection
+	muxMaxFrameSz = 16 * 1024
+)
+
+var ErrStreamReset = errors.New("stream reset")
+var ErrSessionClosed = errors.New("session closed")
+var ErrTooManyStreams = errors.New("too many streams")
+
+/*
+ * Session multiplexes independent, bidirectional streams over a single connection, so that they share its handshake
+ * and congestion state. Streams opened by the dialing side have odd ids, and streams opened by the accepting side
+ * have even ids.
+ *
+ * Each stream is flow controlled separately. A sender may have at most MuxStreamWindowSz unread bytes outstanding on
+ * a stream, and the receiver returns credit as the application reads. The session never blocks on a slow reader, so
+ * one stalled stream does not hold up the others.
+ *
+ * At most MuxMaxStreams streams, opened from either side, are live at once. Opens beyond the limit, and opens from the
+ * peer reusing a live id or an id from our side of the id space, are refused with a reset.
+ *
+ * Session implements net.Listener, accepting the streams opened by the peer.
+ */
+type Session struct {
+	conn      net.Conn
+	profile   *Profile
+	nextId    uint32
+	streams   map[uint32]*Stream
+	lock      *sync.Mutex
+	writeLock *sync.Mutex
+	wbuf      []byte
+	control   chan muxFrame
+	accepted  chan *Stream
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type muxFrame struct {
+	ft muxFrameType
+	id uint32
+	v  uint32
+}
+
+func NewSession(conn net.Conn, dialer bool, profile *Profile) *Session {
+	s := &Session{
+		conn:      conn,
+		profile:   profile,
+		nextId:    2,
+		streams:   make(map[uint32]*Stream),
+		lock:      new(sync.Mutex),
+		writeLock: new(sync.Mutex),
+		wbuf:      make([]byte, muxHeaderSz+muxMaxFrameSz),
+		control:   make(chan muxFrame, profile.AcceptQueueLen),
+		accepted:  make(chan *Stream, profile.AcceptQueueLen),
+		closed:    make(chan struct{}),
+	}
+	if dialer {
+		s.nextId = 1
+	}
+	go s.rxer()
+	go s.controller()
+	return s
+}
+
+/*
+ * DialSession establishes a westworld3 connection to addr, and multiplexes streams over it.
+ */
+func DialSession(addr *net.UDPAddr, profileId byte) (*Session, error) {
+	profile, found := profileRegistry[profileId]
+	if !found {
+		return nil, errors.Errorf("no profile [%d]", profileId)
+	}
+	conn, err := Dial(addr, profileId)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	return NewSession(conn, true, profile), nil
+}
+
+/*
+ * Open starts a new stream. The peer receives it from Accept.
+ */
+func (self *Session) Open() (*Stream, error) {
+	self.lock.Lock()
+	if self.isClosed() {
+		self.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if len(self.streams) >= self.profile.MuxMaxStreams {
+		self.lock.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	st := newStream(self.nextId, self)
+	self.streams[st.id] = st
+	self.nextId += 2
+	self.lock.Unlock()
+
+	if err := self.writeFrame(muxOpen, st.id, 0, nil); err != nil {
+		self.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (self *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-self.accepted:
+		return st, nil
+	case <-self.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (self *Session) Accept() (net.Conn, error) {
+	st, err := self.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (self *Session) Close() error {
+	self.shutdown()
+	return self.conn.Close()
+}
+
+func (self *Session) Addr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *Session) isClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *Session) shutdown() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.lock.Lock()
+		for _, st := range self.streams {
+			st.broadcast()
+		}
+		self.lock.Unlock()
+	})
+}
+
+/*
+ * open registers a stream opened by the peer.
+ */
+func (self *Session) open(id uint32) (*Stream, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if id == 0 || id%2 == self.nextId%2 {
+		return nil, errors.Errorf("stream [%d] not in the peer's id space", id)
+	}
+	if _, found := self.streams[id]; found {
+		return nil, errors.Errorf("stream [%d] already open", id)
+	}
+	if len(self.streams) >= self.profile.MuxMaxStreams {
+		return nil, errors.Errorf("stream [%d] over limit of [%d] streams", id, self.profile.MuxMaxStreams)
+	}
+	st := newStream(id, self)
+	self.streams[id] = st
+	return st, nil
+}
+
+func (self *Session) stream(id uint32) *Stream {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.streams[id]
+}
+
+func (self *Session) remove(id uint32) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.streams, id)
+}
+
+func (self *Session) writeFrame(ft muxFrameType, id, v uint32, data []byte) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	if self.isClosed() {
+		return ErrSessionClosed
+	}
+	self.wbuf[0] = byte(ft)
+	util.WriteUint32(self.wbuf[1:5], id)
+	util.WriteUint32(self.wbuf[5:muxHeaderSz], v)
+	n := copy(self.wbuf[muxHeaderSz:], data)
+	if _, err := self.conn.Write(self.wbuf[:muxHeaderSz+n]); err != nil {
+		self.shutdown()
+		return errors.Wrap(err, "write frame")
+	}
+	return nil
+}
+
+/*
+ * sendControl queues a frame for the controller, for frames originating in the rxer, which must never block on the
+ * connection.
+ */
+func (self *Session) sendControl(ft muxFrameType, id, v uint32) {
+	select {
+	case self.control <- muxFrame{ft, id, v}:
+	case <-self.closed:
+	}
+}
+
+func (self *Session) controller() {
+	for {
+		select {
+		case f := <-self.control:
+			if err := self.writeFrame(f.ft, f.id, f.v, nil); err != nil {
+				logrus.Errorf("error writing control frame (%v)", err)
+				return
+			}
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *Session) rxer() {
+	logrus.Infof("started")
+	defer logrus.Infof("exited")
+	defer func() { _ = self.Close() }()
+
+	header := make([]byte, muxHeaderSz)
+	for {
+		if _, err := io.ReadFull(self.conn, header); err != nil {
+			if err != io.EOF {
+				logrus.Errorf("error reading frame (%v)", err)
+			}
+			return
+		}
+		ft := muxFrameType(header[0])
+		id := util.ReadUint32(header[1:5])
+		v := util.ReadUint32(header[5:muxHeaderSz])
+
+		switch ft {
+		case muxOpen:
+			st, err := self.open(id)
+			if err != nil {
+				logrus.Warnf("refusing stream (%v)", err)
+				self.sendControl(muxReset, id, 0)
+				continue
+			}
+			select {
+			case self.accepted <- st:
+			default:
+				logrus.Warnf("accept queue full, resetting stream [%d]", id)
+				self.remove(id)
+				self.sendControl(muxReset, id, 0)
+			}
+
+		case muxData:
+			if v > muxMaxFrameSz {
+				logrus.Errorf("oversized frame [%d > %d]", v, muxMaxFrameSz)
+				return
+			}
+			data := make([]byte, v)
+			if _, err := io.ReadFull(self.conn, data); err != nil {
+				logrus.Errorf("error reading frame data (%v)", err)
+				return
+			}
+			if st := self.stream(id); st != nil {
+				if !st.rx(data) {
+					logrus.Errorf("stream [%d] exceeded its window, resetting", id)
+					st.rxReset()
+					self.remove(id)
+					self.sendControl(muxReset, id, 0)
+				}
+			}
+
+		case muxWindow:
+			if st := self.stream(id); st != nil {
+				st.rxWindow(int(v))
+			}
+
+		case muxFin:
+			if st := self.stream(id); st != nil {
+				st.rxFin()
+			}
+
+		case muxReset:
+			if st := self.stream(id); st != nil {
+				st.rxReset()
+				self.remove(id)
+			}
+
+		default:
+			logrus.Errorf("unexpected frame type [%d]", ft)
+			return
+		}
+	}
+}
+
+/*
+ * Stream is a single bidirectional stream within a Session. It implements net.Conn, and supports half-close through
+ * CloseWrite and CloseRead, and abortive close through Reset.
+ */
+type Stream struct {
+	id            uint32
+	session       *Session
+	lock          *sync.Mutex
+	ready         *sync.Cond
+	txLock        *sync.Mutex
+	rxBuffer      *bytes.Buffer
+	rxConsumed    int
+	txCredit      int
+	finRx         bool
+	finTx         bool
+	readClosed    bool
+	writeClosed   bool
+	reset         bool
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+}
+
+func newStream(id uint32, session *Session) *Stream {
+	st := &Stream{
+		id:       id,
+		session:  session,
+		lock:     new(sync.Mutex),
+		txLock:   new(sync.Mutex),
+		rxBuffer: new(bytes.Buffer),
+		txCredit: session.profile.MuxStreamWindowSz,
+	}
+	st.ready = sync.NewCond(st.lock)
+	return st
+}
+
+func (self *Stream) Read(p []byte) (int, error) {
+	self.lock.Lock()
+	for self.rxBuffer.Len() < 1 {
+		if err := self.readError(); err != nil {
+			self.lock.Unlock()
+			return 0, err
+		}
+		self.ready.Wait()
+	}
+	n, _ := self.rxBuffer.Read(p)
+	self.rxConsumed += n
+	credit := 0
+	if self.rxConsumed >= self.session.profile.MuxStreamWindowSz/2 && !self.finRx {
+		credit = self.rxConsumed
+		self.rxConsumed = 0
+	}
+	self.lock.Unlock()
+
+	if credit > 0 {
+		if err := self.session.writeFrame(muxWindow, self.id, uint32(credit), nil); err != nil {
+			logrus.Errorf("error returning credit for stream [%d] (%v)", self.id, err)
+		}
+	}
+	return n, nil
+}
+
+func (self *Stream) readError() error {
+	switch {
+	case self.reset:
+		return ErrStreamReset
+	case self.readClosed || self.finRx:
+		return io.EOF
+	case self.session.isClosed():
+		return ErrSessionClosed
+	case !self.readDeadline.IsZero() && !time.Now().Before(self.readDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (self *Stream) Write(p []byte) (int, error) {
+	self.txLock.Lock()
+	defer self.txLock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		self.lock.Lock()
+		for self.txCredit < 1 && self.writeError() == nil {
+			self.ready.Wait()
+		}
+		if err := self.writeError(); err != nil {
+			self.lock.Unlock()
+			return n, err
+		}
+		sz := len(p) - n
+		if sz > self.txCredit {
+			sz = self.txCredit
+		}
+		if sz > muxMaxFrameSz {
+			sz = muxMaxFrameSz
+		}
+		self.txCredit -= sz
+		self.lock.Unlock()
+
+		if err := self.session.writeFrame(muxData, self.id, uint32(sz), p[n:n+sz]); err != nil {
+			return n, err
+		}
+		n += sz
+	}
+	return n, nil
+}
+
+func (self *Stream) writeError() error {
+	switch {
+	case self.reset:
+		return ErrStreamReset
+	case self.finTx || self.writeClosed:
+		return io.ErrClosedPipe
+	case self.session.isClosed():
+		return ErrSessionClosed
+	case !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+/*
+ * CloseWrite ends the outgoing half of the stream. The peer reads io.EOF once it has read everything written before.
+ */
+func (self *Stream) CloseWrite() error {
+	self.txLock.Lock()
+	defer self.txLock.Unlock()
+
+	self.lock.Lock()
+	if self.reset {
+		self.lock.Unlock()
+		return ErrStreamReset
+	}
+	if self.finTx {
+		self.lock.Unlock()
+		return nil
+	}
+	self.finTx = true
+	done := self.finRx
+	self.ready.Broadcast()
+	self.lock.Unlock()
+
+	if done {
+		self.session.remove(self.id)
+	}
+	return self.session.writeFrame(muxFin, self.id, 0, nil)
+}
+
+/*
+ * CloseRead ends the incoming half of the stream locally. Reads return io.EOF, and data arriving from the peer is
+ * discarded while still returning credit, so the peer's writes do not stall.
+ */
+func (self *Stream) CloseRead() error {
+	self.lock.Lock()
+	self.readClosed = true
+	credit := self.rxBuffer.Len() + self.rxConsumed
+	self.rxBuffer.Reset()
+	self.rxConsumed = 0
+	self.ready.Broadcast()
+	self.lock.Unlock()
+
+	if credit > 0 {
+		return self.session.writeFrame(muxWindow, self.id, uint32(credit), nil)
+	}
+	return nil
+}
+
+/*
+ * Close closes both halves of the stream. Pending writes fail with io.ErrClosedPipe.
+ */
+func (self *Stream) Close() error {
+	self.lock.Lock()
+	self.writeClosed = true
+	self.ready.Broadcast()
+	self.lock.Unlock()
+
+	if err := self.CloseRead(); err != nil {
+		return err
+	}
+	if err := self.CloseWrite(); err != nil && err != ErrStreamReset {
+		return err
+	}
+	return nil
+}
+
+/*
+ * Reset aborts the stream in both directions. Pending and later reads and writes on both ends fail with ErrStreamReset.
+ */
+func (self *Stream) Reset() error {
+	self.lock.Lock()
+	if self.reset {
+		self.lock.Unlock()
+		return nil
+	}
+	self.reset = true
+	self.ready.Broadcast()
+	self.lock.Unlock()
+
+	self.session.remove(self.id)
+	return self.session.writeFrame(muxReset, self.id, 0, nil)
+}
+
+func (self *Stream) LocalAddr() net.Addr {
+	return self.session.conn.LocalAddr()
+}
+
+func (self *Stream) RemoteAddr() net.Addr {
+	return self.session.conn.RemoteAddr()
+}
+
+func (self *Stream) SetDeadline(t time.Time) error {
+	if err := self.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return self.SetWriteDeadline(t)
+}
+
+func (self *Stream) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.readDeadline = t
+	self.readTimer = self.deadlineTimer(self.readTimer, t)
+	self.ready.Broadcast()
+	return nil
+}
+
+func (self *Stream) SetWriteDeadline(t time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writeDeadline = t
+	self.writeTimer = self.deadlineTimer(self.writeTimer, t)
+	self.ready.Broadcast()
+	return nil
+}
+
+func (self *Stream) deadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), self.broadcast)
+}
+
+func (self *Stream) broadcast() {
+	self.lock.Lock()
+	self.ready.Broadcast()
+	self.lock.Unlock()
+}
+
+/*
+ * rx buffers data arriving from the peer. It returns false if the peer exceeded the stream window.
+ */
+func (self *Stream) rx(data []byte) bool {
+	self.lock.Lock()
+	if self.reset {
+		self.lock.Unlock()
+		return true
+	}
+	if self.rxBuffer.Len()+self.rxConsumed+len(data) > self.session.profile.MuxStreamWindowSz {
+		self.lock.Unlock()
+		return false
+	}
+	if self.readClosed {
+		self.lock.Unlock()
+		self.session.sendControl(muxWindow, self.id, uint32(len(data)))
+		return true
+	}
+	self.rxBuffer.Write(data)
+	self.ready.Broadcast()
+	self.lock.Unlock()
+	return true
+}
+
+func (self *Stream) rxWindow(credit int) {
+	self.lock.Lock()
+	self.txCredit += credit
+	self.ready.Broadcast()
+	self.lock.Unlock()
+}
+
+func (self *Stream) rxFin() {
+	self.lock.Lock()
+	self.finRx = true
+	done := self.finTx
+	self.ready.Broadcast()
+	self.lock.Unlock()
+
+	if done {
+		self.session.remove(self.id)
+	}
+}
+
+func (self *Stream) rxReset() {
+	self.lock.Lock()
+	self.reset = true
+	self.ready.Broadcast()
+	self.lock.Unlock()
+}
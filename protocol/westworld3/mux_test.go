@@ -0,0 +1,231 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMuxStreams(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	client := NewSession(conn, true, GetProfile(profileId))
+	server := NewSession(lConn, false, GetProfile(profileId))
+	defer func() { _ = client.Close() }()
+
+	// echo every accepted stream
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(st, st)
+				_ = st.(*Stream).CloseWrite()
+			}()
+		}
+	}()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		st, err := client.Open()
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1+2*i), st.id)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 512*1024)
+			for j := range data {
+				data[j] = byte(i + j)
+			}
+			go func() {
+				_, _ = st.Write(data)
+				_ = st.CloseWrite()
+			}()
+			echo, err := ioutil.ReadAll(st)
+			assert.NoError(t, err)
+			assert.Equal(t, data, echo)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxSlowReader(t *testing.T) {
+	client, server := newTestSessionPair(t)
+
+	slow, err := client.Open()
+	assert.NoError(t, err)
+	fast, err := client.Open()
+	assert.NoError(t, err)
+	slowRx, err := server.AcceptStream()
+	assert.NoError(t, err)
+	fastRx, err := server.AcceptStream()
+	assert.NoError(t, err)
+
+	// nobody reads the slow stream; its writer stops at the window
+	assert.NoError(t, slow.SetWriteDeadline(time.Now().Add(250*time.Millisecond)))
+	n, err := slow.Write(make([]byte, 4*client.profile.MuxStreamWindowSz))
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+	assert.Equal(t, client.profile.MuxStreamWindowSz, n)
+
+	// the fast stream is unaffected
+	data := make([]byte, 4*1024*1024)
+	go func() {
+		_, _ = fast.Write(data)
+		_ = fast.CloseWrite()
+	}()
+	rx, err := ioutil.ReadAll(fastRx)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), len(rx))
+
+	// reading the slow stream returns credit
+	assert.NoError(t, slow.SetWriteDeadline(time.Time{}))
+	go func() {
+		_, _ = slow.Write(make([]byte, client.profile.MuxStreamWindowSz))
+		_ = slow.CloseWrite()
+	}()
+	rx, err = ioutil.ReadAll(slowRx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*client.profile.MuxStreamWindowSz, len(rx))
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	client, server := newTestSessionPair(t)
+
+	st, err := client.Open()
+	assert.NoError(t, err)
+	_, err = st.Write([]byte("request"))
+	assert.NoError(t, err)
+	assert.NoError(t, st.CloseWrite())
+	_, err = st.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	stRx, err := server.AcceptStream()
+	assert.NoError(t, err)
+	request, err := ioutil.ReadAll(stRx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("request"), request)
+
+	_, err = stRx.Write([]byte("reply"))
+	assert.NoError(t, err)
+	assert.NoError(t, stRx.Close())
+	reply, err := ioutil.ReadAll(st)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), reply)
+
+	// both halves are closed; the stream is released on both sides
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, client.stream(st.id))
+	assert.Nil(t, server.stream(st.id))
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := newTestSessionPair(t)
+
+	st, err := client.Open()
+	assert.NoError(t, err)
+	stRx, err := server.AcceptStream()
+	assert.NoError(t, err)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := stRx.Read(make([]byte, 64))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, st.Reset())
+	select {
+	case err := <-read:
+		assert.Equal(t, ErrStreamReset, err)
+	case <-time.After(time.Second):
+		t.Fatal("read not released")
+	}
+	_, err = stRx.Write([]byte("x"))
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = st.Read(make([]byte, 64))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// closing the session fails the remaining streams
+	other, err := client.Open()
+	assert.NoError(t, err)
+	otherRx, err := server.AcceptStream()
+	assert.NoError(t, err)
+	assert.NoError(t, client.Close())
+	_, err = other.Write([]byte("x"))
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = otherRx.Read(make([]byte, 64))
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = server.Accept()
+	assert.Equal(t, ErrSessionClosed, err)
+}
+
+func TestMuxOpenRefused(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.MuxMaxStreams = 2
+	peer, b := net.Pipe()
+	server := NewSession(b, false, profile)
+	defer func() { _ = server.Close() }()
+
+	open := func(id uint32) {
+		frame := make([]byte, muxHeaderSz)
+		frame[0] = byte(muxOpen)
+		util.WriteUint32(frame[1:5], id)
+		_, err := peer.Write(frame)
+		assert.NoError(t, err)
+	}
+	expectReset := func(id uint32) {
+		frame := make([]byte, muxHeaderSz)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(peer, frame)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(muxReset), frame[0])
+		assert.Equal(t, id, util.ReadUint32(frame[1:5]))
+	}
+
+	open(1)
+	st, err := server.AcceptStream()
+	assert.NoError(t, err)
+
+	// a live id is not replaced
+	open(1)
+	expectReset(1)
+	assert.Equal(t, st, server.stream(1))
+
+	// even ids belong to the accepting side
+	open(2)
+	expectReset(2)
+	assert.Nil(t, server.stream(2))
+
+	open(3)
+	_, err = server.AcceptStream()
+	assert.NoError(t, err)
+
+	// limited to MuxMaxStreams, from either side
+	open(5)
+	expectReset(5)
+	assert.Nil(t, server.stream(5))
+	_, err = server.Open()
+	assert.Equal(t, ErrTooManyStreams, err)
+}
+
+func newTestSessionPair(t *testing.T) (client, server *Session) {
+	profile := NewBaselineProfile()
+	a, b := net.Pipe()
+	client = NewSession(a, true, profile)
+	server = NewSession(b, false, profile)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
@@ -1,6 +1,9 @@
 package westworld3
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 type nilInstrument struct{}
 
@@ -8,7 +11,7 @@ func NewNilInstrument() Instrument {
 	return &nilInstrument{}
 }
 
-func (self *nilInstrument) NewInstance(_ string, _ *net.UDPAddr) InstrumentInstance {
+func (self *nilInstrument) NewInstance(_ string, _ net.Addr) InstrumentInstance {
 	return &nilInstrumentInstance{}
 }
 
@@ -17,45 +20,65 @@ type nilInstrumentInstance struct{}
 /*
  * connection
  */
-func (self *nilInstrumentInstance) Listener(*net.UDPAddr)               {}
-func (self *nilInstrumentInstance) Hello(*net.UDPAddr)                  {}
-func (self *nilInstrumentInstance) Connected(*net.UDPAddr)              {}
-func (self *nilInstrumentInstance) ConnectionError(*net.UDPAddr, error) {}
-func (self *nilInstrumentInstance) Closed(*net.UDPAddr)                 {}
+func (self *nilInstrumentInstance) Listener(net.Addr)               {}
+func (self *nilInstrumentInstance) Hello(net.Addr)                  {}
+func (self *nilInstrumentInstance) Connected(net.Addr)              {}
+func (self *nilInstrumentInstance) ConnectionError(net.Addr, error) {}
+func (self *nilInstrumentInstance) HelloRetry(net.Addr)             {}
+func (self *nilInstrumentInstance) HelloRejected(net.Addr, error)   {}
+func (self *nilInstrumentInstance) Closed(net.Addr)                 {}
+
+func (self *nilInstrumentInstance) ConnectionMigrated(net.Addr, net.Addr) {}
 
 /*
  * wire
  */
-func (self *nilInstrumentInstance) WireMessageTx(*net.UDPAddr, *wireMessage)        {}
-func (self *nilInstrumentInstance) WireMessageRetx(*net.UDPAddr, *wireMessage)      {}
-func (self *nilInstrumentInstance) WireMessageRx(*net.UDPAddr, *wireMessage)        {}
-func (self *nilInstrumentInstance) UnknownPeer(*net.UDPAddr)                        {}
-func (self *nilInstrumentInstance) ReadError(*net.UDPAddr, error)                   {}
-func (self *nilInstrumentInstance) UnexpectedMessageType(*net.UDPAddr, messageType) {}
+func (self *nilInstrumentInstance) WireMessageTx(net.Addr, *wireMessage)        {}
+func (self *nilInstrumentInstance) WireMessageRetx(net.Addr, *wireMessage)      {}
+func (self *nilInstrumentInstance) WireMessageRx(net.Addr, *wireMessage)        {}
+func (self *nilInstrumentInstance) UnknownPeer(net.Addr)                        {}
+func (self *nilInstrumentInstance) ReadError(net.Addr, error)                   {}
+func (self *nilInstrumentInstance) UnsealError(net.Addr, error)                 {}
+func (self *nilInstrumentInstance) UnexpectedMessageType(net.Addr, messageType) {}
 
 /*
  * control
  */
-func (self *nilInstrumentInstance) TxAck(*net.UDPAddr, *wireMessage)       {}
-func (self *nilInstrumentInstance) RxAck(*net.UDPAddr, *wireMessage)       {}
-func (self *nilInstrumentInstance) TxKeepalive(*net.UDPAddr, *wireMessage) {}
-func (self *nilInstrumentInstance) RxKeepalive(*net.UDPAddr, *wireMessage) {}
+func (self *nilInstrumentInstance) TxAck(net.Addr, *wireMessage)       {}
+func (self *nilInstrumentInstance) RxAck(net.Addr, *wireMessage)       {}
+func (self *nilInstrumentInstance) TxKeepalive(net.Addr, *wireMessage) {}
+func (self *nilInstrumentInstance) RxKeepalive(net.Addr, *wireMessage) {}
+func (self *nilInstrumentInstance) TxPmtuProbe(net.Addr, int)          {}
+func (self *nilInstrumentInstance) RxPmtuProbe(net.Addr, int)          {}
+func (self *nilInstrumentInstance) TxPmtuAck(net.Addr, int)            {}
+func (self *nilInstrumentInstance) RxPmtuAck(net.Addr, int)            {}
+func (self *nilInstrumentInstance) TxPathChallenge(net.Addr, net.Addr) {}
+func (self *nilInstrumentInstance) RxPathChallenge(net.Addr)           {}
+func (self *nilInstrumentInstance) TxPathResponse(net.Addr)            {}
+func (self *nilInstrumentInstance) RxPathResponse(net.Addr, net.Addr)  {}
 
 /*
  * txPortal
  */
-func (self *nilInstrumentInstance) TxPortalCapacityChanged(*net.UDPAddr, int) {}
-func (self *nilInstrumentInstance) TxPortalSzChanged(*net.UDPAddr, int)       {}
-func (self *nilInstrumentInstance) TxPortalRxSzChanged(*net.UDPAddr, int)     {}
-func (self *nilInstrumentInstance) NewRetxMs(*net.UDPAddr, int)               {}
-func (self *nilInstrumentInstance) NewRetxScale(*net.UDPAddr, float64)        {}
-func (self *nilInstrumentInstance) DuplicateAck(*net.UDPAddr, int32)          {}
+func (self *nilInstrumentInstance) TxPortalCapacityChanged(net.Addr, int)   {}
+func (self *nilInstrumentInstance) TxPortalSzChanged(net.Addr, int)         {}
+func (self *nilInstrumentInstance) TxPortalRxSzChanged(net.Addr, int)       {}
+func (self *nilInstrumentInstance) TxPortalPacingRateChanged(net.Addr, int) {}
+func (self *nilInstrumentInstance) NewRetxMs(net.Addr, int)                 {}
+func (self *nilInstrumentInstance) NewRetxScale(net.Addr, float64)          {}
+func (self *nilInstrumentInstance) DuplicateAck(net.Addr, int32)            {}
+func (self *nilInstrumentInstance) FastRetx(net.Addr, *wireMessage)         {}
+func (self *nilInstrumentInstance) TimedRetx(net.Addr, *wireMessage)        {}
+func (self *nilInstrumentInstance) PathMtuChanged(net.Addr, int)            {}
+func (self *nilInstrumentInstance) PathMtuBlackHole(net.Addr)               {}
+
+func (self *nilInstrumentInstance) NewRttEstimate(net.Addr, time.Duration, time.Duration) {}
 
 /*
  * rxPortal
  */
-func (self *nilInstrumentInstance) RxPortalSzChanged(*net.UDPAddr, int)    {}
-func (self *nilInstrumentInstance) DuplicateRx(*net.UDPAddr, *wireMessage) {}
+func (self *nilInstrumentInstance) RxPortalSzChanged(net.Addr, int)    {}
+func (self *nilInstrumentInstance) DuplicateRx(net.Addr, *wireMessage) {}
 
 /*
  * allocation
@@ -0,0 +1,196 @@
+package westworld3
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketConnTransfer(t *testing.T) {
+	for _, encryption := range []string{"none", "aes-gcm"} {
+		t.Run(encryption, func(t *testing.T) {
+			profileId := registerTestProfile(t)
+			profile := GetProfile(profileId)
+			profile.RetxAddMs = 50
+			profile.HelloCookies = true
+			profile.ConnectionIds = true
+			profile.Encryption = encryption
+
+			mn := newMemNetwork()
+			l, err := ListenPacket(mn.listen("listener"), profileId)
+			assert.NoError(t, err)
+			defer func() { _ = l.Close() }()
+			assert.Equal(t, memAddr("listener"), l.Addr())
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+			conn, err := DialPacket(mn.listen("dialer"), memAddr("listener"), profileId)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer func() { _ = conn.Close() }()
+			var lConn net.Conn
+			select {
+			case lConn = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("accept timeout")
+			}
+			assert.Equal(t, memAddr("dialer"), lConn.RemoteAddr())
+			assert.Equal(t, memAddr("listener"), conn.RemoteAddr())
+
+			transfer(t, conn, lConn, 256*1024)
+			transfer(t, lConn, conn, 256*1024)
+		})
+	}
+}
+
+func TestPacketConnClosedWithConn(t *testing.T) {
+	profileId := registerTestProfile(t)
+
+	mn := newMemNetwork()
+	l, err := ListenPacket(mn.listen("listener"), profileId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	pConn := mn.listen("dialer")
+	conn, err := DialPacket(pConn, memAddr("listener"), profileId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, conn.Close())
+	conn.(*dialerConn).closer.shutdown()
+
+	select {
+	case <-pConn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet conn not closed")
+	}
+
+	// a failed dial also releases the packet conn
+	pConn = mn.listen("unanswered")
+	profile := GetProfile(profileId)
+	profile.ConnectionSetupTimeoutMs = 200
+	_, err = DialPacket(pConn, memAddr("nowhere"), profileId)
+	assert.Error(t, err)
+	select {
+	case <-pConn.closed:
+	default:
+		t.Fatal("packet conn not closed after failed dial")
+	}
+}
+
+type memAddr string
+
+func (self memAddr) Network() string { return "mem" }
+func (self memAddr) String() string  { return string(self) }
+
+/*
+ * memNetwork delivers datagrams between in-memory packet connections, dropping them (as a network would) when the
+ * receiver's queue is full.
+ */
+type memNetwork struct {
+	lock  sync.Mutex
+	conns map[memAddr]*memPacketConn
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{conns: make(map[memAddr]*memPacketConn)}
+}
+
+func (self *memNetwork) listen(addr memAddr) *memPacketConn {
+	conn := &memPacketConn{network: self, addr: addr, rx: make(chan memDatagram, 1024), closed: make(chan struct{})}
+	self.lock.Lock()
+	self.conns[addr] = conn
+	self.lock.Unlock()
+	return conn
+}
+
+type memDatagram struct {
+	data []byte
+	from memAddr
+}
+
+type memPacketConn struct {
+	network      *memNetwork
+	addr         memAddr
+	rx           chan memDatagram
+	closed       chan struct{}
+	closeOnce    sync.Once
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func (self *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	self.lock.Lock()
+	deadline := self.readDeadline
+	self.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d := <-self.rx:
+		return copy(p, d.data), d.from, nil
+	case <-self.closed:
+		return 0, nil, errors.New("closed")
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (self *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-self.closed:
+		return 0, errors.New("closed")
+	default:
+	}
+	self.network.lock.Lock()
+	peer, found := self.network.conns[addr.(memAddr)]
+	self.network.lock.Unlock()
+	if found {
+		select {
+		case peer.rx <- memDatagram{append([]byte(nil), p...), self.addr}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (self *memPacketConn) Close() error {
+	self.closeOnce.Do(func() { close(self.closed) })
+	return nil
+}
+
+func (self *memPacketConn) LocalAddr() net.Addr {
+	return self.addr
+}
+
+func (self *memPacketConn) SetDeadline(t time.Time) error {
+	return self.SetReadDeadline(t)
+}
+
+func (self *memPacketConn) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.readDeadline = t
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *memPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
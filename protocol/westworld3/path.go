@@ -0,0 +1,110 @@
+package westworld3
+
+import (
+	"crypto/rand"
+	"github.com/openziti/dilithium/util"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+)
+
+const (
+	// connectionIdSz is the size of the connection id prefixed to each datagram sent by a dialer using connection ids
+	connectionIdSz = 4
+	// connectionIdMark is set in every connection id, so that a datagram prefixed with one is never mistaken for a
+	// HELLO (whose sequence is positive)
+	connectionIdMark = uint32(0x80000000)
+)
+
+/*
+ * path is where a connection sends its messages. A dialer using connection ids prefixes its id to every datagram, so
+ * that the listener can route them by id when the dialer's address changes (a NAT rebinding, or moving between
+ * networks). A listener connection's path migrates to the dialer's new address once it has been validated.
+ */
+type path struct {
+	conn net.PacketConn
+	lock sync.Mutex
+	peer net.Addr
+	cid  uint32 // set before the connection starts, 0 without a connection id
+	pool *pool  // for prefixing the connection id
+}
+
+func newPath(conn net.PacketConn, peer net.Addr) *path {
+	return &path{conn: conn, peer: peer}
+}
+
+/*
+ * setConnectionId prefixes cid to subsequent datagrams, which must fit (with the prefix) in buffers from p.
+ */
+func (self *path) setConnectionId(cid uint32, p *pool) {
+	self.cid = cid
+	self.pool = p
+}
+
+func (self *path) addr() net.Addr {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.peer
+}
+
+func (self *path) migrate(peer net.Addr) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.peer = peer
+}
+
+func (self *path) write(data []byte) error {
+	if self.cid != 0 {
+		prefixed := self.pool.get()
+		defer prefixed.unref()
+		if len(data)+connectionIdSz > len(prefixed.data) {
+			return errors.Errorf("short buffer for connection id [%d < %d]", len(prefixed.data), len(data)+connectionIdSz)
+		}
+		util.WriteUint32(prefixed.data, self.cid)
+		copy(prefixed.data[connectionIdSz:], data)
+		data = prefixed.data[:len(data)+connectionIdSz]
+	}
+
+	n, err := self.conn.WriteTo(data, self.addr())
+	if err != nil {
+		return errors.Wrap(err, "peer write")
+	}
+	if n != len(data) {
+		return errors.Errorf("short peer write [%d != %d]", n, len(data))
+	}
+	return nil
+}
+
+/*
+ * newConnectionId returns a random connection id, marked so it cannot be confused with the start of a HELLO, and never
+ * the all-ones value that starts unsequenced messages.
+ */
+func newConnectionId() (uint32, error) {
+	for {
+		data := make([]byte, connectionIdSz)
+		if _, err := rand.Read(data); err != nil {
+			return 0, errors.Wrap(err, "random connection id")
+		}
+		if cid := util.ReadUint32(data) | connectionIdMark; cid != 0xffffffff {
+			return cid, nil
+		}
+	}
+}
+
+/*
+ * readConnectionId returns the connection id a datagram may start with, or 0 when it cannot start with one.
+ */
+func readConnectionId(buffer *buffer) uint32 {
+	if buffer.uz < connectionIdSz {
+		return 0
+	}
+	if cid := util.ReadUint32(buffer.data); cid&connectionIdMark != 0 {
+		return cid
+	}
+	return 0
+}
+
+func stripConnectionId(buffer *buffer) {
+	copy(buffer.data, buffer.data[connectionIdSz:buffer.uz])
+	buffer.uz -= connectionIdSz
+}
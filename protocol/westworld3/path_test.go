@@ -0,0 +1,172 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionId(t *testing.T) {
+	p := newPool("test", 1024, NewNilInstrument().NewInstance("", nil))
+	for i := 0; i < 64; i++ {
+		cid, err := newConnectionId()
+		assert.NoError(t, err)
+		assert.NotEqual(t, uint32(0), cid&connectionIdMark)
+		assert.NotEqual(t, uint32(0xffffffff), cid)
+	}
+
+	// sequenced messages never start with a connection id
+	wm, err := newData(seqMask, nil, nil, 0, []byte("hello"), p)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), readConnectionId(wm.buffer))
+
+	buffer := p.get()
+	copy(buffer.data, []byte{0x80, 0xc0, 0xff, 0xee, 0x01, 0x02})
+	buffer.uz = 6
+	assert.Equal(t, uint32(0x80c0ffee), readConnectionId(buffer))
+	stripConnectionId(buffer)
+	assert.Equal(t, []byte{0x01, 0x02}, buffer.data[:buffer.uz])
+	assert.Equal(t, uint32(0), readConnectionId(buffer))
+}
+
+func TestConnectionMigration(t *testing.T) {
+	for _, encryption := range []string{"none", "chacha20poly1305"} {
+		t.Run(encryption, func(t *testing.T) {
+			profileId := registerTestProfile(t)
+			profile := GetProfile(profileId)
+			profile.RetxAddMs = 50
+			profile.ConnectionIds = true
+			profile.Encryption = encryption
+			mi := &recordingInstrument{}
+			profile.i = mi
+
+			l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+			assert.NoError(t, err)
+			defer func() { _ = l.Close() }()
+			r := newRebindingRelay(t, l.Addr().(*net.UDPAddr))
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+			conn, err := Dial(r.addr(), profileId)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer func() { _ = conn.Close() }()
+			var lConn net.Conn
+			select {
+			case lConn = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("accept timeout")
+			}
+			assert.NotEqual(t, uint32(0), lConn.(*listenerConn).cid)
+			assert.Equal(t, lConn.(*listenerConn).cid, conn.(*dialerConn).path.cid)
+			transfer(t, conn, lConn, 64*1024)
+
+			// the dialer's address changes; its connection continues once the new address is validated
+			from := r.backAddr()
+			to := r.rebind(t)
+			transfer(t, conn, lConn, 64*1024)
+			transfer(t, lConn, conn, 64*1024)
+			assert.Equal(t, to.String(), lConn.RemoteAddr().String())
+			assert.Equal(t, int64(1), atomic.LoadInt64(&mi.migrations))
+			assert.True(t, atomic.LoadInt64(&mi.pathChallenges) > 0)
+			assert.Equal(t, int64(1), atomic.LoadInt64(&mi.pathResponses))
+
+			ll := l.(*listener)
+			ll.lock.Lock()
+			_, found := ll.peers.Get(from)
+			assert.False(t, found)
+			_, found = ll.peers.Get(to)
+			assert.True(t, found)
+			ll.lock.Unlock()
+		})
+	}
+}
+
+/*
+ * rebindingRelay forwards datagrams between a single dialer and the listener, from a back socket that can be replaced to
+ * change the dialer's address, as a NAT rebinding would.
+ */
+type rebindingRelay struct {
+	front  *net.UDPConn
+	target *net.UDPAddr
+	lock   sync.Mutex
+	back   *net.UDPConn
+	dialer *net.UDPAddr
+}
+
+func newRebindingRelay(t *testing.T, target *net.UDPAddr) *rebindingRelay {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	r := &rebindingRelay{front: front, target: target}
+	r.rebind(t)
+	go r.forward()
+	t.Cleanup(func() {
+		_ = front.Close()
+		r.lock.Lock()
+		_ = r.back.Close()
+		r.lock.Unlock()
+	})
+	return r
+}
+
+func (self *rebindingRelay) addr() *net.UDPAddr {
+	return self.front.LocalAddr().(*net.UDPAddr)
+}
+
+func (self *rebindingRelay) backAddr() *net.UDPAddr {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.back.LocalAddr().(*net.UDPAddr)
+}
+
+func (self *rebindingRelay) rebind(t *testing.T) *net.UDPAddr {
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	self.lock.Lock()
+	if self.back != nil {
+		_ = self.back.Close()
+	}
+	self.back = back
+	self.lock.Unlock()
+	go self.reverse(back)
+	return back.LocalAddr().(*net.UDPAddr)
+}
+
+func (self *rebindingRelay) forward() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := self.front.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		self.dialer = peer
+		back := self.back
+		self.lock.Unlock()
+		_, _ = back.WriteToUDP(buf[:n], self.target)
+	}
+}
+
+func (self *rebindingRelay) reverse(back *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := back.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		dialer := self.dialer
+		self.lock.Unlock()
+		if dialer != nil {
+			_, _ = self.front.WriteToUDP(buf[:n], dialer)
+		}
+	}
+}
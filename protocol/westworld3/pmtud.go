@@ -0,0 +1,147 @@
+package westworld3
+
+import (
+	"net"
+	"time"
+)
+
+/*
+ * pmtud discovers the largest segment the path to the peer will carry (after DPLPMTUD, RFC 8899). Segments start at
+ * PmtuMinSegmentSz, and the search probes upwards towards MaxSegmentSz with padded probes, first at the full size and
+ * then by bisection. The seal and connection id come out of MaxSegmentSz, so that no datagram is larger than an
+ * unsealed DATA message carrying a full MaxSegmentSz segment. A probe size is abandoned after PmtuProbeAttempts
+ * unanswered probes, and the search completes once its bounds are within PmtuSearchResolution bytes. It is repeated
+ * every PmtuRaiseIntervalMs, in case the path improves.
+ *
+ * A black hole (the path mtu shrinking, without any signal from the network) is presumed when PmtuBlackHoleRetx
+ * rounds of timed retransmission pass without any acknowledgement. The segment size falls back to PmtuMinSegmentSz,
+ * and the search restarts below the size that stopped working.
+ *
+ * The txPortal owns the pmtud, and all access is under its lock.
+ */
+type pmtud struct {
+	profile    *Profile
+	overhead   int // wire bytes around each segment
+	base       int
+	max        int // MaxSegmentSz, less the overhead beyond the header
+	segmentSz  int // confirmed, and used for new segments
+	low        int // largest size confirmed in the current search
+	high       int // largest size not yet known to fail in the current search
+	failed     bool
+	searching  bool
+	probeSz    int // in flight, 0 when none
+	attempts   int
+	nextSearch time.Time
+	retxRounds int
+	peer       net.Addr
+	ii         InstrumentInstance
+}
+
+func newPmtud(profile *Profile, overhead int, peer net.Addr, ii InstrumentInstance) *pmtud {
+	max := profile.MaxSegmentSz - (overhead - dataStart)
+	base := profile.PmtuMinSegmentSz
+	if base > max {
+		base = max // the listener agreed to less during hello
+	}
+	pd := &pmtud{
+		profile:   profile,
+		overhead:  overhead,
+		base:      base,
+		max:       max,
+		segmentSz: base,
+		peer:      peer,
+		ii:        ii,
+	}
+	pd.search()
+	pd.ii.PathMtuChanged(pd.peer, pd.mtu())
+	return pd
+}
+
+/*
+ * mtu returns the largest datagram confirmed to reach the peer.
+ */
+func (self *pmtud) mtu() int {
+	return self.segmentSz + self.overhead
+}
+
+/*
+ * nextProbe returns the size to probe now, or 0 when no probe is needed. It is called every PmtuProbeTimeoutMs, so an
+ * outstanding probe has timed out.
+ */
+func (self *pmtud) nextProbe(now time.Time) int {
+	if self.probeSz > 0 {
+		self.attempts++
+		if self.attempts < self.profile.PmtuProbeAttempts {
+			return self.probeSz
+		}
+		self.high = self.probeSz - 1
+		self.failed = true
+		self.probeSz = 0
+	}
+	if !self.searching {
+		if now.Before(self.nextSearch) {
+			return 0
+		}
+		self.search()
+	}
+	if self.high <= self.low || (self.failed && self.high-self.low < self.profile.PmtuSearchResolution) {
+		self.searching = false
+		self.nextSearch = now.Add(time.Duration(self.profile.PmtuRaiseIntervalMs) * time.Millisecond)
+		return 0
+	}
+	self.probeSz = self.high
+	if self.failed {
+		self.probeSz = self.low + (self.high-self.low+1)/2
+	}
+	self.attempts = 0
+	return self.probeSz
+}
+
+/*
+ * ack confirms that a probe of sz reached the peer.
+ */
+func (self *pmtud) ack(sz int) {
+	if sz != self.probeSz {
+		return
+	}
+	self.probeSz = 0
+	self.attempts = 0
+	self.low = sz
+	if sz > self.segmentSz {
+		self.segmentSz = sz
+		self.ii.PathMtuChanged(self.peer, self.mtu())
+	}
+}
+
+/*
+ * acked notes that the peer acknowledged sequenced messages, so the current segment size is getting through.
+ */
+func (self *pmtud) acked() {
+	self.retxRounds = 0
+}
+
+/*
+ * timedRetx notes a round of timed retransmission, detecting a black hole.
+ */
+func (self *pmtud) timedRetx() {
+	self.retxRounds++
+	if self.retxRounds < self.profile.PmtuBlackHoleRetx || self.segmentSz <= self.base {
+		return
+	}
+	self.ii.PathMtuBlackHole(self.peer)
+	self.high = self.segmentSz - 1
+	self.failed = true
+	self.segmentSz = self.base
+	self.low = self.base
+	self.searching = true
+	self.probeSz = 0
+	self.retxRounds = 0
+	self.ii.PathMtuChanged(self.peer, self.mtu())
+}
+
+func (self *pmtud) search() {
+	self.searching = true
+	self.failed = false
+	self.low = self.segmentSz
+	self.high = self.max
+}
@@ -0,0 +1,191 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPmtudSearch(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.PmtuMinSegmentSz = 1200
+	pi := &recordingInstrument{}
+
+	for _, limit := range []int{1450, 1300, 1201, 1200} {
+		pd := newPmtud(profile, dataStart, nil, pi.NewInstance("", nil))
+		assert.Equal(t, 1200, pd.segmentSz)
+		now := time.Now()
+		probes := 0
+		for sz := pd.nextProbe(now); sz > 0; sz = pd.nextProbe(now) {
+			if sz <= limit {
+				pd.ack(sz)
+			}
+			probes++
+			assert.True(t, probes < 64)
+		}
+		assert.True(t, pd.segmentSz <= limit, "limit %d", limit)
+		assert.True(t, pd.segmentSz > limit-profile.PmtuSearchResolution, "limit %d", limit)
+		assert.Equal(t, int64(pd.mtu()), atomic.LoadInt64(&pi.pathMtu))
+		assert.Equal(t, pd.segmentSz+dataStart, pd.mtu())
+	}
+}
+
+func TestPmtudRaise(t *testing.T) {
+	profile := NewBaselineProfile()
+	pd := newPmtud(profile, dataStart, nil, NewNilInstrument().NewInstance("", nil))
+
+	now := time.Now()
+	for sz := pd.nextProbe(now); sz > 0; sz = pd.nextProbe(now) {
+		if sz <= 1300 {
+			pd.ack(sz)
+		}
+	}
+	segmentSz := pd.segmentSz
+
+	// the path improves, but is not probed again until the raise interval passes
+	assert.Equal(t, 0, pd.nextProbe(now.Add(time.Second)))
+	later := now.Add(time.Duration(profile.PmtuRaiseIntervalMs) * time.Millisecond)
+	assert.Equal(t, profile.MaxSegmentSz, pd.nextProbe(later))
+	pd.ack(profile.MaxSegmentSz)
+	assert.Equal(t, profile.MaxSegmentSz, pd.segmentSz)
+	assert.True(t, pd.segmentSz > segmentSz)
+}
+
+func TestPmtudOverhead(t *testing.T) {
+	profile := NewBaselineProfile()
+	overhead := dataStart + sealOverhead + connectionIdSz
+	pd := newPmtud(profile, overhead, nil, NewNilInstrument().NewInstance("", nil))
+
+	// the search tops out where the sealed, connection id prefixed datagram is as large as an unsealed full segment
+	now := time.Now()
+	assert.Equal(t, profile.MaxSegmentSz-sealOverhead-connectionIdSz, pd.nextProbe(now))
+	pd.ack(pd.probeSz)
+	assert.Equal(t, 0, pd.nextProbe(now))
+	assert.Equal(t, dataStart+profile.MaxSegmentSz, pd.mtu())
+}
+
+func TestPmtudBlackHole(t *testing.T) {
+	profile := NewBaselineProfile()
+	pi := &recordingInstrument{}
+	pd := newPmtud(profile, dataStart, nil, pi.NewInstance("", nil))
+	pd.ack(pd.nextProbe(time.Now()))
+	assert.Equal(t, profile.MaxSegmentSz, pd.segmentSz)
+
+	// acknowledgements between rounds of retransmission are not a black hole
+	for i := 0; i < 2*profile.PmtuBlackHoleRetx; i++ {
+		pd.timedRetx()
+		pd.acked()
+	}
+	assert.Equal(t, profile.MaxSegmentSz, pd.segmentSz)
+
+	for i := 0; i < profile.PmtuBlackHoleRetx; i++ {
+		pd.timedRetx()
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&pi.blackHoles))
+	assert.Equal(t, profile.PmtuMinSegmentSz, pd.segmentSz)
+	assert.Equal(t, int64(profile.PmtuMinSegmentSz+dataStart), atomic.LoadInt64(&pi.pathMtu))
+
+	// the search resumes immediately, below the size that stopped working
+	sz := pd.nextProbe(time.Now())
+	assert.True(t, sz > profile.PmtuMinSegmentSz && sz < profile.MaxSegmentSz)
+
+	// no further black hole at the base segment size
+	for i := 0; i < profile.PmtuBlackHoleRetx; i++ {
+		pd.timedRetx()
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&pi.blackHoles))
+}
+
+func TestPmtuDiscoveryTransfer(t *testing.T) {
+	profileId := registerTestProfile(t)
+	profile := GetProfile(profileId)
+	profile.RetxAddMs = 50
+	profile.MaxSegmentSz = 4000
+	profile.PmtuDiscovery = true
+	profile.PmtuMinSegmentSz = 1000
+	profile.PmtuProbeTimeoutMs = 20
+	pi := &recordingInstrument{}
+	profile.i = pi
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	r := newUdpRelay(t, l.Addr().(*net.UDPAddr))
+	r.setLimit(2000)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := Dial(r.addr(), profileId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() { _ = conn.Close() }()
+	var lConn net.Conn
+	select {
+	case lConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+
+	txp := conn.(*dialerConn).txPortal
+	waitForSegmentSz(t, txp, func(segmentSz int) bool { return segmentSz > 2000-dataStart-profile.PmtuSearchResolution })
+	txp.lock.Lock()
+	assert.True(t, txp.pmtud.mtu() <= 2000)
+	segmentSz := txp.pmtud.segmentSz
+	txp.lock.Unlock()
+	assert.True(t, atomic.LoadInt64(&pi.pmtuProbes) > 0)
+	assert.True(t, atomic.LoadInt64(&pi.pmtuAcks) > 0)
+	transfer(t, conn, lConn, 256*1024)
+
+	// datagrams are limited to the discovered segment size
+	assert.Error(t, conn.(*dialerConn).SendDatagram(make([]byte, segmentSz+1)))
+	assert.NoError(t, conn.(*dialerConn).SendDatagram(make([]byte, segmentSz)))
+	datagram, err := lConn.(*listenerConn).ReceiveDatagram()
+	assert.NoError(t, err)
+	assert.Equal(t, segmentSz, len(datagram))
+
+	// the path shrinks below the discovered mtu; segments in flight must be fragmented to get through
+	r.setLimit(1200)
+	transfer(t, conn, lConn, 256*1024)
+	assert.True(t, atomic.LoadInt64(&pi.blackHoles) > 0)
+	waitForSegmentSz(t, txp, func(segmentSz int) bool { return segmentSz > 1200-dataStart-profile.PmtuSearchResolution })
+	txp.lock.Lock()
+	assert.True(t, txp.pmtud.mtu() <= 1200)
+	txp.lock.Unlock()
+	transfer(t, conn, lConn, 256*1024)
+}
+
+func waitForSegmentSz(t *testing.T, txp *txPortal, f func(segmentSz int) bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		txp.lock.Lock()
+		segmentSz := txp.pmtud.segmentSz
+		searching := txp.pmtud.searching
+		txp.lock.Unlock()
+		if !searching && f(segmentSz) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("path mtu search did not complete")
+}
+
+func transfer(t *testing.T, conn, lConn net.Conn, sz int) {
+	data := make([]byte, sz)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() { _, _ = conn.Write(data) }()
+	buf := make([]byte, len(data))
+	assert.NoError(t, lConn.SetReadDeadline(time.Now().Add(20*time.Second)))
+	_, err := io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf)
+}
@@ -1,8 +1,12 @@
 package westworld3
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/openziti/dilithium/cf"
 	"github.com/pkg/errors"
+	"hash/fnv"
+	"io/ioutil"
 	"reflect"
 )
 
@@ -10,6 +14,9 @@ const profileVersion = 1
 
 var profileRegistry map[byte]*Profile
 
+// minSegmentSz is the smallest segment size a listener will agree to during hello
+const minSegmentSz = 256
+
 func init() {
 	profileRegistry = make(map[byte]*Profile)
 	profileRegistry[0] = NewBaselineProfile()
@@ -39,7 +46,20 @@ type Profile struct {
 	ConnectionInactiveTimeoutMs int     `cf:"connection_inactive_timeout_ms"`
 	SendKeepalive               bool    `cf:"send_keepalive"`
 	CloseWaitMs                 int     `cf:"close_wait_ms"`
-	CloseCheckMs                int     `cf:"close_check_ms`
+	CloseCheckMs                int     `cf:"close_check_ms"`
+	ListenerCloseTimeoutMs      int     `cf:"listener_close_timeout_ms"`
+	HelloRequireProfile         bool    `cf:"hello_require_profile"`
+	HelloCookies                bool    `cf:"hello_cookies"`
+	HelloCookieThresh           int     `cf:"hello_cookie_thresh"`
+	HelloCookieLifetimeMs       int     `cf:"hello_cookie_lifetime_ms"`
+	ListenerMaxPeers            int     `cf:"listener_max_peers"`
+	ListenerIpHelloRate         float64 `cf:"listener_ip_hello_rate"`
+	ListenerIpHelloBurst        int     `cf:"listener_ip_hello_burst"`
+	ListenerSubnetHelloRate     float64 `cf:"listener_subnet_hello_rate"`
+	ListenerSubnetHelloBurst    int     `cf:"listener_subnet_hello_burst"`
+	ListenerHelloRateBuckets    int     `cf:"listener_hello_rate_buckets"`
+	ListenerSubnetV4Prefix      int     `cf:"listener_subnet_v4_prefix"`
+	ListenerSubnetV6Prefix      int     `cf:"listener_subnet_v6_prefix"`
 	TxPortalStartSz             int     `cf:"tx_portal_start_sz"`
 	TxPortalMinSz               int     `cf:"tx_portal_min_sz"`
 	TxPortalMaxSz               int     `cf:"tx_portal_max_sz"`
@@ -52,6 +72,16 @@ type Profile struct {
 	TxPortalRetxCapacityScale   float64 `cf:"tx_portal_retx_capacity_scale"`
 	TxPortalRetxSuccessScale    float64 `cf:"tx_portal_retx_success_scale"`
 	TxPortalRxSzPressureScale   float64 `cf:"tx_portal_rx_sz_pressure_scale"`
+	TxPortalFastRetxThresh      int     `cf:"tx_portal_fast_retx_thresh"`
+	TxPortalPacing              bool    `cf:"tx_portal_pacing"`
+	TxPortalPacingGain          float64 `cf:"tx_portal_pacing_gain"`
+	CongestionController        string  `cf:"congestion_controller"`
+	BbrBwWindowRounds           int     `cf:"bbr_bw_window_rounds"`
+	BbrMinRttWindowMs           int     `cf:"bbr_min_rtt_window_ms"`
+	BbrProbeRttMs               int     `cf:"bbr_probe_rtt_ms"`
+	LedbatTargetGain            float64 `cf:"ledbat_target_gain"`
+	LedbatGain                  float64 `cf:"ledbat_gain"`
+	LedbatBaseHistory           int     `cf:"ledbat_base_history"`
 	RetxStartMs                 int     `cf:"retx_start_ms"`
 	RetxScale                   float64 `cf:"retx_scale"`
 	RetxScaleFloor              float64 `cf:"retx_scale_floor"`
@@ -60,10 +90,27 @@ type Profile struct {
 	RetxEvaluationScaleIncr     float64 `cf:"retx_evaluation_scale_incr"`
 	RetxEvaluationScaleDecr     float64 `cf:"retx_evaluation_scale_decr"`
 	RetxBatchMs                 int     `cf:"retx_batch_ms"`
+	RetxWaitlist                string  `cf:"retx_waitlist"`
+	RetxEstimator               string  `cf:"retx_estimator"`
+	RetxMinMs                   int     `cf:"retx_min_ms"`
+	RetxMaxMs                   int     `cf:"retx_max_ms"`
 	RttProbeMs                  int     `cf:"rtt_probe_ms"`
 	RttProbeAvg                 int     `cf:"rtt_probe_avg"`
+	RttProbeWide                bool    `cf:"rtt_probe_wide"`
+	ConnectionIds               bool    `cf:"connection_ids"`
+	PathChallengeMs             int     `cf:"path_challenge_ms"`
 	RxPortalSzPacingThresh      float64 `cf:"rx_portal_sz_pacing_thresh"`
+	AckCoalesceThresh           int     `cf:"ack_coalesce_thresh"`
+	AckDelayMs                  int     `cf:"ack_delay_ms"`
+	MaxInlineAcks               int     `cf:"max_inline_acks"`
 	MaxSegmentSz                int     `cf:"max_segment_sz"`
+	PmtuDiscovery               bool    `cf:"pmtu_discovery"`
+	PmtuMinSegmentSz            int     `cf:"pmtu_min_segment_sz"`
+	PmtuProbeTimeoutMs          int     `cf:"pmtu_probe_timeout_ms"`
+	PmtuProbeAttempts           int     `cf:"pmtu_probe_attempts"`
+	PmtuSearchResolution        int     `cf:"pmtu_search_resolution"`
+	PmtuRaiseIntervalMs         int     `cf:"pmtu_raise_interval_ms"`
+	PmtuBlackHoleRetx           int     `cf:"pmtu_black_hole_retx"`
 	PoolBufferSz                int     `cf:"pool_buffer_sz"`
 	RxBufferSz                  int     `cf:"rx_buffer_sz"`
 	TxBufferSz                  int     `cf:"tx_buffer_sz"`
@@ -74,7 +121,19 @@ type Profile struct {
 	ReadsQueueLen               int     `cf:"reads_queue_len"`
 	ListenerRxQueueLen          int     `cf:"listener_rx_queue_len"`
 	AcceptQueueLen              int     `cf:"accept_queue_len"`
+	MuxStreamWindowSz           int     `cf:"mux_stream_window_sz"`
+	MuxMaxStreams               int     `cf:"mux_max_streams"`
+	DatagramQueueLen            int     `cf:"datagram_queue_len"`
+	Encryption                  string  `cf:"encryption"`
+	EncryptionPskPath           string  `cf:"encryption_psk_path"`
+	EncryptionUnauthenticated   bool    `cf:"encryption_unauthenticated"`
+	EncryptionRekeyMs           int     `cf:"encryption_rekey_ms"`
+	EncryptionRekeyMessages     int     `cf:"encryption_rekey_messages"`
+	EncryptionReplayWindow      int     `cf:"encryption_replay_window"`
+	psk                         []byte  // loaded from EncryptionPskPath
+	acceptFilter                AcceptFilter
 	i                           Instrument
+	startSeq                    int32 // without RandomizeSeq; only changed by tests, to start near a wrap
 }
 
 func NewBaselineProfile() *Profile {
@@ -85,6 +144,19 @@ func NewBaselineProfile() *Profile {
 		SendKeepalive:               true,
 		CloseWaitMs:                 5000,
 		CloseCheckMs:                500,
+		ListenerCloseTimeoutMs:      10000,
+		HelloRequireProfile:         false,
+		HelloCookies:                false,
+		HelloCookieThresh:           64,
+		HelloCookieLifetimeMs:       10000,
+		ListenerMaxPeers:            0,
+		ListenerIpHelloRate:         0,
+		ListenerIpHelloBurst:        10,
+		ListenerSubnetHelloRate:     0,
+		ListenerSubnetHelloBurst:    100,
+		ListenerHelloRateBuckets:    64 * 1024,
+		ListenerSubnetV4Prefix:      24,
+		ListenerSubnetV6Prefix:      48,
 		TxPortalStartSz:             96 * 1024,
 		TxPortalMinSz:               16 * 1024,
 		TxPortalMaxSz:               4 * 1024 * 1024,
@@ -97,6 +169,16 @@ func NewBaselineProfile() *Profile {
 		TxPortalRetxCapacityScale:   0.75,
 		TxPortalRetxSuccessScale:    0.825,
 		TxPortalRxSzPressureScale:   2.8911,
+		TxPortalFastRetxThresh:      3,
+		TxPortalPacing:              false,
+		TxPortalPacingGain:          1.25,
+		CongestionController:        "baseline",
+		BbrBwWindowRounds:           10,
+		BbrMinRttWindowMs:           10000,
+		BbrProbeRttMs:               200,
+		LedbatTargetGain:            0.25,
+		LedbatGain:                  1.0,
+		LedbatBaseHistory:           10,
 		RetxStartMs:                 200,
 		RetxScale:                   1.5,
 		RetxScaleFloor:              1.0,
@@ -105,10 +187,27 @@ func NewBaselineProfile() *Profile {
 		RetxEvaluationScaleIncr:     0.15,
 		RetxEvaluationScaleDecr:     0.01,
 		RetxBatchMs:                 2,
+		RetxWaitlist:                "array",
+		RetxEstimator:               "average",
+		RetxMinMs:                   200,
+		RetxMaxMs:                   60000,
 		RttProbeMs:                  50,
 		RttProbeAvg:                 8,
+		RttProbeWide:                false,
+		ConnectionIds:               false,
+		PathChallengeMs:             250,
 		RxPortalSzPacingThresh:      0.5,
+		AckCoalesceThresh:           2,
+		AckDelayMs:                  5,
+		MaxInlineAcks:               16,
 		MaxSegmentSz:                1450,
+		PmtuDiscovery:               false,
+		PmtuMinSegmentSz:            1200,
+		PmtuProbeTimeoutMs:          1000,
+		PmtuProbeAttempts:           3,
+		PmtuSearchResolution:        16,
+		PmtuRaiseIntervalMs:         10 * 60 * 1000,
+		PmtuBlackHoleRetx:           3,
 		PoolBufferSz:                64 * 1024,
 		RxBufferSz:                  16 * 1024 * 1024,
 		TxBufferSz:                  16 * 1024 * 1024,
@@ -119,10 +218,39 @@ func NewBaselineProfile() *Profile {
 		ReadsQueueLen:               1024,
 		ListenerRxQueueLen:          1024,
 		AcceptQueueLen:              1024,
+		MuxStreamWindowSz:           256 * 1024,
+		MuxMaxStreams:               1024,
+		DatagramQueueLen:            1024,
+		EncryptionRekeyMs:           2 * 60 * 1000,
+		EncryptionRekeyMessages:     1 << 24,
+		EncryptionReplayWindow:      4096,
 		i:                           NewNilInstrument(),
 	}
 }
 
+/*
+ * SetAcceptFilter installs a filter consulted by listeners using this profile before admitting each new peer.
+ */
+func (self *Profile) SetAcceptFilter(f AcceptFilter) {
+	self.acceptFilter = f
+}
+
+/*
+ * agreementDigest summarizes the fields that both ends of a connection must hold in common for a registered profile to
+ * be adopted by id: the congestion controller, rtt probe width, cipher suite, path MTU discovery and connection ids.
+ */
+func (self *Profile) agreementDigest() uint32 {
+	suite, _ := cipherSuiteFor(self.Encryption)
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s|%t|%d|%t|%t", self.CongestionController, self.RttProbeWide, suite, self.PmtuDiscovery, self.ConnectionIds)
+	return h.Sum32()
+}
+
+func (self *Profile) clone() *Profile {
+	p := *self
+	return &p
+}
+
 func (self *Profile) Load(data map[string]interface{}) error {
 	if v, found := data["profile_version"]; found {
 		if i, ok := v.(int); ok {
@@ -159,7 +287,107 @@ func (self *Profile) Load(data map[string]interface{}) error {
 			return errors.New("invalid instrument map")
 		}
 	}
-	return cf.Load(data, self)
+	if err := cf.Load(data, self); err != nil {
+		return err
+	}
+	if _, err := newWaitlist(self.RetxWaitlist); err != nil {
+		return errors.Wrap(err, "invalid 'retx_waitlist'")
+	}
+	if err := validateRetxEstimator(self.RetxEstimator); err != nil {
+		return errors.Wrap(err, "invalid 'retx_estimator'")
+	}
+	if self.RetxMinMs < 1 {
+		return errors.Errorf("invalid 'retx_min_ms' [%d]", self.RetxMinMs)
+	}
+	if self.RetxMaxMs < self.RetxMinMs {
+		return errors.Errorf("invalid 'retx_max_ms' [%d < %d]", self.RetxMaxMs, self.RetxMinMs)
+	}
+	if _, err := congestionControllerFactory(self.CongestionController); err != nil {
+		return errors.Wrap(err, "invalid 'congestion_controller'")
+	}
+	if self.PmtuMinSegmentSz < minSegmentSz || self.PmtuMinSegmentSz > self.MaxSegmentSz {
+		return errors.Errorf("invalid 'pmtu_min_segment_sz' [%d]", self.PmtuMinSegmentSz)
+	}
+	if self.PmtuDiscovery && dataStart+self.MaxSegmentSz > maxFragments*(self.PmtuMinSegmentSz-fragmentHeaderSz) {
+		return errors.Errorf("'max_segment_sz' [%d] cannot be fragmented at 'pmtu_min_segment_sz' [%d]", self.MaxSegmentSz, self.PmtuMinSegmentSz)
+	}
+	if self.PmtuProbeTimeoutMs < 1 {
+		return errors.Errorf("invalid 'pmtu_probe_timeout_ms' [%d]", self.PmtuProbeTimeoutMs)
+	}
+	if self.PmtuProbeAttempts < 1 {
+		return errors.Errorf("invalid 'pmtu_probe_attempts' [%d]", self.PmtuProbeAttempts)
+	}
+	if self.PmtuSearchResolution < 1 {
+		return errors.Errorf("invalid 'pmtu_search_resolution' [%d]", self.PmtuSearchResolution)
+	}
+	if self.PmtuRaiseIntervalMs < 1 {
+		return errors.Errorf("invalid 'pmtu_raise_interval_ms' [%d]", self.PmtuRaiseIntervalMs)
+	}
+	if self.PmtuBlackHoleRetx < 1 {
+		return errors.Errorf("invalid 'pmtu_black_hole_retx' [%d]", self.PmtuBlackHoleRetx)
+	}
+	if self.PathChallengeMs < 1 {
+		return errors.Errorf("invalid 'path_challenge_ms' [%d]", self.PathChallengeMs)
+	}
+	if self.MuxStreamWindowSz < 1 {
+		return errors.Errorf("invalid 'mux_stream_window_sz' [%d]", self.MuxStreamWindowSz)
+	}
+	if self.MuxMaxStreams < 1 {
+		return errors.Errorf("invalid 'mux_max_streams' [%d]", self.MuxMaxStreams)
+	}
+	if self.DatagramQueueLen < 0 {
+		return errors.Errorf("invalid 'datagram_queue_len' [%d]", self.DatagramQueueLen)
+	}
+	if _, err := cipherSuiteFor(self.Encryption); err != nil {
+		return errors.Wrap(err, "invalid 'encryption'")
+	}
+	if self.EncryptionPskPath != "" {
+		psk, err := ioutil.ReadFile(self.EncryptionPskPath)
+		if err != nil {
+			return errors.Wrap(err, "invalid 'encryption_psk_path'")
+		}
+		self.psk = bytes.TrimSpace(psk)
+	} else if self.Encryption != "" && !self.EncryptionUnauthenticated {
+		// without a psk the key exchange is open to an on-path attacker
+		return errors.New("'encryption' requires 'encryption_psk_path', or 'encryption_unauthenticated'")
+	}
+	if self.EncryptionRekeyMs < 1 {
+		return errors.Errorf("invalid 'encryption_rekey_ms' [%d]", self.EncryptionRekeyMs)
+	}
+	if self.EncryptionRekeyMessages < 1 {
+		return errors.Errorf("invalid 'encryption_rekey_messages' [%d]", self.EncryptionRekeyMessages)
+	}
+	if self.EncryptionReplayWindow < 1 {
+		return errors.Errorf("invalid 'encryption_replay_window' [%d]", self.EncryptionReplayWindow)
+	}
+	if self.HelloCookieThresh < 0 {
+		return errors.Errorf("invalid 'hello_cookie_thresh' [%d]", self.HelloCookieThresh)
+	}
+	if self.HelloCookieLifetimeMs < 1 {
+		return errors.Errorf("invalid 'hello_cookie_lifetime_ms' [%d]", self.HelloCookieLifetimeMs)
+	}
+	if self.ListenerMaxPeers < 0 {
+		return errors.Errorf("invalid 'listener_max_peers' [%d]", self.ListenerMaxPeers)
+	}
+	if self.ListenerIpHelloRate < 0 {
+		return errors.Errorf("invalid 'listener_ip_hello_rate' [%f]", self.ListenerIpHelloRate)
+	}
+	if self.ListenerSubnetHelloRate < 0 {
+		return errors.Errorf("invalid 'listener_subnet_hello_rate' [%f]", self.ListenerSubnetHelloRate)
+	}
+	if self.ListenerHelloRateBuckets < 1 {
+		return errors.Errorf("invalid 'listener_hello_rate_buckets' [%d]", self.ListenerHelloRateBuckets)
+	}
+	if self.ListenerSubnetV4Prefix < 0 || self.ListenerSubnetV4Prefix > 32 {
+		return errors.Errorf("invalid 'listener_subnet_v4_prefix' [%d]", self.ListenerSubnetV4Prefix)
+	}
+	if self.ListenerSubnetV6Prefix < 0 || self.ListenerSubnetV6Prefix > 128 {
+		return errors.Errorf("invalid 'listener_subnet_v6_prefix' [%d]", self.ListenerSubnetV6Prefix)
+	}
+	if self.LedbatTargetGain <= 0 {
+		return errors.Errorf("invalid 'ledbat_target_gain' [%f]", self.LedbatTargetGain)
+	}
+	return nil
 }
 
 func (self *Profile) Dump() string {
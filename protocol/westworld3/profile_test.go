@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/openziti/dilithium/cf"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 )
 
@@ -33,3 +35,161 @@ func TestAddProfile(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, byte(2), id)
 }
+
+func TestProfileLoadRetxWaitlist(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	assert.Equal(t, "array", p.RetxWaitlist)
+	d["retx_waitlist"] = "heap"
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, "heap", p.RetxWaitlist)
+
+	d["retx_waitlist"] = "wheel"
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadCongestionController(t *testing.T) {
+	p := NewBaselineProfile()
+	assert.Equal(t, "baseline", p.CongestionController)
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["congestion_controller"] = "baseline"
+	assert.NoError(t, p.Load(d))
+
+	d["congestion_controller"] = "reno"
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadLedbatTarget(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["congestion_controller"] = "ledbat"
+	d["ledbat_target_gain"] = 0.5
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, 0.5, p.LedbatTargetGain)
+
+	d["ledbat_target_gain"] = 0.0
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadMuxMaxStreams(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["mux_max_streams"] = 16
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, 16, p.MuxMaxStreams)
+
+	d["mux_max_streams"] = 0
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadEncryption(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["encryption"] = "chacha20poly1305"
+	assert.Error(t, p.Load(d))
+	d["encryption_unauthenticated"] = true
+	assert.NoError(t, p.Load(d))
+	assert.Nil(t, p.psk)
+	delete(d, "encryption_unauthenticated")
+
+	pskPath := filepath.Join(t.TempDir(), "psk")
+	assert.NoError(t, ioutil.WriteFile(pskPath, []byte("secret\n"), 0600))
+	d["encryption_psk_path"] = pskPath
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, []byte("secret"), p.psk)
+
+	d["encryption_psk_path"] = filepath.Join(t.TempDir(), "missing")
+	assert.Error(t, p.Load(d))
+	delete(d, "encryption_psk_path")
+	d["encryption_unauthenticated"] = true
+
+	d["encryption"] = "rot13"
+	assert.Error(t, p.Load(d))
+	d["encryption"] = "aes-gcm"
+	d["encryption_replay_window"] = 0
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadListenerAdmission(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["listener_max_peers"] = 16
+	d["listener_ip_hello_rate"] = 2.5
+	d["listener_subnet_v6_prefix"] = 56
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, 16, p.ListenerMaxPeers)
+	assert.Equal(t, 2.5, p.ListenerIpHelloRate)
+	assert.Equal(t, 56, p.ListenerSubnetV6Prefix)
+
+	d["listener_subnet_v4_prefix"] = 33
+	assert.Error(t, p.Load(d))
+	d["listener_subnet_v4_prefix"] = 24
+	d["listener_hello_rate_buckets"] = 0
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadRetxEstimator(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["retx_estimator"] = "rfc6298"
+	d["retx_min_ms"] = 50
+	d["retx_max_ms"] = 5000
+	assert.NoError(t, p.Load(d))
+	assert.Equal(t, "rfc6298", p.RetxEstimator)
+	assert.Equal(t, 50, p.RetxMinMs)
+	assert.Equal(t, 5000, p.RetxMaxMs)
+
+	d["retx_max_ms"] = 10
+	assert.Error(t, p.Load(d))
+
+	d["retx_max_ms"] = 5000
+	d["retx_estimator"] = "kalman"
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadPmtu(t *testing.T) {
+	p := NewBaselineProfile()
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["pmtu_discovery"] = true
+	d["max_segment_sz"] = 8000
+	d["pmtu_min_segment_sz"] = 1000
+	d["pmtu_probe_timeout_ms"] = 500
+	assert.NoError(t, p.Load(d))
+	assert.True(t, p.PmtuDiscovery)
+	assert.Equal(t, 8000, p.MaxSegmentSz)
+	assert.Equal(t, 1000, p.PmtuMinSegmentSz)
+	assert.Equal(t, 500, p.PmtuProbeTimeoutMs)
+
+	d["pmtu_min_segment_sz"] = 9000
+	assert.Error(t, p.Load(d))
+
+	d["pmtu_min_segment_sz"] = 300
+	assert.Error(t, p.Load(d)) // too many fragments to retransmit a full segment
+
+	d["pmtu_min_segment_sz"] = 1000
+	d["pmtu_probe_attempts"] = 0
+	assert.Error(t, p.Load(d))
+}
+
+func TestProfileLoadConnectionIds(t *testing.T) {
+	p := NewBaselineProfile()
+	assert.False(t, p.ConnectionIds)
+	d := make(map[string]interface{})
+	d["profile_version"] = profileVersion
+	d["connection_ids"] = true
+	d["path_challenge_ms"] = 100
+	assert.NoError(t, p.Load(d))
+	assert.True(t, p.ConnectionIds)
+	assert.Equal(t, 100, p.PathChallengeMs)
+
+	d["path_challenge_ms"] = 0
+	assert.Error(t, p.Load(d))
+}
@@ -0,0 +1,84 @@
+package westworld3
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// rfc6298Alpha and rfc6298Beta are the smoothing gains for srtt and rttvar (1/8 and 1/4)
+	rfc6298Alpha = 8
+	rfc6298Beta  = 4
+	// rfc6298K scales rttvar in the retransmission timeout
+	rfc6298K = 4
+	// rfc6298Granularity is the clock granularity, the least variance allowed for in the retransmission timeout
+	rfc6298Granularity = time.Millisecond
+)
+
+func validateRetxEstimator(name string) error {
+	switch name {
+	case "average", "rfc6298":
+		return nil
+	default:
+		return errors.Errorf("unknown retx estimator '%s'", name)
+	}
+}
+
+/*
+ * rfc6298Estimator computes the retransmission timeout from the smoothed rtt and rtt variance (after RFC 6298), clamped
+ * between RetxMinMs and RetxMaxMs. Each expiry of the retransmission timer doubles the timeout, until the next rtt
+ * sample recomputes it; the retxMonitor backs off at most once per timeout interval, as a lost window expires in several
+ * batches. Rtt probes are restamped when retransmitted, so every sample is unambiguous.
+ */
+type rfc6298Estimator struct {
+	profile  *Profile
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	measured bool
+}
+
+func newRfc6298Estimator(profile *Profile) *rfc6298Estimator {
+	return &rfc6298Estimator{
+		profile: profile,
+		rto:     time.Duration(profile.RetxStartMs) * time.Millisecond,
+	}
+}
+
+func (self *rfc6298Estimator) sample(rtt time.Duration) {
+	if !self.measured {
+		self.srtt = rtt
+		self.rttvar = rtt / 2
+		self.measured = true
+	} else {
+		delta := self.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		self.rttvar += (delta - self.rttvar) / rfc6298Beta
+		self.srtt += (rtt - self.srtt) / rfc6298Alpha
+	}
+	variance := rfc6298K * self.rttvar
+	if variance < rfc6298Granularity {
+		variance = rfc6298Granularity
+	}
+	self.rto = self.clamp(self.srtt + variance)
+}
+
+func (self *rfc6298Estimator) backoff() {
+	self.rto = self.clamp(2 * self.rto)
+}
+
+func (self *rfc6298Estimator) retxMs() int {
+	return int(self.rto / time.Millisecond)
+}
+
+func (self *rfc6298Estimator) clamp(rto time.Duration) time.Duration {
+	if min := time.Duration(self.profile.RetxMinMs) * time.Millisecond; rto < min {
+		return min
+	}
+	if max := time.Duration(self.profile.RetxMaxMs) * time.Millisecond; rto > max {
+		return max
+	}
+	return rto
+}
@@ -0,0 +1,109 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRfc6298Estimator(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.RetxMinMs = 200
+	profile.RetxMaxMs = 1000
+	e := newRfc6298Estimator(profile)
+	assert.Equal(t, profile.RetxStartMs, e.retxMs())
+
+	e.sample(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, e.srtt)
+	assert.Equal(t, 50*time.Millisecond, e.rttvar)
+	assert.Equal(t, 300, e.retxMs())
+
+	e.sample(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, e.srtt)
+	assert.Equal(t, 37500*time.Microsecond, e.rttvar)
+	assert.Equal(t, 250, e.retxMs())
+
+	// jitter widens the timeout
+	e.sample(300 * time.Millisecond)
+	assert.Equal(t, 125*time.Millisecond, e.srtt)
+	assert.Equal(t, 78125*time.Microsecond, e.rttvar)
+	assert.Equal(t, 437, e.retxMs())
+
+	// a stable path converges to the floor
+	for i := 0; i < 100; i++ {
+		e.sample(10 * time.Millisecond)
+	}
+	assert.Equal(t, 200, e.retxMs())
+
+	e.backoff()
+	assert.Equal(t, 400, e.retxMs())
+	e.backoff()
+	e.backoff()
+	assert.Equal(t, 1000, e.retxMs())
+
+	// the next sample recomputes the timeout
+	e.sample(10 * time.Millisecond)
+	assert.Equal(t, 200, e.retxMs())
+}
+
+func TestRetxMonitorRfc6298Backoff(t *testing.T) {
+	ri := &recordingInstrument{}
+	profile := NewBaselineProfile()
+	profile.RetxEstimator = "rfc6298"
+	profile.RetxStartMs = 20
+	profile.RetxMinMs = 20
+	profile.RetxMaxMs = 80
+	profile.RttProbeMs = 60000
+	profile.i = ri
+	txp, seq := newTestTxPortalProfile(t, profile)
+
+	// the sink never acks
+	_, err := txp.tx([]byte{1}, seq)
+	assert.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+
+	ri.lock.Lock()
+	if assert.True(t, len(ri.retxMs) >= 3) {
+		assert.Equal(t, []int{40, 80, 80}, ri.retxMs[:3])
+	}
+	ri.lock.Unlock()
+
+	txp.rtt(*txp.rttClock.probe(false, time.Now()))
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	assert.Equal(t, 20, ri.retxMs[len(ri.retxMs)-1])
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ri.rttEstimates))
+}
+
+func TestRetxMonitorRfc6298WindowBackoff(t *testing.T) {
+	ri := &recordingInstrument{}
+	profile := NewBaselineProfile()
+	profile.RetxEstimator = "rfc6298"
+	profile.RetxStartMs = 200
+	profile.RetxMinMs = 200
+	profile.RetxMaxMs = 10000
+	profile.RttProbeMs = 60000
+	profile.i = ri
+	txp, seq := newTestTxPortalProfile(t, profile)
+
+	// the sink never acks; a window sent over 120ms expires as 4 batches, the first at 200ms, backing off to 400ms and
+	// moving the rest to 440ms, 480ms and 520ms
+	for i := 0; i < 4; i++ {
+		_, err := txp.tx([]byte{byte(i)}, seq)
+		assert.NoError(t, err)
+		time.Sleep(40 * time.Millisecond)
+	}
+	time.Sleep(400 * time.Millisecond)
+
+	ri.lock.Lock()
+	assert.Equal(t, int64(4), atomic.LoadInt64(&ri.timedRetxs))
+	assert.Equal(t, []int{400}, ri.retxMs)
+	ri.lock.Unlock()
+
+	// the first message expires again at 600ms, a timeout interval after the last backoff
+	time.Sleep(120 * time.Millisecond)
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	assert.Equal(t, []int{400, 800}, ri.retxMs)
+}
@@ -1,7 +1,6 @@
 package westworld3
 
 import (
-	"github.com/openziti/dilithium/util"
 	"github.com/sirupsen/logrus"
 	"net"
 	"sync"
@@ -9,29 +8,49 @@ import (
 )
 
 type retxMonitor struct {
-	profile  *Profile
-	rttAvg   []uint16
-	retxMs   int
-	conn     *net.UDPConn
-	peer     *net.UDPAddr
-	waitlist waitlist
-	lock     *sync.Mutex
-	ready    *sync.Cond
-	closed   bool
-	retxF    func()
-	ii       InstrumentInstance
+	profile   *Profile
+	rttClock  *rttClock
+	rttAvg    []time.Duration
+	rtt       time.Duration // averaged (or smoothed) rtt probes, negative until measured
+	rto       *rfc6298Estimator
+	backedOff time.Time // headline of the batch which last backed off the rto
+	retxMs    int
+	retxScale float64 // adjusted by txPortal, starts at profile.RetxScale
+	path      *path
+	peer      net.Addr
+	sealer    *sealer
+	pmtud     *pmtud
+	pool      *pool
+	waitlist  waitlist
+	lock      *sync.Mutex
+	ready     *sync.Cond
+	wake      chan struct{} // interrupts run's wait when a deadline moves earlier
+	closed    bool
+	retxF     func()
+	ii        InstrumentInstance
 }
 
-func newRetxMonitor(profile *Profile, conn *net.UDPConn, peer *net.UDPAddr, lock *sync.Mutex, ii InstrumentInstance) *retxMonitor {
+func newRetxMonitor(profile *Profile, path *path, peer net.Addr, lock *sync.Mutex, ii InstrumentInstance) *retxMonitor {
+	wl, err := newWaitlist(profile.RetxWaitlist)
+	if err != nil {
+		logrus.Errorf("falling back to array waitlist (%v)", err)
+		wl = newArrayWaitlist()
+	}
 	rm := &retxMonitor{
-		profile:  profile,
-		retxMs:   profile.RetxStartMs,
-		conn:     conn,
-		peer:     peer,
-		waitlist: newArrayWaitlist(),
-		lock:     lock,
-		ready:    sync.NewCond(lock),
-		ii:       ii,
+		profile:   profile,
+		rtt:       -1,
+		retxMs:    profile.RetxStartMs,
+		retxScale: profile.RetxScale,
+		path:      path,
+		peer:      peer,
+		waitlist:  wl,
+		lock:      lock,
+		ready:     sync.NewCond(lock),
+		wake:      make(chan struct{}, 1),
+		ii:        ii,
+	}
+	if profile.RetxEstimator == "rfc6298" {
+		rm.rto = newRfc6298Estimator(profile)
 	}
 	return rm
 }
@@ -44,19 +63,51 @@ func (self *retxMonitor) start() {
 	go self.run()
 }
 
-func (self *retxMonitor) updateRttMs(rttMs uint16) {
-	self.rttAvg = append(self.rttAvg, rttMs)
+/*
+ * updateRtt incorporates an rtt sample. By default, the retransmission timeout is the average of the last RttProbeAvg
+ * samples scaled by retxScale, plus RetxAddMs. The "rfc6298" RetxEstimator accounts for rtt variance instead.
+ */
+func (self *retxMonitor) updateRtt(rtt time.Duration) {
+	if self.rto != nil {
+		self.rto.sample(rtt)
+		self.rtt = self.rto.srtt
+		self.ii.NewRttEstimate(self.peer, self.rto.srtt, self.rto.rttvar)
+		self.setRetxMs(self.rto.retxMs())
+		return
+	}
+
+	self.rttAvg = append(self.rttAvg, rtt)
 	if len(self.rttAvg) > self.profile.RttProbeAvg {
 		self.rttAvg = self.rttAvg[1:]
 	}
-	accum := 0
-	for _, rttMs := range self.rttAvg {
-		accum += int(rttMs)
+	var accum time.Duration
+	for _, rtt := range self.rttAvg {
+		accum += rtt
 	}
-	accum /= len(self.rttAvg)
-	self.retxMs = int(float64(accum)*self.profile.RetxScale) + self.profile.RetxAddMs
+	accum /= time.Duration(len(self.rttAvg))
+	self.rtt = accum
+	self.setRetxMs(int(float64(accum)*self.retxScale/float64(time.Millisecond)) + self.profile.RetxAddMs)
+}
+
+/*
+ * setRetxMs changes the retransmission timeout, moving the deadlines already in the waitlist. A shorter timeout can move
+ * the head of the waitlist earlier than run is waiting for, so run is woken to wait again.
+ */
+func (self *retxMonitor) setRetxMs(retxMs int) {
+	shorter := retxMs < self.retxMs
+	self.retxMs = retxMs
 	self.waitlist.Update(self.retxMs)
 	self.ii.NewRetxMs(self.peer, self.retxMs)
+	if shorter {
+		self.interrupt()
+	}
+}
+
+func (self *retxMonitor) interrupt() {
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
 }
 
 func (self *retxMonitor) add(wm *wireMessage) {
@@ -71,12 +122,17 @@ func (self *retxMonitor) remove(wm *wireMessage) {
 func (self *retxMonitor) close() {
 	self.closed = true
 	self.ready.Broadcast()
+	self.interrupt()
 }
 
 func (self *retxMonitor) run() {
 	logrus.Info("started")
 	defer logrus.Warn("exited")
 
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
 	for {
 		var headline time.Time
 		var timeout time.Duration
@@ -98,43 +154,80 @@ func (self *retxMonitor) run() {
 		}
 		self.lock.Unlock()
 
-		time.Sleep(timeout)
+		timer.Reset(timeout)
+		select {
+		case <-timer.C:
+		case <-self.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			continue
+		}
 
 		self.lock.Lock()
 		{
-			if self.waitlist.Size() > 0 {
-				i := 0
-				x := self.waitlist.Size()
-				for ; i < x; i++ {
-					_, t := self.waitlist.Peek()
-					delta := t.Sub(headline).Milliseconds()
-					if delta <= int64(self.profile.RetxBatchMs) {
-						wm, _ := self.waitlist.Next()
-						if wm.hasFlag(RTT) {
-							util.WriteUint16(wm.buffer.data[dataStart:], uint16(time.Now().UnixNano()/int64(time.Millisecond)))
-						}
-
-						if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
-							logrus.Errorf("retx (%v)", err)
-						} else {
-							self.ii.WireMessageRetx(self.peer, wm)
-						}
-						if self.retxF != nil {
-							self.retxF()
-						}
-
-						self.waitlist.Add(wm, self.retxMs, self.deadline())
-
-					} else {
-						break
-					}
+			var due []*wireMessage
+			for self.waitlist.Size() > 0 {
+				_, t := self.waitlist.Peek()
+				delta := t.Sub(headline).Milliseconds()
+				if delta > int64(self.profile.RetxBatchMs) {
+					break
 				}
+				wm, _ := self.waitlist.Next()
+				due = append(due, wm)
+			}
+			if len(due) > 0 && self.rto != nil && !headline.Before(self.backedOff.Add(self.rto.rto)) {
+				// a lost window expires as several batches; back off once per rto interval, not once per batch
+				self.rto.backoff()
+				self.setRetxMs(self.rto.retxMs())
+				self.backedOff = headline
+			}
+			if len(due) > 0 && self.pmtud != nil {
+				self.pmtud.timedRetx()
+			}
+			for _, wm := range due {
+				self.retransmit(wm)
+				self.ii.TimedRetx(self.peer, wm)
+				self.waitlist.Add(wm, self.retxMs, self.deadline())
 			}
 		}
 		self.lock.Unlock()
 	}
 }
 
+/*
+ * fastRetx immediately retransmits a message that the txPortal has inferred to be lost, and restarts its retransmission
+ * deadline. Must be called while holding the txPortal lock.
+ */
+func (self *retxMonitor) fastRetx(wm *wireMessage) {
+	self.waitlist.Remove(wm)
+	self.retransmit(wm)
+	self.ii.FastRetx(self.peer, wm)
+	self.waitlist.Add(wm, self.retxMs, self.deadline())
+}
+
+func (self *retxMonitor) retransmit(wm *wireMessage) {
+	if err := wm.stripInlineAcks(); err != nil {
+		logrus.Errorf("strip inline acks (%v)", err)
+	}
+	wm.restampRtt(self.rttClock, time.Now())
+
+	var err error
+	if self.pmtud != nil && int(wm.buffer.uz)-dataStart > self.pmtud.segmentSz {
+		err = writeFragmented(wm, self.pmtud.segmentSz, self.path, self.sealer, self.pool)
+	} else {
+		err = writeWireMessage(wm, self.path, self.sealer)
+	}
+	if err != nil {
+		logrus.Errorf("retx (%v)", err)
+	} else {
+		self.ii.WireMessageRetx(self.peer, wm)
+	}
+	if self.retxF != nil {
+		self.retxF()
+	}
+}
+
 func (self *retxMonitor) deadline() time.Time {
 	return time.Now().Add(time.Duration(self.retxMs) * time.Millisecond)
 }
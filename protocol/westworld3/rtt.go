@@ -0,0 +1,48 @@
+package westworld3
+
+import "time"
+
+/*
+ * rttProbe is a sender's timestamp carried by DATA, and echoed unchanged by the ACK responding to it. Narrow probes are
+ * 16-bit milliseconds; wide probes (RTT_US), negotiated in HELLO, are 32-bit microseconds.
+ */
+type rttProbe struct {
+	ts   uint32
+	wide bool
+}
+
+func (self rttProbe) sz() uint32 {
+	if self.wide {
+		return 4
+	}
+	return 2
+}
+
+/*
+ * rttClock stamps rtt probes against a monotonic clock started with the connection. Only the sender interprets its
+ * probes, so the peer's clock never matters. An rtt is the difference modulo the width of the probe, which stays
+ * correct across wraps for rtts shorter than the wrap period (~65 seconds for narrow probes, ~71 minutes for wide).
+ */
+type rttClock struct {
+	epoch time.Time
+}
+
+func newRttClock() *rttClock {
+	return &rttClock{epoch: time.Now()}
+}
+
+func (self *rttClock) probe(wide bool, now time.Time) *rttProbe {
+	elapsed := now.Sub(self.epoch)
+	if wide {
+		return &rttProbe{uint32(elapsed / time.Microsecond), true}
+	}
+	return &rttProbe{uint32(uint16(elapsed / time.Millisecond)), false}
+}
+
+func (self *rttClock) rtt(probe rttProbe, now time.Time) time.Duration {
+	elapsed := now.Sub(self.epoch)
+	if probe.wide {
+		return time.Duration(uint32(elapsed/time.Microsecond)-probe.ts) * time.Microsecond
+	}
+	return time.Duration(uint16(elapsed/time.Millisecond)-uint16(probe.ts)) * time.Millisecond
+}
@@ -0,0 +1,85 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRttClock(t *testing.T) {
+	epoch := time.Now()
+	clock := &rttClock{epoch: epoch}
+
+	sent := epoch.Add(1500 * time.Microsecond)
+	assert.Equal(t, 250*time.Microsecond, clock.rtt(*clock.probe(true, sent), sent.Add(250*time.Microsecond)))
+	assert.Equal(t, time.Duration(0), clock.rtt(*clock.probe(false, sent), sent.Add(250*time.Microsecond)))
+	assert.Equal(t, 3*time.Millisecond, clock.rtt(*clock.probe(false, sent), sent.Add(3*time.Millisecond)))
+}
+
+func TestRttClockWrap(t *testing.T) {
+	clock := &rttClock{epoch: time.Now()}
+
+	// narrow probes wrap every 65.536 seconds
+	sent := clock.epoch.Add(65535 * time.Millisecond)
+	probe := clock.probe(false, sent)
+	assert.Equal(t, uint32(65535), probe.ts)
+	assert.Equal(t, 20*time.Millisecond, clock.rtt(*probe, sent.Add(20*time.Millisecond)))
+
+	// wide probes wrap every ~71.6 minutes
+	sent = clock.epoch.Add((1<<32 - 100) * time.Microsecond)
+	probe = clock.probe(true, sent)
+	assert.Equal(t, uint32(1<<32-100), probe.ts)
+	assert.Equal(t, 600*time.Microsecond, clock.rtt(*probe, sent.Add(600*time.Microsecond)))
+	assert.Equal(t, 600*time.Second, clock.rtt(*probe, sent.Add(600*time.Second)))
+}
+
+func TestRttProbeWide(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	GetProfile(profileId).RttProbeMs = 0
+	GetProfile(profileId).RttProbeWide = true
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	dTxp := conn.(*dialerConn).txPortal
+	lTxp := lConn.(*listenerConn).txPortal
+	dTxp.lock.Lock()
+	assert.True(t, dTxp.rttWide)
+	dTxp.lock.Unlock()
+	lTxp.lock.Lock()
+	assert.True(t, lTxp.rttWide)
+	lTxp.lock.Unlock()
+
+	for i := 0; i < 10; i++ {
+		_, err := conn.Write([]byte("probe"))
+		assert.NoError(t, err)
+		buf := make([]byte, 64)
+		_, err = lConn.Read(buf)
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+
+	dTxp.lock.Lock()
+	defer dTxp.lock.Unlock()
+	assert.True(t, len(dTxp.monitor.rttAvg) > 0)
+	for _, rtt := range dTxp.monitor.rttAvg {
+		assert.True(t, rtt > 0 && rtt < time.Second, "rtt %v", rtt)
+	}
+}
+
+func TestRttProbeNarrowByDefault(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	dTxp := conn.(*dialerConn).txPortal
+	lTxp := lConn.(*listenerConn).txPortal
+	dTxp.lock.Lock()
+	assert.False(t, dTxp.rttWide)
+	dTxp.lock.Unlock()
+	lTxp.lock.Lock()
+	assert.False(t, lTxp.rttWide)
+	lTxp.lock.Unlock()
+}
@@ -3,34 +3,48 @@ package westworld3
 import (
 	"bytes"
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
-	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
 type rxPortal struct {
-	tree       *btree.Tree
-	accepted   int32
-	rxs        chan *wireMessage
-	reads      chan *rxRead
-	readBuffer *bytes.Buffer
-	rxPortalSz int
-	readPool   *sync.Pool
-	ackPool    *pool
-	conn       *net.UDPConn
-	peer       *net.UDPAddr
-	txPortal   *txPortal
-	seq        *util.Sequence
-	closer     *closer
-	profile    *Profile
-	closed     bool
-	ii         InstrumentInstance
+	tree              *btree.Tree
+	accepted          int32
+	rxs               chan *wireMessage
+	reads             chan *rxRead
+	readBuffer        *bytes.Buffer
+	eof               bool
+	done              chan struct{}
+	readClosed        chan struct{}
+	datagrams         chan *wireMessage
+	closeReadOnce     sync.Once
+	readDeadline      time.Time
+	deadlineLock      *sync.Mutex
+	deadlineChanged   chan struct{}
+	datagramDeadline  chan struct{} // deadlineChanged, for receiveDatagram
+	rxPortalSz        int
+	pendingAcks       []ack
+	pendingAckCt      int
+	pendingRxPortalSz int32
+	ackTimer          *time.Timer
+	ackLock           *sync.Mutex
+	readPool          *sync.Pool
+	ackPool           *pool
+	path              *path
+	peer              net.Addr
+	sealer            *sealer
+	txPortal          *txPortal
+	seq               *util.Sequence
+	closer            *closer
+	profile           *Profile
+	closed            bool
+	ii                InstrumentInstance
 }
 
 type rxRead struct {
@@ -39,22 +53,29 @@ type rxRead struct {
 	eof bool
 }
 
-func newRxPortal(conn *net.UDPConn, peer *net.UDPAddr, txPortal *txPortal, seq *util.Sequence, closer *closer, profile *Profile, ii InstrumentInstance) *rxPortal {
+func newRxPortal(path *path, peer net.Addr, txPortal *txPortal, seq *util.Sequence, closer *closer, profile *Profile, ii InstrumentInstance) *rxPortal {
 	rx := &rxPortal{
-		tree:       btree.NewWith(profile.RxPortalTreeLen, utils.Int32Comparator),
-		accepted:   -1,
-		rxs:        make(chan *wireMessage),
-		reads:      make(chan *rxRead, profile.ReadsQueueLen),
-		readBuffer: new(bytes.Buffer),
-		readPool:   new(sync.Pool),
-		ackPool:    newPool("ackPool", uint32(profile.PoolBufferSz), ii),
-		conn:       conn,
-		peer:       peer,
-		txPortal:   txPortal,
-		seq:        seq,
-		closer:     closer,
-		profile:    profile,
-		ii:         ii,
+		tree:             btree.NewWith(profile.RxPortalTreeLen, seqComparator),
+		accepted:         -1,
+		rxs:              make(chan *wireMessage),
+		reads:            make(chan *rxRead, profile.ReadsQueueLen),
+		readBuffer:       new(bytes.Buffer),
+		done:             make(chan struct{}),
+		readClosed:       make(chan struct{}),
+		datagrams:        make(chan *wireMessage, profile.DatagramQueueLen),
+		deadlineLock:     new(sync.Mutex),
+		ackLock:          new(sync.Mutex),
+		deadlineChanged:  make(chan struct{}, 1),
+		datagramDeadline: make(chan struct{}, 1),
+		readPool:         new(sync.Pool),
+		ackPool:          newPool("ackPool", uint32(profile.PoolBufferSz), ii),
+		path:             path,
+		peer:             peer,
+		txPortal:         txPortal,
+		seq:              seq,
+		closer:           closer,
+		profile:          profile,
+		ii:               ii,
 	}
 	rx.readPool.New = func() interface{} {
 		return make([]byte, profile.PoolBufferSz)
@@ -64,23 +85,18 @@ func newRxPortal(conn *net.UDPConn, peer *net.UDPAddr, txPortal *txPortal, seq *
 }
 
 func (self *rxPortal) read(p []byte) (int, error) {
+	select {
+	case <-self.readClosed:
+		return 0, io.EOF
+	default:
+	}
+
 preread:
-	for {
+	for !self.eof {
 		select {
-		case read, ok := <-self.reads:
-			if !ok {
-				return 0, io.EOF
-			}
-			if !read.eof {
-				n, err := self.readBuffer.Write(read.buf[:read.sz])
-				if err != nil {
-					return 0, errors.Wrap(err, "buffer")
-				}
-				if n != read.sz {
-
-				}
-			} else {
-				return 0, io.EOF
+		case read := <-self.reads:
+			if err := self.buffer(read); err != nil {
+				return 0, err
 			}
 
 		default:
@@ -89,50 +105,200 @@ preread:
 	}
 	if self.readBuffer.Len() > 0 {
 		return self.readBuffer.Read(p)
-	} else {
-		read, ok := <-self.reads
-		if !ok {
-			return 0, io.EOF
+	}
+	if self.eof {
+		return 0, io.EOF
+	}
+
+	read, err := self.nextRead()
+	if err != nil {
+		return 0, err
+	}
+	if err := self.buffer(read); err != nil {
+		return 0, err
+	}
+	if self.readBuffer.Len() > 0 {
+		return self.readBuffer.Read(p)
+	}
+	return 0, io.EOF
+}
+
+func (self *rxPortal) buffer(read *rxRead) error {
+	if read.eof {
+		logrus.Infof("close notified")
+		self.eof = true
+		return nil
+	}
+	n, err := self.readBuffer.Write(read.buf[:read.sz])
+	if err != nil {
+		return errors.Wrap(err, "buffer")
+	}
+	if n != read.sz {
+		return errors.Errorf("short buffer [%d != %d]", n, read.sz)
+	}
+	self.readPool.Put(read.buf)
+	return nil
+}
+
+func (self *rxPortal) nextRead() (*rxRead, error) {
+	for {
+		self.deadlineLock.Lock()
+		deadline := self.readDeadline
+		self.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			until := time.Until(deadline)
+			if until <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(until)
+			timeout = timer.C
 		}
-		if !read.eof {
-			n, err := self.readBuffer.Write(read.buf[:read.sz])
-			if err != nil {
-				return 0, errors.Wrap(err, "buffer")
+
+		select {
+		case read := <-self.reads:
+			if timer != nil {
+				timer.Stop()
+			}
+			return read, nil
+
+		case <-self.done:
+			if timer != nil {
+				timer.Stop()
 			}
-			if n != read.sz {
-				return 0, errors.Wrap(err, "short buffer")
+			select {
+			case read := <-self.reads:
+				return read, nil
+			default:
+				return nil, io.EOF
 			}
-			self.readPool.Put(read.buf)
 
-			return self.readBuffer.Read(p)
+		case <-self.readClosed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, io.EOF
+
+		case <-timeout:
+			return nil, os.ErrDeadlineExceeded
 
-		} else {
-			logrus.Infof("close notified")
-			close(self.reads)
-			return 0, io.EOF
+		case <-self.deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
 		}
 	}
 }
 
-func (self *rxPortal) rx(wm *wireMessage) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.Wrap(err, "send on closed rxs")
+/*
+ * receiveDatagram returns the next datagram received from the peer, waiting until the read deadline. Datagrams are
+ * delivered in arrival order, and are dropped when DatagramQueueLen datagrams are waiting.
+ */
+func (self *rxPortal) receiveDatagram() ([]byte, error) {
+	for {
+		self.deadlineLock.Lock()
+		deadline := self.readDeadline
+		self.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			until := time.Until(deadline)
+			if until <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(until)
+			timeout = timer.C
 		}
-	}()
-	self.rxs <- wm
-	return err
+
+		select {
+		case wm := <-self.datagrams:
+			if timer != nil {
+				timer.Stop()
+			}
+			return self.datagram(wm)
+
+		case <-self.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			select {
+			case wm := <-self.datagrams:
+				return self.datagram(wm)
+			default:
+				return nil, io.EOF
+			}
+
+		case <-timeout:
+			return nil, os.ErrDeadlineExceeded
+
+		case <-self.datagramDeadline:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (self *rxPortal) datagram(wm *wireMessage) ([]byte, error) {
+	defer wm.buffer.unref()
+	data, err := wm.asDatagram()
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, len(data))
+	copy(p, data)
+	return p, nil
+}
+
+func (self *rxPortal) setReadDeadline(t time.Time) {
+	self.deadlineLock.Lock()
+	self.readDeadline = t
+	self.deadlineLock.Unlock()
+	select {
+	case self.deadlineChanged <- struct{}{}:
+	default:
+	}
+	select {
+	case self.datagramDeadline <- struct{}{}:
+	default:
+	}
+}
+
+func (self *rxPortal) rx(wm *wireMessage) error {
+	select {
+	case self.rxs <- wm:
+		return nil
+	case <-self.done:
+		return errors.New("rx portal closed")
+	}
 }
 
 func (self *rxPortal) setAccepted(accepted int32) {
 	self.accepted = accepted
 }
 
+/*
+ * closeRead ends the incoming stream locally. Reads return io.EOF, and data arriving from the peer is acknowledged and
+ * discarded, so the peer's writes continue to flow.
+ */
+func (self *rxPortal) closeRead() {
+	self.closeReadOnce.Do(func() {
+		close(self.readClosed)
+	})
+}
+
 func (self *rxPortal) close() {
 	if !self.closed {
-		self.reads <- &rxRead{nil, 0, true}
 		self.closed = true
-		close(self.rxs)
+		select {
+		case self.reads <- &rxRead{nil, 0, true}:
+		default:
+			// reads queue is full, readers will observe done once it drains
+		}
+		close(self.done)
 	}
 }
 
@@ -147,13 +313,25 @@ func (self *rxPortal) run() {
 	}()
 
 	for {
+		var ackTimeout <-chan time.Time
+		self.ackLock.Lock()
+		if self.ackTimer != nil {
+			ackTimeout = self.ackTimer.C
+		}
+		self.ackLock.Unlock()
+
 		var wm *wireMessage
-		var ok bool
 		select {
-		case wm, ok = <-self.rxs:
-			if !ok {
-				return
-			}
+		case wm = <-self.rxs:
+
+		case <-ackTimeout:
+			self.ackLock.Lock()
+			self.flushAcks(nil)
+			self.ackLock.Unlock()
+			continue
+
+		case <-self.done:
+			return
 
 		case <-time.After(time.Duration(self.profile.ConnectionInactiveTimeoutMs) * time.Millisecond):
 			self.closer.timeout()
@@ -163,11 +341,13 @@ func (self *rxPortal) run() {
 		switch wm.messageType() {
 		case DATA:
 			_, found := self.tree.Get(wm.seq)
-			if !found && (wm.seq > self.accepted || (wm.seq == 0 && self.accepted == math.MaxInt32)) {
+			duplicate := true
+			if !found && seqLess(self.accepted, wm.seq) {
 				if sz, err := wm.asDataSize(); err == nil {
 					self.tree.Put(wm.seq, wm)
 					self.rxPortalSz += int(sz)
 					self.ii.RxPortalSzChanged(self.peer, self.rxPortalSz)
+					duplicate = false
 				} else {
 					logrus.Errorf("unexpected mt [%d] (%v)", wm.messageType(), err)
 				}
@@ -175,23 +355,31 @@ func (self *rxPortal) run() {
 				self.ii.DuplicateRx(self.peer, wm)
 			}
 
-			var rtt *uint16
+			var rtt *rttProbe
 			if wm.hasFlag(RTT) {
-				if _, rttIn, err := wm.asData(); err == nil {
+				if _, rttIn, _, _, err := wm.asData(); err == nil {
 					rtt = rttIn
 				} else {
 					logrus.Errorf("unexpected mt [%d] (%v)", wm.messageType(), err)
 				}
 			}
 
-			if ack, err := newAck([]ack{{wm.seq, wm.seq}}, int32(self.rxPortalSz), rtt, self.ackPool); err == nil {
-				if err := writeWireMessage(ack, self.conn, self.peer); err != nil {
-					logrus.Errorf("error sending ack (%v)", err)
-				}
-				self.ii.WireMessageTx(self.peer, ack)
-				self.ii.TxAck(self.peer, ack)
-				ack.buffer.unref()
+			/*
+			 * Flush immediately when carrying an rtt probe (to keep the probe accurate), when a duplicate arrives, when
+			 * data arrives out of order, or when the coalescing threshold is reached. Otherwise, wait for AckDelayMs, or
+			 * for the txPortal to carry the pending acks inline with outgoing data.
+			 */
+			self.ackLock.Lock()
+			self.pendingAcks = appendAck(self.pendingAcks, wm.seq)
+			self.pendingAckCt++
+			self.pendingRxPortalSz = int32(self.rxPortalSz)
+			outOfOrder := wm.seq != seqNext(self.accepted)
+			if rtt != nil || duplicate || outOfOrder || self.tree.Size() > 1 || self.pendingAckCt >= self.profile.AckCoalesceThresh || len(self.pendingAcks) >= maxAckSeries {
+				self.flushAcks(rtt)
+			} else if self.ackTimer == nil {
+				self.ackTimer = time.NewTimer(time.Duration(self.profile.AckDelayMs) * time.Millisecond)
 			}
+			self.ackLock.Unlock()
 
 			if found {
 				wm.buffer.unref()
@@ -200,33 +388,38 @@ func (self *rxPortal) run() {
 			if self.tree.Size() > 0 {
 				startingRxPortalSz := self.rxPortalSz
 
-				var next int32
-				if self.accepted < math.MaxInt32 {
-					next = self.accepted + 1
-				} else {
-					next = 0
-				}
+				next := seqNext(self.accepted)
 
 				keys := self.tree.Keys()
 				for _, key := range keys {
 					if key.(int32) == next {
 						v, _ := self.tree.Get(key)
 						wm := v.(*wireMessage)
-						buf := self.readPool.Get().([]byte)
-						if data, _, err := wm.asData(); err == nil {
-							n := copy(buf, data)
-							self.reads <- &rxRead{buf, n, false}
+						if data, _, _, _, err := wm.asData(); err == nil {
+							read := &rxRead{nil, 0, true}
+							if !wm.hasFlag(FIN) {
+								buf := self.readPool.Get().([]byte)
+								n := copy(buf, data)
+								read = &rxRead{buf, n, false}
+							} else {
+								logrus.Infof("end of stream from peer")
+							}
+							select {
+							case self.reads <- read:
+							case <-self.readClosed:
+								if read.buf != nil {
+									self.readPool.Put(read.buf)
+								}
+							case <-self.done:
+								return
+							}
 
 							self.tree.Remove(key)
 							self.rxPortalSz -= len(data)
 							self.ii.RxPortalSzChanged(self.peer, self.rxPortalSz)
 							wm.buffer.unref()
 							self.accepted = next
-							if next < math.MaxInt32 {
-								next++
-							} else {
-								next = 0
-							}
+							next = seqNext(next)
 						} else {
 							logrus.Errorf("unexpected mt [%d]", wm.mt)
 						}
@@ -238,7 +431,7 @@ func (self *rxPortal) run() {
 				 */
 				if startingRxPortalSz > self.profile.TxPortalMinSz && float64(self.rxPortalSz)/float64(startingRxPortalSz) < self.profile.RxPortalSzPacingThresh {
 					if keepalive, err := newKeepalive(self.rxPortalSz, self.ackPool); err == nil {
-						if err := writeWireMessage(keepalive, self.conn, self.peer); err != nil {
+						if err := writeWireMessage(keepalive, self.path, self.sealer); err != nil {
 							logrus.Errorf("error sending pacing keepalive (%v)", err)
 						}
 						self.ii.WireMessageTx(self.peer, keepalive)
@@ -251,10 +444,21 @@ func (self *rxPortal) run() {
 		case KEEPALIVE:
 			//
 
+		case DATAGRAM:
+			select {
+			case self.datagrams <- wm:
+			default:
+				logrus.Warnf("datagram queue full, dropping")
+				wm.buffer.unref()
+			}
+
 		case CLOSE:
+			self.ackLock.Lock()
+			self.flushAcks(nil)
+			self.ackLock.Unlock()
 			closeAck, err := newAck([]ack{{wm.seq, wm.seq}}, int32(self.rxPortalSz), nil, self.ackPool)
 			if err == nil {
-				if err := writeWireMessage(closeAck, self.conn, self.peer); err != nil {
+				if err := writeWireMessage(closeAck, self.path, self.sealer); err != nil {
 					logrus.Errorf("error writing close ack (%v)", err)
 				}
 				self.ii.WireMessageTx(self.peer, closeAck)
@@ -271,3 +475,55 @@ func (self *rxPortal) run() {
 		}
 	}
 }
+
+/*
+ * takeAcks removes up to max pending acks, so that the txPortal can carry them inline with outgoing data.
+ */
+func (self *rxPortal) takeAcks(max int) ([]ack, int32) {
+	self.ackLock.Lock()
+	defer self.ackLock.Unlock()
+
+	if len(self.pendingAcks) < 1 || max < 1 {
+		return nil, 0
+	}
+	n := len(self.pendingAcks)
+	if n > max {
+		n = max
+	}
+	acks := make([]ack, n)
+	copy(acks, self.pendingAcks)
+	self.pendingAcks = append(self.pendingAcks[:0], self.pendingAcks[n:]...)
+	if len(self.pendingAcks) < 1 {
+		self.pendingAckCt = 0
+		if self.ackTimer != nil {
+			self.ackTimer.Stop()
+			self.ackTimer = nil
+		}
+	}
+	return acks, self.pendingRxPortalSz
+}
+
+/*
+ * flushAcks sends any pending acks in a standalone ACK. Must be called while holding ackLock.
+ */
+func (self *rxPortal) flushAcks(rtt *rttProbe) {
+	if self.ackTimer != nil {
+		self.ackTimer.Stop()
+		self.ackTimer = nil
+	}
+	if len(self.pendingAcks) < 1 {
+		return
+	}
+	if ack, err := newAck(self.pendingAcks, self.pendingRxPortalSz, rtt, self.ackPool); err == nil {
+		if err := writeWireMessage(ack, self.path, self.sealer); err != nil {
+			logrus.Errorf("error sending ack (%v)", err)
+		}
+		self.ii.WireMessageTx(self.peer, ack)
+		self.ii.TxAck(self.peer, ack)
+		ack.buffer.unref()
+	} else {
+		logrus.Errorf("error creating ack (%v)", err)
+	}
+	self.pendingAcks = self.pendingAcks[:0]
+	self.pendingAckCt = 0
+}
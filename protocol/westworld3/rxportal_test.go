@@ -0,0 +1,82 @@
+package westworld3
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCoalescedAcks(t *testing.T) {
+	profileId := registerTestProfile(t)
+	ci := &recordingInstrument{}
+	p := GetProfile(profileId)
+	p.AckCoalesceThresh = 16
+	p.AckDelayMs = 5
+	p.RetxAddMs = 50 // loopback rtt alone would retransmit everything behind the delayed acks
+	p.i = ci
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	data := make([]byte, 4*1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		_, err := conn.Write(data)
+		assert.NoError(t, err)
+	}()
+	out := make([]byte, len(data))
+	_, err := io.ReadFull(lConn, out)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	dataMsgs := len(data) / p.MaxSegmentSz
+	txAcks := int(atomic.LoadInt64(&ci.txAcks))
+	assert.True(t, txAcks < dataMsgs/2, "%d acks for %d data messages", txAcks, dataMsgs)
+}
+
+/*
+ * TestInlineAcks checks that, with the baseline ack coalescing parameters, request/response traffic carries its acks
+ * inline on reverse DATA rather than in standalone ACKs.
+ */
+func TestInlineAcks(t *testing.T) {
+	profileId := registerTestProfile(t)
+	ci := &recordingInstrument{}
+	p := GetProfile(profileId)
+	p.RttProbeMs = 60000 // probes are acknowledged immediately
+	p.RetxAddMs = 50
+	p.i = ci
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	rounds := 100
+	go func() {
+		buf := make([]byte, 1024)
+		for i := 0; i < rounds; i++ {
+			if _, err := io.ReadFull(lConn, buf); err != nil {
+				return
+			}
+			if _, err := lConn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	req := make([]byte, 1024)
+	resp := make([]byte, 1024)
+	for i := 0; i < rounds; i++ {
+		req[0] = byte(i)
+		_, err := conn.Write(req)
+		assert.NoError(t, err)
+		_, err = io.ReadFull(conn, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, req, resp)
+	}
+
+	txAcks := int(atomic.LoadInt64(&ci.txAcks))
+	assert.True(t, txAcks < rounds/2, "%d acks for %d round trips", txAcks, rounds)
+}
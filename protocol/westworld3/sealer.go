@@ -0,0 +1,376 @@
+package westworld3
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+type cipherSuite uint8
+
+const (
+	cipherNone cipherSuite = iota
+	cipherChaCha20Poly1305
+	cipherAesGcm
+)
+
+func cipherSuiteFor(name string) (cipherSuite, error) {
+	switch name {
+	case "", "none":
+		return cipherNone, nil
+	case "chacha20poly1305":
+		return cipherChaCha20Poly1305, nil
+	case "aes-gcm":
+		return cipherAesGcm, nil
+	default:
+		return cipherNone, errors.Errorf("unknown cipher suite '%s'", name)
+	}
+}
+
+func (self cipherSuite) String() string {
+	switch self {
+	case cipherNone:
+		return "none"
+	case cipherChaCha20Poly1305:
+		return "chacha20poly1305"
+	case cipherAesGcm:
+		return "aes-gcm"
+	default:
+		return "unknown"
+	}
+}
+
+func (self cipherSuite) newAead(key []byte) (cipher.AEAD, error) {
+	switch self {
+	case cipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case cipherAesGcm:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, errors.Errorf("no aead for cipher suite [%d]", self)
+	}
+}
+
+const (
+	// sealKeySz is the size of the traffic keys for both suites (ChaCha20-Poly1305 and AES-256-GCM)
+	sealKeySz = 32
+	// sealPrefixSz is the cleartext key epoch and packet number preceding each sealed message
+	sealPrefixSz = 9
+	// sealOverhead is the growth of a sealed message on the wire; both suites use a 16 byte tag
+	sealOverhead = sealPrefixSz + 16
+	// sealMaxEpochSkip is the furthest ahead of its current key epoch a receiver will ratchet to open a message
+	sealMaxEpochSkip = 4
+)
+
+/*
+ * sealer protects every wire message of a connection after hello with an AEAD. Traffic keys come from an X25519
+ * exchange of ephemeral keys carried in the HELLOs (mixed with the profile's pre-shared key, when configured), with one
+ * key for each direction.
+ *
+ * Each sealed message is prefixed by the sender's key epoch and a 64-bit packet number, which is also the nonce. Packet
+ * numbers are never reused, so retransmissions are resealed as new packets, and the receiver rejects any packet number
+ * it has already opened, or that has fallen behind its replay window.
+ *
+ * The sender ratchets its traffic key forward after EncryptionRekeyMs or EncryptionRekeyMessages, and the receiver
+ * follows when it opens a message in the next epoch. Keys from older epochs are discarded, except for the previous one,
+ * kept for messages reordered across a rekey.
+ */
+type sealer struct {
+	suite   cipherSuite
+	profile *Profile
+	private []byte
+	public  []byte
+	pool    *pool
+
+	txLock       *sync.Mutex
+	txKey        []byte
+	txAead       cipher.AEAD
+	txEpoch      uint8
+	txEpochStart time.Time
+	txEpochMsgs  int
+	txPn         uint64
+
+	rxLock   *sync.Mutex
+	rxKey    []byte
+	rxAead   cipher.AEAD
+	rxPrev   cipher.AEAD
+	rxAhead  []sealerKey
+	rxEpoch  uint8
+	rxReplay *replayWindow
+	now      func() time.Time
+}
+
+type sealerKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+/*
+ * newSealer returns nil when the profile does not enable encryption.
+ */
+func newSealer(id string, profile *Profile, ii InstrumentInstance) (*sealer, error) {
+	suite, err := cipherSuiteFor(profile.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if suite == cipherNone {
+		return nil, nil
+	}
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, errors.Wrap(err, "generate private key")
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "public key")
+	}
+	return &sealer{
+		suite:    suite,
+		profile:  profile,
+		private:  private,
+		public:   public,
+		pool:     newPool(id+"_sealer", uint32(dataStart+profile.MaxSegmentSz+sealOverhead), ii),
+		txLock:   new(sync.Mutex),
+		txPn:     1,
+		rxLock:   new(sync.Mutex),
+		rxReplay: newReplayWindow(profile.EncryptionReplayWindow),
+		now:      time.Now,
+	}, nil
+}
+
+func (self *sealer) keyExchange() keyExchange {
+	return keyExchange{self.suite, self.public}
+}
+
+/*
+ * establish derives the traffic keys from the peer's public key. Nothing can be sealed or opened before it completes.
+ */
+func (self *sealer) establish(kx *keyExchange, dialer bool) error {
+	if kx == nil || kx.suite != self.suite {
+		return errors.Errorf("peer did not agree cipher suite [%s]", self.suite)
+	}
+	shared, err := curve25519.X25519(self.private, kx.publicKey)
+	if err != nil {
+		return errors.Wrap(err, "key agreement")
+	}
+
+	info := []byte("westworld3 traffic keys")
+	if dialer {
+		info = append(append(info, self.public...), kx.publicKey...)
+	} else {
+		info = append(append(info, kx.publicKey...), self.public...)
+	}
+	keys := make([]byte, 2*sealKeySz)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, self.profile.psk, info), keys); err != nil {
+		return errors.Wrap(err, "derive keys")
+	}
+	txKey, rxKey := keys[:sealKeySz], keys[sealKeySz:]
+	if !dialer {
+		txKey, rxKey = rxKey, txKey
+	}
+	txAead, err := self.suite.newAead(txKey)
+	if err != nil {
+		return errors.Wrap(err, "tx aead")
+	}
+	rxAead, err := self.suite.newAead(rxKey)
+	if err != nil {
+		return errors.Wrap(err, "rx aead")
+	}
+
+	self.txLock.Lock()
+	self.txKey = txKey
+	self.txAead = txAead
+	self.txEpochStart = self.now()
+	self.txLock.Unlock()
+
+	self.rxLock.Lock()
+	self.rxKey = rxKey
+	self.rxAead = rxAead
+	self.rxLock.Unlock()
+
+	for i := range self.private {
+		self.private[i] = 0
+	}
+
+	return nil
+}
+
+/*
+ * seal appends the sealed form of the wire message in data to dst.
+ */
+func (self *sealer) seal(dst, data []byte) ([]byte, error) {
+	self.txLock.Lock()
+	defer self.txLock.Unlock()
+
+	if self.txAead == nil {
+		return nil, errors.New("keys not established")
+	}
+
+	if self.txEpochMsgs >= self.profile.EncryptionRekeyMessages ||
+		self.now().Sub(self.txEpochStart) >= time.Duration(self.profile.EncryptionRekeyMs)*time.Millisecond {
+		next, err := self.ratchet(self.txKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "rekey")
+		}
+		self.txKey = next.key
+		self.txAead = next.aead
+		self.txEpoch++
+		self.txEpochStart = self.now()
+		self.txEpochMsgs = 0
+	}
+
+	pn := self.txPn
+	self.txPn++
+	self.txEpochMsgs++
+
+	dst = append(dst, make([]byte, sealPrefixSz)...)
+	prefix := dst[len(dst)-sealPrefixSz:]
+	prefix[0] = self.txEpoch
+	binary.BigEndian.PutUint64(prefix[1:], pn)
+	return self.txAead.Seal(dst, sealNonce(pn), data, prefix), nil
+}
+
+/*
+ * open authenticates and decrypts a received message in place, leaving the wire message at the start of the buffer.
+ */
+func (self *sealer) open(buffer *buffer) error {
+	if buffer.uz < sealOverhead {
+		return errors.Errorf("short sealed message [%d < %d]", buffer.uz, sealOverhead)
+	}
+	data := buffer.data[:buffer.uz]
+	epoch := data[0]
+	pn := binary.BigEndian.Uint64(data[1:sealPrefixSz])
+
+	self.rxLock.Lock()
+	defer self.rxLock.Unlock()
+
+	if self.rxAead == nil {
+		return errors.New("keys not established")
+	}
+	if !self.rxReplay.check(pn) {
+		return errors.Errorf("replayed or stale packet number [%d]", pn)
+	}
+
+	var aead cipher.AEAD
+	skip := int(epoch - self.rxEpoch)
+	switch {
+	case skip == 0:
+		aead = self.rxAead
+	case skip == 0xff && self.rxPrev != nil:
+		aead = self.rxPrev
+	case skip > 0 && skip <= sealMaxEpochSkip:
+		for len(self.rxAhead) < skip {
+			key := self.rxKey
+			if len(self.rxAhead) > 0 {
+				key = self.rxAhead[len(self.rxAhead)-1].key
+			}
+			next, err := self.ratchet(key)
+			if err != nil {
+				return errors.Wrap(err, "rekey")
+			}
+			self.rxAhead = append(self.rxAhead, next)
+		}
+		aead = self.rxAhead[skip-1].aead
+	default:
+		return errors.Errorf("unexpected key epoch [%d], current [%d]", epoch, self.rxEpoch)
+	}
+
+	out, err := aead.Open(data[sealPrefixSz:sealPrefixSz], sealNonce(pn), data[sealPrefixSz:], data[:sealPrefixSz])
+	if err != nil {
+		return errors.Wrap(err, "authentication failed")
+	}
+
+	if skip > 0 && skip <= sealMaxEpochSkip {
+		if skip == 1 {
+			self.rxPrev = self.rxAead
+		} else {
+			self.rxPrev = self.rxAhead[skip-2].aead
+		}
+		self.rxKey = self.rxAhead[skip-1].key
+		self.rxAead = aead
+		self.rxAhead = self.rxAhead[skip:]
+		self.rxEpoch = epoch
+	}
+	self.rxReplay.accept(pn)
+
+	copy(buffer.data, out)
+	buffer.uz = uint32(len(out))
+	return nil
+}
+
+func (self *sealer) ratchet(key []byte) (sealerKey, error) {
+	next := make([]byte, sealKeySz)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("westworld3 rekey")), next); err != nil {
+		return sealerKey{}, err
+	}
+	aead, err := self.suite.newAead(next)
+	if err != nil {
+		return sealerKey{}, err
+	}
+	return sealerKey{next, aead}, nil
+}
+
+func sealNonce(pn uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], pn)
+	return nonce
+}
+
+/*
+ * replayWindow tracks the packet numbers opened within a sliding window behind the highest one seen, as a ring of
+ * 64-bit words (after RFC 6479). Packet number 0 is never valid.
+ */
+type replayWindow struct {
+	top  uint64
+	bits []uint64
+}
+
+func newReplayWindow(sz int) *replayWindow {
+	// one extra word, as the word holding top is only partly behind it
+	return &replayWindow{bits: make([]uint64, (sz+63)/64+1)}
+}
+
+func (self *replayWindow) check(pn uint64) bool {
+	if pn == 0 {
+		return false
+	}
+	if pn > self.top {
+		return true
+	}
+	words := uint64(len(self.bits))
+	if pn/64+words <= self.top/64 {
+		return false
+	}
+	return self.bits[(pn/64)%words]&(1<<(pn%64)) == 0
+}
+
+func (self *replayWindow) accept(pn uint64) {
+	words := uint64(len(self.bits))
+	if pn > self.top {
+		from := self.top/64 + 1
+		to := pn / 64
+		if to >= from {
+			if to-from >= words {
+				from = to - words + 1
+			}
+			for w := from; w <= to; w++ {
+				self.bits[w%words] = 0
+			}
+		}
+		self.top = pn
+	}
+	self.bits[(pn/64)%words] |= 1 << (pn % 64)
+}
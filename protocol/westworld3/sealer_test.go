@@ -0,0 +1,386 @@
+package westworld3
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSealerSuites(t *testing.T) {
+	for _, suite := range []string{"chacha20poly1305", "aes-gcm"} {
+		t.Run(suite, func(t *testing.T) {
+			dialer, listener := newTestSealerPair(t, suite)
+
+			wm, err := newData(11, nil, nil, 0, []byte("sealed"), dialer.pool)
+			assert.NoError(t, err)
+			sealed := sealTestMessage(t, dialer, wm)
+			assert.Equal(t, int(wm.buffer.uz)+sealOverhead, len(sealed))
+			assert.NotContains(t, string(sealed), "sealed")
+
+			buffer := listener.pool.get()
+			buffer.uz = uint32(copy(buffer.data, sealed))
+			assert.NoError(t, listener.open(buffer))
+			wmOut, err := decodeHeader(buffer)
+			assert.NoError(t, err)
+			data, _, _, _, err := wmOut.asData()
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("sealed"), data)
+
+			// each direction has its own key
+			buffer.uz = uint32(copy(buffer.data, sealed))
+			assert.Error(t, dialer.open(buffer))
+		})
+	}
+}
+
+func TestSealerForgery(t *testing.T) {
+	dialer, listener := newTestSealerPair(t, "chacha20poly1305")
+
+	wm, err := newKeepalive(1024, dialer.pool)
+	assert.NoError(t, err)
+	sealed := sealTestMessage(t, dialer, wm)
+
+	// tampered prefix, body or tag
+	for _, i := range []int{1, sealPrefixSz + 1, len(sealed) - 1} {
+		forged := append([]byte{}, sealed...)
+		forged[i] ^= 0x1
+		buffer := listener.pool.get()
+		buffer.uz = uint32(copy(buffer.data, forged))
+		assert.Error(t, listener.open(buffer))
+	}
+
+	// a forgery does not consume the packet number
+	buffer := listener.pool.get()
+	buffer.uz = uint32(copy(buffer.data, sealed))
+	assert.NoError(t, listener.open(buffer))
+
+	// replay
+	buffer.uz = uint32(copy(buffer.data, sealed))
+	assert.Error(t, listener.open(buffer))
+}
+
+func TestSealerRekey(t *testing.T) {
+	dialer, listener := newTestSealerPair(t, "aes-gcm")
+	dialer.profile.EncryptionRekeyMessages = 2
+
+	var sealed [][]byte
+	for i := 0; i < 12; i++ {
+		wm, err := newKeepalive(i, dialer.pool)
+		assert.NoError(t, err)
+		sealed = append(sealed, sealTestMessage(t, dialer, wm))
+	}
+	assert.Equal(t, uint8(5), dialer.txEpoch)
+
+	open := func(i int) error {
+		buffer := listener.pool.get()
+		buffer.uz = uint32(copy(buffer.data, sealed[i]))
+		if err := listener.open(buffer); err != nil {
+			return err
+		}
+		wm, err := decodeHeader(buffer)
+		assert.NoError(t, err)
+		rxPortalSz, err := wm.asKeepalive()
+		assert.NoError(t, err)
+		assert.Equal(t, i, rxPortalSz)
+		return nil
+	}
+
+	assert.NoError(t, open(0))
+	assert.NoError(t, open(3))
+	assert.Equal(t, uint8(1), listener.rxEpoch)
+
+	// reordered across the rekey
+	assert.NoError(t, open(1))
+
+	// all of epoch 2 lost
+	assert.NoError(t, open(6))
+	assert.Equal(t, uint8(3), listener.rxEpoch)
+
+	// keys older than the previous epoch are gone
+	assert.Error(t, open(2))
+	assert.NoError(t, open(7))
+
+	// too far ahead
+	listener.rxAhead = nil
+	listener.profile.EncryptionRekeyMessages = 1
+	for i := 0; i < 2*sealMaxEpochSkip; i++ {
+		wm, err := newKeepalive(i, dialer.pool)
+		assert.NoError(t, err)
+		sealed[11] = sealTestMessage(t, dialer, wm)
+	}
+	assert.Error(t, open(11))
+}
+
+func TestSealerRekeyInterval(t *testing.T) {
+	dialer, listener := newTestSealerPair(t, "chacha20poly1305")
+	clock := &testClock{t: time.Unix(1000, 0)}
+	dialer.now = clock.now
+	dialer.txEpochStart = clock.now()
+
+	wm, err := newKeepalive(0, dialer.pool)
+	assert.NoError(t, err)
+	sealTestMessage(t, dialer, wm)
+	assert.Equal(t, uint8(0), dialer.txEpoch)
+
+	clock.advance(time.Duration(dialer.profile.EncryptionRekeyMs) * time.Millisecond)
+	sealed := sealTestMessage(t, dialer, wm)
+	assert.Equal(t, uint8(1), dialer.txEpoch)
+
+	buffer := listener.pool.get()
+	buffer.uz = uint32(copy(buffer.data, sealed))
+	assert.NoError(t, listener.open(buffer))
+	assert.Equal(t, uint8(1), listener.rxEpoch)
+}
+
+func TestSealerPsk(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.Encryption = "chacha20poly1305"
+	dialer, err := newSealer("dialer", profile, NewNilInstrument().NewInstance("", nil))
+	assert.NoError(t, err)
+	lProfile := profile.clone()
+	lProfile.psk = []byte("different")
+	listener, err := newSealer("listener", lProfile, NewNilInstrument().NewInstance("", nil))
+	assert.NoError(t, err)
+	dkx := dialer.keyExchange()
+	lkx := listener.keyExchange()
+	assert.NoError(t, dialer.establish(&lkx, true))
+	assert.NoError(t, listener.establish(&dkx, false))
+
+	wm, err := newKeepalive(0, dialer.pool)
+	assert.NoError(t, err)
+	buffer := listener.pool.get()
+	buffer.uz = uint32(copy(buffer.data, sealTestMessage(t, dialer, wm)))
+	assert.Error(t, listener.open(buffer))
+}
+
+func TestReplayWindow(t *testing.T) {
+	rw := newReplayWindow(128)
+	assert.False(t, rw.check(0))
+
+	for _, pn := range []uint64{1, 2, 5, 4, 100} {
+		assert.True(t, rw.check(pn))
+		rw.accept(pn)
+		assert.False(t, rw.check(pn))
+	}
+	assert.True(t, rw.check(3))
+
+	rw.accept(300)
+	assert.False(t, rw.check(100))
+	assert.True(t, rw.check(300-128))
+	assert.False(t, rw.check(64))
+
+	// a large jump clears the whole window
+	rw.accept(10000)
+	for pn := uint64(10000 - 128); pn < 10000; pn++ {
+		assert.True(t, rw.check(pn))
+	}
+}
+
+func TestSealedConnection(t *testing.T) {
+	profileId := registerTestProfile(t)
+	GetProfile(profileId).RetxAddMs = 50
+	GetProfile(profileId).Encryption = "chacha20poly1305"
+	GetProfile(profileId).EncryptionRekeyMessages = 64
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+	assert.NotNil(t, conn.(*dialerConn).sealer)
+	assert.NotNil(t, lConn.(*listenerConn).sealer)
+
+	request := make([]byte, 256*1024)
+	for i := range request {
+		request[i] = byte(i)
+	}
+	_, err := conn.Write(request)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*dialerConn).CloseWrite())
+	rx, err := ioutil.ReadAll(lConn)
+	assert.NoError(t, err)
+	assert.Equal(t, request, rx)
+
+	_, err = lConn.Write([]byte("reply"))
+	assert.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(conn, buf, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), buf[:n])
+	assert.True(t, conn.(*dialerConn).sealer.txEpoch > 0)
+
+	// a forged close from an on-path attacker is dropped
+	forged, err := newClose(0, conn.(*dialerConn).pool)
+	assert.NoError(t, err)
+	assert.NoError(t, writeWireMessage(forged, conn.(*dialerConn).path, nil))
+	_, err = lConn.Write([]byte("still open"))
+	assert.NoError(t, err)
+	n, err = io.ReadAtLeast(conn, buf, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("still open"), buf[:n])
+}
+
+/*
+ * TestSealedSegmentSz checks that sealing and connection ids do not grow datagrams beyond the plain maximum, which
+ * MaxSegmentSz is chosen to fit in the path mtu.
+ */
+func TestSealedSegmentSz(t *testing.T) {
+	for _, connectionIds := range []bool{false, true} {
+		t.Run(fmt.Sprintf("connection_ids=%t", connectionIds), func(t *testing.T) {
+			profileId := registerTestProfile(t)
+			GetProfile(profileId).RetxAddMs = 50
+			GetProfile(profileId).Encryption = "aes-gcm"
+			GetProfile(profileId).ConnectionIds = connectionIds
+			l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+			assert.NoError(t, err)
+			defer func() { _ = l.Close() }()
+			relay := newUdpRelay(t, l.Addr().(*net.UDPAddr))
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+			conn, err := Dial(relay.addr(), profileId)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer func() { _ = conn.Close() }()
+			var lConn net.Conn
+			select {
+			case lConn = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("accept timeout")
+			}
+
+			request := make([]byte, 256*1024)
+			_, err = conn.Write(request)
+			assert.NoError(t, err)
+			_, err = io.ReadFull(lConn, request)
+			assert.NoError(t, err)
+
+			dc := conn.(*dialerConn)
+			assert.NoError(t, dc.SendDatagram(make([]byte, dc.txPortal.segmentSz())))
+			assert.Error(t, dc.SendDatagram(make([]byte, dc.txPortal.segmentSz()+1)))
+			_, err = lConn.(*listenerConn).ReceiveDatagram()
+			assert.NoError(t, err)
+
+			assert.Equal(t, int64(dataStart+dc.profile.MaxSegmentSz), atomic.LoadInt64(&relay.max))
+		})
+	}
+}
+
+func TestListenerRefuseEncryption(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	lp := NewBaselineProfile()
+	lp.Encryption = "aes-gcm"
+	lId, err := AddProfile(lp)
+	assert.NoError(t, err)
+	t.Cleanup(func() { delete(profileRegistry, lId) })
+
+	l, err := Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, lId)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	// the baseline profile is cleartext
+	_, err = Dial(l.Addr().(*net.UDPAddr), 0)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), refuseEncryption.String())
+	assert.Equal(t, 0, l.(*listener).peerCount())
+}
+
+func newTestSealerPair(t *testing.T, suite string) (dialer, listener *sealer) {
+	profile := NewBaselineProfile()
+	profile.Encryption = suite
+	ii := NewNilInstrument().NewInstance("test", nil)
+	dialer, err := newSealer("dialer", profile.clone(), ii)
+	assert.NoError(t, err)
+	listener, err = newSealer("listener", profile.clone(), ii)
+	assert.NoError(t, err)
+	dkx := dialer.keyExchange()
+	lkx := listener.keyExchange()
+	assert.NoError(t, dialer.establish(&lkx, true))
+	assert.NoError(t, listener.establish(&dkx, false))
+	return dialer, listener
+}
+
+func sealTestMessage(t *testing.T, s *sealer, wm *wireMessage) []byte {
+	sealed, err := s.seal(nil, wm.buffer.data[:wm.buffer.uz])
+	assert.NoError(t, err)
+	return sealed
+}
+
+/*
+ * udpRelay forwards datagrams between a dialer and target, recording the largest it forwards. With a limit, it silently
+ * drops any larger datagrams, like a path with that mtu.
+ */
+type udpRelay struct {
+	front  *net.UDPConn
+	back   *net.UDPConn
+	target *net.UDPAddr
+	max    int64
+	limit  int64 // 0 when unlimited
+	lock   sync.Mutex
+	dialer *net.UDPAddr
+}
+
+func newUdpRelay(t *testing.T, target *net.UDPAddr) *udpRelay {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	r := &udpRelay{front: front, back: back, target: target}
+	go r.forward(r.front, func() *net.UDPAddr { return r.target }, r.back)
+	go r.forward(r.back, r.dialerAddr, r.front)
+	t.Cleanup(func() {
+		_ = front.Close()
+		_ = back.Close()
+	})
+	return r
+}
+
+func (self *udpRelay) addr() *net.UDPAddr {
+	return self.front.LocalAddr().(*net.UDPAddr)
+}
+
+func (self *udpRelay) setLimit(limit int) {
+	atomic.StoreInt64(&self.limit, int64(limit))
+}
+
+func (self *udpRelay) dialerAddr() *net.UDPAddr {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.dialer
+}
+
+func (self *udpRelay) forward(from *net.UDPConn, to func() *net.UDPAddr, via *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := from.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if from == self.front {
+			self.lock.Lock()
+			self.dialer = peer
+			self.lock.Unlock()
+		}
+		if limit := atomic.LoadInt64(&self.limit); limit > 0 && int64(n) > limit {
+			continue
+		}
+		for max := atomic.LoadInt64(&self.max); int64(n) > max; max = atomic.LoadInt64(&self.max) {
+			if atomic.CompareAndSwapInt64(&self.max, max, int64(n)) {
+				break
+			}
+		}
+		if addr := to(); addr != nil {
+			_, _ = via.WriteToUDP(buf[:n], addr)
+		}
+	}
+}
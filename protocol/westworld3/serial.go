@@ -0,0 +1,51 @@
+package westworld3
+
+import "math"
+
+/*
+ * Sequence numbers occupy 31 bits (the high bit marks ranges in encoded acks), and wrap from seqMask to 0. They are
+ * compared with serial number arithmetic (after RFC 1982): a is before b when b is less than half of the sequence space
+ * ahead of a. Comparisons are only meaningful between sequence numbers in flight at the same time, which the portal
+ * sizes keep far below half of the space.
+ */
+const seqMask int32 = math.MaxInt32
+
+/*
+ * seqNext returns the sequence number following seq.
+ */
+func seqNext(seq int32) int32 {
+	return (seq + 1) & seqMask
+}
+
+/*
+ * seqDiff returns the signed distance from b to a.
+ */
+func seqDiff(a, b int32) int32 {
+	d := (a - b) & seqMask
+	if d > seqMask>>1 {
+		d = d - seqMask - 1
+	}
+	return d
+}
+
+/*
+ * seqLess reports whether a comes before b.
+ */
+func seqLess(a, b int32) bool {
+	return seqDiff(a, b) < 0
+}
+
+/*
+ * seqComparator orders the portals' trees by sequence number, so that iteration follows the sequence across a wrap.
+ */
+func seqComparator(a, b interface{}) int {
+	d := seqDiff(a.(int32), b.(int32))
+	switch {
+	case d < 0:
+		return -1
+	case d > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,104 @@
+package westworld3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/emirpasic/gods/trees/btree"
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSerial(t *testing.T) {
+	assert.Equal(t, int32(1), seqNext(0))
+	assert.Equal(t, int32(0), seqNext(math.MaxInt32))
+
+	assert.Equal(t, int32(1), seqDiff(0, math.MaxInt32))
+	assert.Equal(t, int32(-1), seqDiff(math.MaxInt32, 0))
+	assert.Equal(t, int32(10), seqDiff(4, math.MaxInt32-5))
+	assert.Equal(t, int32(0), seqDiff(7, 7))
+
+	assert.True(t, seqLess(math.MaxInt32, 0))
+	assert.False(t, seqLess(0, math.MaxInt32))
+	assert.True(t, seqLess(math.MaxInt32-100, 100))
+	assert.True(t, seqLess(5, 6))
+	assert.False(t, seqLess(6, 6))
+	assert.True(t, seqLess(0, 1<<30-1))
+	assert.False(t, seqLess(0, 1<<30+1))
+}
+
+func TestSerialTreeWrap(t *testing.T) {
+	tree := btree.NewWith(8, seqComparator)
+	var expected []interface{}
+	for seq := int32(math.MaxInt32 - 9); len(expected) < 20; seq = seqNext(seq) {
+		expected = append(expected, seq)
+	}
+	for _, i := range rand.Perm(len(expected)) {
+		tree.Put(expected[i], nil)
+	}
+	assert.Equal(t, expected, tree.Keys())
+}
+
+/*
+ * TestSequenceWraps transfers data in both directions across the wrap of the sequence space.
+ */
+func TestSequenceWraps(t *testing.T) {
+	profileId := registerTestProfile(t)
+	profile := GetProfile(profileId)
+	profile.RetxAddMs = 50
+	profile.TxPortalStartSz = 64 * 1024
+	profile.TxPortalMaxSz = 256 * 1024
+	profile.startSeq = seqMask - 1024
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	sz := 4 * 1024 * profile.MaxSegmentSz
+	data := make([]byte, sz)
+	rand.Read(data)
+	expected := sha256.Sum256(data)
+
+	transfer := func(from, to net.Conn) chan error {
+		errs := make(chan error, 2)
+		go func() {
+			_, err := io.Copy(from, bytes.NewReader(data))
+			errs <- err
+		}()
+		go func() {
+			h := sha256.New()
+			if _, err := io.CopyN(h, to, int64(sz)); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(expected[:], h.Sum(nil)) {
+				errs <- io.ErrUnexpectedEOF
+				return
+			}
+			errs <- nil
+		}()
+		return errs
+	}
+	dialerErrs := transfer(conn, lConn)
+	listenerErrs := transfer(lConn, conn)
+
+	timeout := time.After(60 * time.Second)
+	for _, errs := range []chan error{dialerErrs, dialerErrs, listenerErrs, listenerErrs} {
+		select {
+		case err := <-errs:
+			assert.NoError(t, err)
+		case <-timeout:
+			t.Fatal("transfer timeout")
+		}
+	}
+	// both ends wrapped
+	for _, seq := range []*util.Sequence{conn.(*dialerConn).seq, lConn.(*listenerConn).seq} {
+		next := seq.Next()
+		assert.True(t, next < profile.startSeq, "%d", next)
+	}
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, lConn.Close())
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 type traceInstrument struct {
@@ -24,7 +25,7 @@ type traceInstrumentConfig struct {
 
 type traceInstrumentInstance struct {
 	id   string
-	peer *net.UDPAddr
+	peer net.Addr
 	lock *sync.Mutex
 	i    *traceInstrument
 }
@@ -40,32 +41,56 @@ func NewTraceInstrument(config map[string]interface{}) (Instrument, error) {
 	return i, nil
 }
 
-func (self *traceInstrument) NewInstance(id string, peer *net.UDPAddr) InstrumentInstance {
+func (self *traceInstrument) NewInstance(id string, peer net.Addr) InstrumentInstance {
 	return &traceInstrumentInstance{id, peer, new(sync.Mutex), self}
 }
 
 /*
  * connection
  */
-func (self *traceInstrumentInstance) Listener(addr *net.UDPAddr) {
+func (self *traceInstrumentInstance) Listener(addr net.Addr) {
 }
 
-func (self *traceInstrumentInstance) Hello(peer *net.UDPAddr) {
+func (self *traceInstrumentInstance) Hello(peer net.Addr) {
 }
 
-func (self *traceInstrumentInstance) Connected(peer *net.UDPAddr) {
+func (self *traceInstrumentInstance) Connected(peer net.Addr) {
 }
 
-func (self *traceInstrumentInstance) ConnectionError(peer *net.UDPAddr, err error) {
+func (self *traceInstrumentInstance) ConnectionError(peer net.Addr, err error) {
 }
 
-func (self *traceInstrumentInstance) Closed(peer *net.UDPAddr) {
+func (self *traceInstrumentInstance) HelloRetry(peer net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("&& %-24s HELLO RETRY: %s", self.id, peer))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) HelloRejected(peer net.Addr, err error) {
+	if self.i.config.Error {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("&& %-24s HELLO REJECTED: %s (%v)", self.id, peer, err))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) Closed(peer net.Addr) {
+}
+
+func (self *traceInstrumentInstance) ConnectionMigrated(peer net.Addr, to net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("&& %-24s MIGRATED: %s -> %s", self.id, peer, to))
+		self.lock.Unlock()
+	}
 }
 
 /*
  * wire
  */
-func (self *traceInstrumentInstance) WireMessageTx(peer *net.UDPAddr, wm *wireMessage) {
+func (self *traceInstrumentInstance) WireMessageTx(peer net.Addr, wm *wireMessage) {
 	if self.i.config.Wire {
 		decode, _ := self.decode(wm)
 		self.lock.Lock()
@@ -74,7 +99,7 @@ func (self *traceInstrumentInstance) WireMessageTx(peer *net.UDPAddr, wm *wireMe
 	}
 }
 
-func (self *traceInstrumentInstance) WireMessageRetx(peer *net.UDPAddr, wm *wireMessage) {
+func (self *traceInstrumentInstance) WireMessageRetx(peer net.Addr, wm *wireMessage) {
 	if self.i.config.Wire {
 		decode, _ := self.decode(wm)
 		self.lock.Lock()
@@ -83,7 +108,7 @@ func (self *traceInstrumentInstance) WireMessageRetx(peer *net.UDPAddr, wm *wire
 	}
 }
 
-func (self *traceInstrumentInstance) WireMessageRx(peer *net.UDPAddr, wm *wireMessage) {
+func (self *traceInstrumentInstance) WireMessageRx(peer net.Addr, wm *wireMessage) {
 	if self.i.config.Wire {
 		decode, _ := self.decode(wm)
 		self.lock.Lock()
@@ -92,7 +117,7 @@ func (self *traceInstrumentInstance) WireMessageRx(peer *net.UDPAddr, wm *wireMe
 	}
 }
 
-func (self *traceInstrumentInstance) UnknownPeer(peer *net.UDPAddr) {
+func (self *traceInstrumentInstance) UnknownPeer(peer net.Addr) {
 	if self.i.config.Error {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("&& %-24s UNKNOWN PEER: %s", self.id, peer))
@@ -100,7 +125,7 @@ func (self *traceInstrumentInstance) UnknownPeer(peer *net.UDPAddr) {
 	}
 }
 
-func (self *traceInstrumentInstance) ReadError(peer *net.UDPAddr, err error) {
+func (self *traceInstrumentInstance) ReadError(peer net.Addr, err error) {
 	if self.i.config.Error {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("&& %-24s READ ERROR: %v", self.id, err))
@@ -108,7 +133,15 @@ func (self *traceInstrumentInstance) ReadError(peer *net.UDPAddr, err error) {
 	}
 }
 
-func (self *traceInstrumentInstance) UnexpectedMessageType(peer *net.UDPAddr, mt messageType) {
+func (self *traceInstrumentInstance) UnsealError(peer net.Addr, err error) {
+	if self.i.config.Error {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("&& %-24s UNSEAL ERROR: %v", self.id, err))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) UnexpectedMessageType(peer net.Addr, mt messageType) {
 	if self.i.config.Error {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("&& %-24s UNEXPECTED MESSAGE TYPE: %s", self.id, mt.String()))
@@ -119,7 +152,7 @@ func (self *traceInstrumentInstance) UnexpectedMessageType(peer *net.UDPAddr, mt
 /*
  * control
  */
-func (self *traceInstrumentInstance) TxAck(_ *net.UDPAddr, _ *wireMessage) {
+func (self *traceInstrumentInstance) TxAck(_ net.Addr, _ *wireMessage) {
 	if self.i.config.Control {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s TX ACK", self.id))
@@ -127,7 +160,7 @@ func (self *traceInstrumentInstance) TxAck(_ *net.UDPAddr, _ *wireMessage) {
 	}
 }
 
-func (self *traceInstrumentInstance) RxAck(_ *net.UDPAddr, _ *wireMessage) {
+func (self *traceInstrumentInstance) RxAck(_ net.Addr, _ *wireMessage) {
 	if self.i.config.Control {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s RX ACK", self.id))
@@ -135,7 +168,7 @@ func (self *traceInstrumentInstance) RxAck(_ *net.UDPAddr, _ *wireMessage) {
 	}
 }
 
-func (self *traceInstrumentInstance) TxKeepalive(_ *net.UDPAddr, _ *wireMessage) {
+func (self *traceInstrumentInstance) TxKeepalive(_ net.Addr, _ *wireMessage) {
 	if self.i.config.Control {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s TX KEEPALIVE", self.id))
@@ -143,7 +176,7 @@ func (self *traceInstrumentInstance) TxKeepalive(_ *net.UDPAddr, _ *wireMessage)
 	}
 }
 
-func (self *traceInstrumentInstance) RxKeepalive(_ *net.UDPAddr, _ *wireMessage) {
+func (self *traceInstrumentInstance) RxKeepalive(_ net.Addr, _ *wireMessage) {
 	if self.i.config.Control {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s RX KEEPALIVE", self.id))
@@ -151,10 +184,74 @@ func (self *traceInstrumentInstance) RxKeepalive(_ *net.UDPAddr, _ *wireMessage)
 	}
 }
 
+func (self *traceInstrumentInstance) TxPmtuProbe(_ net.Addr, sz int) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TX PMTU PROBE: %d", self.id, sz))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) RxPmtuProbe(_ net.Addr, sz int) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s RX PMTU PROBE: %d", self.id, sz))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TxPmtuAck(_ net.Addr, sz int) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TX PMTU ACK: %d", self.id, sz))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) RxPmtuAck(_ net.Addr, sz int) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s RX PMTU ACK: %d", self.id, sz))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TxPathChallenge(_ net.Addr, to net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TX PATH CHALLENGE TO %s", self.id, to))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) RxPathChallenge(net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s RX PATH CHALLENGE", self.id))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TxPathResponse(net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TX PATH RESPONSE", self.id))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) RxPathResponse(_ net.Addr, from net.Addr) {
+	if self.i.config.Control {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s RX PATH RESPONSE FROM %s", self.id, from))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * txPortal
  */
-func (self *traceInstrumentInstance) TxPortalCapacityChanged(peer *net.UDPAddr, capacity int) {
+func (self *traceInstrumentInstance) TxPortalCapacityChanged(peer net.Addr, capacity int) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s TX PORTAL CAPACITY: %d", self.id, capacity))
@@ -162,7 +259,7 @@ func (self *traceInstrumentInstance) TxPortalCapacityChanged(peer *net.UDPAddr,
 	}
 }
 
-func (self *traceInstrumentInstance) TxPortalSzChanged(peer *net.UDPAddr, sz int) {
+func (self *traceInstrumentInstance) TxPortalSzChanged(peer net.Addr, sz int) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s TX PORTAL SZ: %d", self.id, sz))
@@ -170,7 +267,7 @@ func (self *traceInstrumentInstance) TxPortalSzChanged(peer *net.UDPAddr, sz int
 	}
 }
 
-func (self *traceInstrumentInstance) TxPortalRxSzChanged(peer *net.UDPAddr, sz int) {
+func (self *traceInstrumentInstance) TxPortalRxSzChanged(peer net.Addr, sz int) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s TX PORTAL RX SZ: %d", self.id, sz))
@@ -178,7 +275,15 @@ func (self *traceInstrumentInstance) TxPortalRxSzChanged(peer *net.UDPAddr, sz i
 	}
 }
 
-func (self *traceInstrumentInstance) NewRetxMs(peer *net.UDPAddr, retxMs int) {
+func (self *traceInstrumentInstance) TxPortalPacingRateChanged(peer net.Addr, rate int) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TX PORTAL PACING RATE: %d", self.id, rate))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) NewRetxMs(peer net.Addr, retxMs int) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s RETX MS: %d", self.id, retxMs))
@@ -186,7 +291,7 @@ func (self *traceInstrumentInstance) NewRetxMs(peer *net.UDPAddr, retxMs int) {
 	}
 }
 
-func (self *traceInstrumentInstance) NewRetxScale(_ *net.UDPAddr, retxScale float64) {
+func (self *traceInstrumentInstance) NewRetxScale(_ net.Addr, retxScale float64) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s RETX SCALE: %0.2f", self.id, retxScale))
@@ -194,7 +299,31 @@ func (self *traceInstrumentInstance) NewRetxScale(_ *net.UDPAddr, retxScale floa
 	}
 }
 
-func (self *traceInstrumentInstance) DuplicateAck(peer *net.UDPAddr, seq int32) {
+func (self *traceInstrumentInstance) NewRttEstimate(_ net.Addr, srtt, rttvar time.Duration) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s RTT ESTIMATE: srtt %v rttvar %v", self.id, srtt, rttvar))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) PathMtuChanged(_ net.Addr, mtu int) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s PATH MTU: %d", self.id, mtu))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) PathMtuBlackHole(net.Addr) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s PATH MTU BLACK HOLE", self.id))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) DuplicateAck(peer net.Addr, seq int32) {
 	if self.i.config.TxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s DUPLICATE ACK: #%d", self.id, seq))
@@ -202,10 +331,26 @@ func (self *traceInstrumentInstance) DuplicateAck(peer *net.UDPAddr, seq int32)
 	}
 }
 
+func (self *traceInstrumentInstance) FastRetx(peer net.Addr, wm *wireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s FAST RETX: #%d", self.id, wm.seq))
+		self.lock.Unlock()
+	}
+}
+
+func (self *traceInstrumentInstance) TimedRetx(peer net.Addr, wm *wireMessage) {
+	if self.i.config.TxPortal {
+		self.lock.Lock()
+		fmt.Println(fmt.Sprintf("!! %-24s TIMED RETX: #%d", self.id, wm.seq))
+		self.lock.Unlock()
+	}
+}
+
 /*
  * rxPortal
  */
-func (self *traceInstrumentInstance) RxPortalSzChanged(peer *net.UDPAddr, sz int) {
+func (self *traceInstrumentInstance) RxPortalSzChanged(peer net.Addr, sz int) {
 	if self.i.config.RxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s RX PORTAL SZ: %d", self.id, sz))
@@ -213,7 +358,7 @@ func (self *traceInstrumentInstance) RxPortalSzChanged(peer *net.UDPAddr, sz int
 	}
 }
 
-func (self *traceInstrumentInstance) DuplicateRx(peer *net.UDPAddr, wm *wireMessage) {
+func (self *traceInstrumentInstance) DuplicateRx(peer net.Addr, wm *wireMessage) {
 	if self.i.config.RxPortal {
 		self.lock.Lock()
 		fmt.Println(fmt.Sprintf("!! %-24s DUPLICATE RX: #%d", self.id, wm.seq))
@@ -244,7 +389,14 @@ func (self *traceInstrumentInstance) decode(wm *wireMessage) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		return fmt.Sprintf("{v:%d, p:%d} |%s|", h.version, h.profile, self.decodeAcks(acks)), nil
+		return fmt.Sprintf("{v:%d, p:%d, mss:%d} |%s|", h.version, h.profile, h.maxSegmentSz, self.decodeAcks(acks)), nil
+
+	case REFUSE:
+		reason, err := wm.asRefuse()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("{%s}", reason), nil
 
 	case ACK:
 		a, rxPortalSz, _, err := wm.asAck()
@@ -258,6 +410,13 @@ func (self *traceInstrumentInstance) decode(wm *wireMessage) (string, error) {
 		if err != nil {
 			return "", err
 		}
+		if wm.hasFlag(INLINE_ACK) {
+			_, _, a, rxPortalSz, err := wm.asData()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf(":%d |%s| %%%d", sz, self.decodeAcks(a), rxPortalSz), nil
+		}
 		return fmt.Sprintf(":%d", sz), nil
 
 	default:
@@ -2,68 +2,100 @@ package westworld3
 
 import (
 	"github.com/emirpasic/gods/trees/btree"
-	"github.com/emirpasic/gods/utils"
 	"github.com/openziti/dilithium/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io"
 	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
+var ErrDatagramDropped = errors.New("datagram dropped by congestion control")
+
 type txPortal struct {
 	lock              *sync.Mutex
 	tree              *btree.Tree
-	capacity          int
+	cc                CongestionController
+	pacer             CongestionPacer
+	window            CongestionWindow
+	pacingRate        int
+	nextTx            time.Time
+	lastPaced         time.Time
+	pacingSlept       bool // slept for the pacing schedule since lastPaced
 	ready             *sync.Cond
 	txPortalSz        int
 	rxPortalSz        int
-	successCt         int
-	successAccum      int
 	dupAckCt          int
-	retxCt            int
-	startRetxScale    float64
 	lastRetxScaleIncr time.Time
 	lastRetxScaleDecr time.Time
 	lastRttProbe      time.Time
+	rttClock          *rttClock
+	rttWide           bool   // negotiated in hello
+	pmtud             *pmtud // nil without PmtuDiscovery
 	lastTx            time.Time
+	highestTx         int32 // highest sequence placed in the tree
+	fastRetxHigh      int32 // highest sequence fast retransmitted, while fastRetxSent
+	fastRetxSent      bool
+	writeDeadline     time.Time
+	deadlineTimer     *time.Timer
 	monitor           *retxMonitor
+	rxPortal          *rxPortal
 	closer            *closer
+	finSent           bool
 	closeSent         bool
 	closed            bool
-	conn              *net.UDPConn
-	peer              *net.UDPAddr
+	path              *path
+	peer              net.Addr
+	sealer            *sealer
 	pool              *pool
 	profile           *Profile
 	ii                InstrumentInstance
 }
 
-func newTxPortal(conn *net.UDPConn, peer *net.UDPAddr, closer *closer, profile *Profile, pool *pool, ii InstrumentInstance) *txPortal {
+func newTxPortal(path *path, peer net.Addr, closer *closer, profile *Profile, pool *pool, ii InstrumentInstance) *txPortal {
+	cc, err := newCongestionController(profile.CongestionController, profile, peer, ii)
+	if err != nil {
+		logrus.Errorf("falling back to baseline congestion controller (%v)", err)
+		cc = newBaselineCongestionController(profile, peer, ii)
+	}
 	p := &txPortal{
 		lock:              new(sync.Mutex),
-		tree:              btree.NewWith(profile.TxPortalTreeLen, utils.Int32Comparator),
-		capacity:          profile.TxPortalStartSz,
-		startRetxScale:    profile.RetxScale,
+		tree:              btree.NewWith(profile.TxPortalTreeLen, seqComparator),
+		cc:                cc,
 		lastRetxScaleIncr: time.Now(),
 		lastRetxScaleDecr: time.Now(),
 		rxPortalSz:        -1,
+		rttClock:          newRttClock(),
 		closer:            closer,
 		closed:            false,
-		conn:              conn,
+		path:              path,
 		peer:              peer,
 		pool:              pool,
 		profile:           profile,
 		ii:                ii,
 	}
+	p.pacer, _ = cc.(CongestionPacer)
+	p.window, _ = cc.(CongestionWindow)
 	p.ready = sync.NewCond(p.lock)
-	p.monitor = newRetxMonitor(p.profile, p.conn, p.peer, p.lock, p.ii)
+	p.monitor = newRetxMonitor(p.profile, p.path, p.peer, p.lock, p.ii)
 	p.monitor.setRetxF(p.retx)
+	p.monitor.rttClock = p.rttClock
+	p.monitor.pool = p.pool
 	return p
 }
 
 func (self *txPortal) start() {
+	if self.profile.PmtuDiscovery {
+		// segment size is agreed, and the sealer established, during hello
+		self.lock.Lock()
+		self.pmtud = newPmtud(self.profile, self.overhead(), self.peer, self.ii)
+		self.monitor.pmtud = self.pmtud
+		self.lock.Unlock()
+		go self.pmtuProber()
+	}
 	self.monitor.start()
 	if self.profile.SendKeepalive {
 		go self.keepaliveSender()
@@ -77,38 +109,83 @@ func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 	if self.closed {
 		return -1, io.EOF
 	}
+	if self.finSent {
+		return 0, io.ErrClosedPipe
+	}
+	if self.writeDeadlineExceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
 
 	remaining := len(p)
 	n = 0
 	for remaining > 0 {
-		segmentSz := int(math.Min(float64(remaining), float64(self.profile.MaxSegmentSz)))
+		maxSegmentSz := self.segmentSz()
+		segmentSz := int(math.Min(float64(remaining), float64(maxSegmentSz)))
+
+		probe := time.Since(self.lastRttProbe).Milliseconds() > int64(self.profile.RttProbeMs)
+		probeSz := 0
+		if probe {
+			probeSz = int(rttProbe{wide: self.rttWide}.sz())
+			if segmentSz > maxSegmentSz-probeSz {
+				segmentSz = maxSegmentSz - probeSz
+			}
+		}
+
+		for !self.closed && !self.finSent && !self.writeDeadlineExceeded() {
+			if self.cc.Available(self.txPortalSz, segmentSz) < 0 {
+				self.ready.Wait()
+				continue
+			}
+			if delay := self.pacingDelay(); delay > 0 {
+				self.lock.Unlock()
+				time.Sleep(delay)
+				self.lock.Lock()
+				self.pacingSlept = true
+				continue
+			}
+			break
+		}
+		if self.closed {
+			return n, io.EOF
+		}
+		if self.finSent {
+			return n, io.ErrClosedPipe
+		}
+		if self.writeDeadlineExceeded() {
+			return n, os.ErrDeadlineExceeded
+		}
 
-		var rtt *uint16
-		if time.Since(self.lastRttProbe).Milliseconds() > int64(self.profile.RttProbeMs) {
+		var rtt *rttProbe
+		if probe {
+			// stamp the probe after waiting for capacity and pacing, so the wait is not measured as rtt
 			now := time.Now()
-			rtt = new(uint16)
-			*rtt = uint16(now.UnixNano() / int64(time.Millisecond))
-			segmentSz -= 2
+			rtt = self.rttClock.probe(self.rttWide, now)
 			self.lastRttProbe = now
 		}
 
-		for self.availableCapacity(segmentSz) < 0 {
-			self.ready.Wait()
+		acks, rxPortalSz := self.rxPortal.takeAcks(self.profile.MaxInlineAcks)
+		if len(acks) > 0 {
+			headerSz := int(encodedAcksSz(acks)) + 4 + probeSz
+			if segmentSz+headerSz > maxSegmentSz {
+				segmentSz = maxSegmentSz - headerSz
+			}
 		}
 
-		wm, err := newData(seq.Next(), rtt, p[n:n+segmentSz], self.pool)
+		wm, err := newData(seq.Next(), rtt, acks, rxPortalSz, p[n:n+segmentSz], self.pool)
 		if err != nil {
 			return 0, errors.Wrap(err, "new data")
 		}
 		self.tree.Put(wm.seq, wm)
+		self.highestTx = wm.seq
 		self.txPortalSz += segmentSz
 		self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
 
-		if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
+		if err := writeWireMessage(wm, self.path, self.sealer); err != nil {
 			return 0, errors.Wrap(err, "tx")
 		}
 		self.ii.WireMessageTx(self.peer, wm)
 		self.lastTx = time.Now()
+		self.paced(segmentSz)
 
 		self.monitor.add(wm)
 
@@ -119,17 +196,99 @@ func (self *txPortal) tx(p []byte, seq *util.Sequence) (n int, err error) {
 	return n, nil
 }
 
+/*
+ * sendDatagram transmits p as a single unreliable datagram. Datagrams are paced along with the stream, but are not
+ * tracked for acknowledgement or retransmission. When the congestion window is full the datagram is dropped, rather
+ * than delayed, and ErrDatagramDropped is returned.
+ *
+ * Datagrams are never acknowledged, so a datagram's bytes count against the window for about one rtt (the time an ack
+ * would take to release them) and are then released.
+ */
+func (self *txPortal) sendDatagram(p []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if segmentSz := self.segmentSz(); len(p) > segmentSz {
+		return errors.Errorf("datagram too large [%d > %d]", len(p), segmentSz)
+	}
+	for !self.closed && !self.writeDeadlineExceeded() {
+		delay := self.pacingDelay()
+		if delay <= 0 {
+			break
+		}
+		self.lock.Unlock()
+		time.Sleep(delay)
+		self.lock.Lock()
+		self.pacingSlept = true
+	}
+	if self.closed {
+		return io.EOF
+	}
+	if self.writeDeadlineExceeded() {
+		return os.ErrDeadlineExceeded
+	}
+	if self.cc.Available(self.txPortalSz, len(p)) < 0 {
+		return ErrDatagramDropped
+	}
+
+	wm, err := newDatagram(p, self.pool)
+	if err != nil {
+		return errors.Wrap(err, "new datagram")
+	}
+	defer wm.buffer.unref()
+	if err := writeWireMessage(wm, self.path, self.sealer); err != nil {
+		return errors.Wrap(err, "tx datagram")
+	}
+	self.ii.WireMessageTx(self.peer, wm)
+	self.lastTx = time.Now()
+	self.paced(len(p))
+
+	self.txPortalSz += len(p)
+	self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
+	time.AfterFunc(self.datagramHold(), func() { self.releaseDatagram(len(p)) })
+
+	return nil
+}
+
+/*
+ * datagramHold is how long a datagram's bytes count against the window: the averaged rtt, at least a millisecond, or
+ * RetxStartMs before the rtt is known.
+ */
+func (self *txPortal) datagramHold() time.Duration {
+	if self.monitor.rtt < 0 {
+		return time.Duration(self.profile.RetxStartMs) * time.Millisecond
+	}
+	if self.monitor.rtt < time.Millisecond {
+		return time.Millisecond
+	}
+	return self.monitor.rtt
+}
+
+func (self *txPortal) releaseDatagram(sz int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.txPortalSz -= sz
+	self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
+	self.ready.Broadcast()
+}
+
 func (self *txPortal) ack(acks []ack) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
 	lastTxPortalSz := self.txPortalSz
+	var acked []int32
 	for _, ack := range acks {
-		for seq := ack.start; seq <= ack.end; seq++ {
+		if seqLess(ack.end, ack.start) {
+			logrus.Warnf("ignoring inverted ack range [%d:%d]", ack.start, ack.end)
+			continue
+		}
+		for seq := ack.start; ; seq = seqNext(seq) {
 			if v, found := self.tree.Get(seq); found {
 				wm := v.(*wireMessage)
 				self.monitor.remove(wm)
 				self.tree.Remove(seq)
+				acked = append(acked, seq)
 				switch wm.messageType() {
 				case DATA:
 					sz, err := wm.asDataSize()
@@ -138,10 +297,10 @@ func (self *txPortal) ack(acks []ack) error {
 					}
 					self.txPortalSz -= int(sz)
 					self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
-					self.successfulAck(int(sz))
+					self.cc.Ack(int(sz))
 
 				case CLOSE:
-					self.successfulAck(0)
+					self.cc.Ack(0)
 
 				default:
 					logrus.Warnf("acked suspicious message type in tree [%d]", wm.messageType())
@@ -151,6 +310,9 @@ func (self *txPortal) ack(acks []ack) error {
 			} else {
 				self.duplicateAck(seq)
 			}
+			if seq == ack.end {
+				break
+			}
 		}
 	}
 
@@ -158,12 +320,20 @@ func (self *txPortal) ack(acks []ack) error {
 		self.ii.TxPortalSzChanged(self.peer, self.txPortalSz)
 	}
 
+	if self.profile.TxPortalFastRetxThresh > 0 && len(acked) > 0 {
+		self.fastRetx()
+	}
+
+	if self.pmtud != nil && len(acked) > 0 {
+		self.pmtud.acked()
+	}
+
 	if time.Since(self.lastRetxScaleDecr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
-		self.profile.RetxScale -= self.profile.RetxEvaluationScaleDecr
-		if self.profile.RetxScale < self.profile.RetxScaleFloor {
-			self.profile.RetxScale = self.profile.RetxScaleFloor
+		self.monitor.retxScale -= self.profile.RetxEvaluationScaleDecr
+		if self.monitor.retxScale < self.profile.RetxScaleFloor {
+			self.monitor.retxScale = self.profile.RetxScaleFloor
 		}
-		self.ii.NewRetxScale(self.peer, self.profile.RetxScale)
+		self.ii.NewRetxScale(self.peer, self.monitor.retxScale)
 		self.lastRetxScaleDecr = time.Now()
 	}
 
@@ -175,19 +345,112 @@ func (self *txPortal) updateRxPortalSz(rxPortalSz int) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 	self.rxPortalSz = rxPortalSz
+	self.cc.RxPortalSz(rxPortalSz)
 	self.ready.Broadcast()
 	self.ii.TxPortalRxSzChanged(self.peer, rxPortalSz)
 }
 
-func (self *txPortal) rtt(probeTs uint16) {
-	now := time.Now().UnixNano()
+func (self *txPortal) rtt(probe rttProbe) {
+	rtt := self.rttClock.rtt(probe, time.Now())
 	self.lock.Lock()
-	clockTs := uint16(now / int64(time.Millisecond))
-	rttMs := clockTs - probeTs
-	self.monitor.updateRttMs(rttMs)
+	self.monitor.updateRtt(rtt)
+	self.cc.Rtt(rtt)
 	self.lock.Unlock()
 }
 
+/*
+ * helloRtt seeds the smoothed rtt from the hello exchange, so that the first window can be paced before any rtt probe
+ * returns. Only an unambiguous exchange (no hello retransmission) should be reported.
+ */
+func (self *txPortal) helloRtt(rtt time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.monitor.rtt < 0 {
+		self.monitor.rtt = rtt
+	}
+}
+
+/*
+ * segmentSz returns the largest segment to transmit: what the discovered path mtu allows for, or MaxSegmentSz. Segments
+ * leave room for the seal and connection id, so that datagrams are no larger than a plain DATA message's.
+ */
+func (self *txPortal) segmentSz() int {
+	if self.pmtud != nil {
+		return self.pmtud.segmentSz
+	}
+	return self.profile.MaxSegmentSz - (self.overhead() - dataStart)
+}
+
+/*
+ * overhead is the wire bytes around each segment: the header, and the seal and connection id when used.
+ */
+func (self *txPortal) overhead() int {
+	overhead := dataStart
+	if self.sealer != nil {
+		overhead += sealOverhead
+	}
+	if self.path.cid != 0 {
+		overhead += connectionIdSz
+	}
+	return overhead
+}
+
+func (self *txPortal) setWriteDeadline(t time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.writeDeadline = t
+	if self.deadlineTimer != nil {
+		self.deadlineTimer.Stop()
+		self.deadlineTimer = nil
+	}
+	if !t.IsZero() {
+		self.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+			self.lock.Lock()
+			self.ready.Broadcast()
+			self.lock.Unlock()
+		})
+	}
+	self.ready.Broadcast()
+}
+
+func (self *txPortal) writeDeadlineExceeded() bool {
+	return !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline)
+}
+
+/*
+ * sendFin ends the outgoing stream, leaving the incoming stream open. Writes blocked in tx, and any later writes, fail
+ * with io.ErrClosedPipe.
+ */
+func (self *txPortal) sendFin(seq *util.Sequence) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed || self.closeSent {
+		return io.EOF
+	}
+	if !self.finSent {
+		wm, err := newFin(seq.Next(), self.pool)
+		if err != nil {
+			return errors.Wrap(err, "fin")
+		}
+		self.tree.Put(wm.seq, wm)
+		self.highestTx = wm.seq
+		self.monitor.add(wm)
+
+		if err := writeWireMessage(wm, self.path, self.sealer); err != nil {
+			return errors.Wrap(err, "tx fin")
+		}
+		self.ii.WireMessageTx(self.peer, wm)
+		self.lastTx = time.Now()
+
+		self.finSent = true
+		self.ready.Broadcast()
+	}
+
+	return nil
+}
+
 func (self *txPortal) sendClose(seq *util.Sequence) error {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -198,9 +461,10 @@ func (self *txPortal) sendClose(seq *util.Sequence) error {
 			return errors.Wrap(err, "close")
 		}
 		self.tree.Put(wm.seq, wm)
+		self.highestTx = wm.seq
 		self.monitor.add(wm)
 
-		if err := writeWireMessage(wm, self.conn, self.peer); err != nil {
+		if err := writeWireMessage(wm, self.path, self.sealer); err != nil {
 			return errors.Wrap(err, "tx close")
 		}
 		self.closer.txCloseSeqIn <- wm.seq
@@ -213,71 +477,135 @@ func (self *txPortal) sendClose(seq *util.Sequence) error {
 }
 
 func (self *txPortal) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	self.closed = true
+	self.ready.Broadcast()
 	self.monitor.closed = true
 	self.monitor.ready.Broadcast()
 }
 
-func (self *txPortal) successfulAck(sz int) {
-	self.successCt++
-	self.successAccum += sz
-	if self.successCt == self.profile.TxPortalIncreaseThresh {
-		newCapacity := self.capacity + int(float64(self.successAccum)*self.profile.TxPortalIncreaseScale)
-		self.updatePortalCapacity(newCapacity)
-		self.successCt = 0
-		self.successAccum = 0
-	}
+func (self *txPortal) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
 }
 
 func (self *txPortal) duplicateAck(seq int32) {
+	self.cc.DuplicateAck()
+
+	// #93: Self-Adjusting retxMs
 	self.dupAckCt++
-	self.successCt = 0
 	if self.dupAckCt >= self.profile.TxPortalDupAckThresh {
-		newCapacity := int(float64(self.capacity) * self.profile.TxPortalDupAckCapacityScale)
-
-		// #93: Self-Adjusting retxMs
 		if time.Since(self.lastRetxScaleIncr).Milliseconds() > int64(self.profile.RetxEvaluationMs) {
-			self.profile.RetxScale += self.profile.RetxEvaluationScaleIncr
+			self.monitor.retxScale += self.profile.RetxEvaluationScaleIncr
 			self.lastRetxScaleIncr = time.Now()
-			self.ii.NewRetxScale(self.peer, self.profile.RetxScale)
+			self.ii.NewRetxScale(self.peer, self.monitor.retxScale)
 		}
-
-		self.updatePortalCapacity(newCapacity)
 		self.dupAckCt = 0
-		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalDupAckSuccessScale)
 	}
 	self.ii.DuplicateAck(self.peer, seq)
 }
 
 func (self *txPortal) retx() {
-	self.retxCt++
-	self.successCt = 0
-	if self.retxCt >= self.profile.TxPortalRetxThresh {
-		newCapacity := int(float64(self.capacity) * self.profile.TxPortalRetxCapacityScale)
-		self.updatePortalCapacity(newCapacity)
-		self.retxCt = 0
-		self.successAccum = int(float64(self.successAccum) * self.profile.TxPortalRetxSuccessScale)
+	self.cc.Retx()
+}
+
+/*
+ * fastRetx presumes an unacknowledged message lost once TxPortalFastRetxThresh later sequences have been acknowledged,
+ * and retransmits it immediately, rather than waiting for its retxMonitor deadline. Every sequence from the start of the
+ * tree through highestTx passed through the tree, so the acknowledged sequences after the k-th message still in the tree
+ * are its distance to highestTx less the messages after it. That count never grows along the tree, so the walk stops at
+ * the first message short of the threshold. Messages are fast retransmitted in order, and each at most once.
+ */
+func (self *txPortal) fastRetx() {
+	sz := self.tree.Size()
+	it := self.tree.Iterator()
+	if !it.First() {
+		self.fastRetxSent = false
+		return
+	}
+	if self.fastRetxSent && seqLess(self.fastRetxHigh, it.Key().(int32)) {
+		self.fastRetxSent = false
+	}
+	it.Begin()
+	for k := 0; it.Next(); k++ {
+		seq := it.Key().(int32)
+		if self.fastRetxSent && !seqLess(self.fastRetxHigh, seq) {
+			continue
+		}
+		if int(seqDiff(self.highestTx, seq))-(sz-k-1) < self.profile.TxPortalFastRetxThresh {
+			break
+		}
+		self.monitor.fastRetx(it.Value().(*wireMessage))
+		self.fastRetxHigh = seq
+		self.fastRetxSent = true
 	}
 }
 
-func (self *txPortal) updatePortalCapacity(newCapacity int) {
-	oldCapacity := self.capacity
-	self.capacity = newCapacity
-	if self.capacity < self.profile.TxPortalMinSz {
-		self.capacity = self.profile.TxPortalMinSz
+/*
+ * pacingDelay returns how long the txPortal should wait before transmitting the next segment, when transmission is
+ * paced. Delays shorter than pacingQuantum are ignored, allowing small bursts instead of sleeping for every segment.
+ */
+func (self *txPortal) pacingDelay() time.Duration {
+	if self.nextTx.IsZero() {
+		return 0
 	}
-	if self.capacity > self.profile.TxPortalMaxSz {
-		self.capacity = self.profile.TxPortalMaxSz
+	delay := time.Until(self.nextTx)
+	if delay < pacingQuantum {
+		return 0
 	}
-	if self.capacity != oldCapacity {
-		self.ii.TxPortalCapacityChanged(self.peer, self.capacity)
+	if !self.writeDeadline.IsZero() {
+		if untilDeadline := time.Until(self.writeDeadline); untilDeadline < delay {
+			delay = untilDeadline
+		}
 	}
+	return delay
 }
 
-func (self *txPortal) availableCapacity(segmentSz int) int {
-	txPortalCapacity := float64(self.capacity - int(float64(self.rxPortalSz)*self.profile.TxPortalRxSzPressureScale) - (self.txPortalSz + segmentSz))
-	rxPortalCapacity := float64(self.capacity - (self.rxPortalSz + segmentSz))
-	return int(math.Min(txPortalCapacity, rxPortalCapacity))
+func (self *txPortal) paced(sz int) {
+	rate := self.currentPacingRate()
+	if rate != self.pacingRate {
+		self.pacingRate = rate
+		self.ii.TxPortalPacingRateChanged(self.peer, rate)
+	}
+	if rate <= 0 {
+		self.nextTx = time.Time{}
+		return
+	}
+	// a sender which fell behind its schedule while sleeping for it overslept, and catches up (up to pacingMaxDebt); a
+	// sender which went quiet on its own was idle, and restarts its schedule now rather than bursting through the idle
+	// time
+	now := time.Now()
+	idle := !self.pacingSlept && now.Sub(self.lastPaced) > pacingQuantum
+	behind := now.Sub(self.nextTx)
+	if self.nextTx.IsZero() || (idle && behind > 0) || behind > pacingMaxDebt {
+		self.nextTx = now
+	}
+	self.lastPaced = now
+	self.pacingSlept = false
+	self.nextTx = self.nextTx.Add(time.Duration(int64(sz) * int64(time.Second) / int64(rate)))
+}
+
+/*
+ * currentPacingRate returns the sending rate in bytes per second, or 0 when unpaced. Congestion controllers which pace
+ * set their own rate. Otherwise, with TxPortalPacing, the window of a CongestionWindow is spread across the smoothed rtt
+ * (scaled by TxPortalPacingGain, so pacing does not itself limit the window), once the rtt has been measured. An rtt
+ * shorter than pacingQuantum is taken as one, as the pacer cannot sleep for less.
+ */
+func (self *txPortal) currentPacingRate() int {
+	if self.pacer != nil {
+		return self.pacer.PacingRate()
+	}
+	if !self.profile.TxPortalPacing || self.window == nil || self.monitor.rtt < 0 {
+		return 0
+	}
+	rtt := self.monitor.rtt
+	if rtt < pacingQuantum {
+		rtt = pacingQuantum
+	}
+	return int(self.profile.TxPortalPacingGain * float64(self.window.Capacity()) / rtt.Seconds())
 }
 
 func (self *txPortal) keepaliveSender() {
@@ -286,22 +614,153 @@ func (self *txPortal) keepaliveSender() {
 
 	for {
 		time.Sleep(1 * time.Second)
-		if self.closed {
+		if !self.sendKeepalive() {
 			return
 		}
-		if time.Since(self.lastTx).Milliseconds() > int64(self.profile.ConnectionInactiveTimeoutMs/2) {
-			keepalive, err := newKeepalive(self.rxPortalSz, self.pool)
-			if err == nil {
-				if err := writeWireMessage(keepalive, self.conn, self.peer); err == nil {
-					self.lastTx = time.Now()
+	}
+}
 
-					self.ii.WireMessageTx(self.peer, keepalive)
-					self.ii.TxKeepalive(self.peer, keepalive)
+func (self *txPortal) sendKeepalive() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-				} else {
-					logrus.Errorf("error sending keepalive (%v)", err)
-				}
+	if self.closed {
+		return false
+	}
+	if time.Since(self.lastTx).Milliseconds() > int64(self.profile.ConnectionInactiveTimeoutMs/2) {
+		keepalive, err := newKeepalive(self.rxPortalSz, self.pool)
+		if err == nil {
+			if err := writeWireMessage(keepalive, self.path, self.sealer); err == nil {
+				self.lastTx = time.Now()
+
+				self.ii.WireMessageTx(self.peer, keepalive)
+				self.ii.TxKeepalive(self.peer, keepalive)
+
+			} else {
+				logrus.Errorf("error sending keepalive (%v)", err)
 			}
 		}
 	}
+	return true
+}
+
+func (self *txPortal) pmtuProber() {
+	logrus.Info("started")
+	defer logrus.Info("exited")
+
+	for {
+		time.Sleep(time.Duration(self.profile.PmtuProbeTimeoutMs) * time.Millisecond)
+		if !self.sendPmtuProbe() {
+			return
+		}
+	}
+}
+
+func (self *txPortal) sendPmtuProbe() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return false
+	}
+	if sz := self.pmtud.nextProbe(time.Now()); sz > 0 {
+		probe, err := newPmtuProbe(sz, self.rxPortalSz, self.pool)
+		if err != nil {
+			logrus.Errorf("error creating pmtu probe (%v)", err)
+			return true
+		}
+		defer probe.buffer.unref()
+		if err := writeWireMessage(probe, self.path, self.sealer); err != nil {
+			logrus.Errorf("error sending pmtu probe (%v)", err)
+			return true
+		}
+		self.ii.WireMessageTx(self.peer, probe)
+		self.ii.TxPmtuProbe(self.peer, sz)
+	}
+	return true
+}
+
+/*
+ * pmtu handles a received PMTU_PROBE or PMTU_ACK. Probes are answered whether or not this side is discovering the path
+ * mtu itself.
+ */
+func (self *txPortal) pmtu(wm *wireMessage) {
+	sz, err := wm.asPmtu()
+	if err != nil {
+		logrus.Errorf("as pmtu error (%v)", err)
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if wm.hasFlag(PMTU_ACK) {
+		self.ii.RxPmtuAck(self.peer, sz)
+		if self.pmtud != nil {
+			self.pmtud.ack(sz)
+		}
+		return
+	}
+	self.ii.RxPmtuProbe(self.peer, sz)
+	ack, err := newPmtuAck(sz, self.rxPortalSz, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating pmtu ack (%v)", err)
+		return
+	}
+	defer ack.buffer.unref()
+	if err := writeWireMessage(ack, self.path, self.sealer); err != nil {
+		logrus.Errorf("error sending pmtu ack (%v)", err)
+		return
+	}
+	self.ii.WireMessageTx(self.peer, ack)
+	self.ii.TxPmtuAck(self.peer, sz)
+}
+
+/*
+ * pathChallenge sends a CHALLENGE along a path to a new, unvalidated address of the peer.
+ */
+func (self *txPortal) pathChallenge(token int64, path *path) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	challenge, err := newPathChallenge(token, self.rxPortalSz, self.pool)
+	if err != nil {
+		return errors.Wrap(err, "path challenge")
+	}
+	defer challenge.buffer.unref()
+	if err := writeWireMessage(challenge, path, self.sealer); err != nil {
+		return err
+	}
+	self.ii.WireMessageTx(self.peer, challenge)
+	self.ii.TxPathChallenge(self.peer, path.addr())
+	return nil
+}
+
+/*
+ * pathResponse answers a CHALLENGE from the listener, which is validating this side's new address.
+ */
+func (self *txPortal) pathResponse(wm *wireMessage) {
+	token, err := wm.asPathToken()
+	if err != nil {
+		logrus.Errorf("as path token error (%v)", err)
+		return
+	}
+	self.ii.RxPathChallenge(self.peer)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	response, err := newPathResponse(token, self.rxPortalSz, self.pool)
+	if err != nil {
+		logrus.Errorf("error creating path response (%v)", err)
+		return
+	}
+	defer response.buffer.unref()
+	if err := writeWireMessage(response, self.path, self.sealer); err != nil {
+		logrus.Errorf("error sending path response (%v)", err)
+		return
+	}
+	self.lastTx = time.Now()
+	self.ii.WireMessageTx(self.peer, response)
+	self.ii.TxPathResponse(self.peer)
 }
@@ -0,0 +1,333 @@
+package westworld3
+
+import (
+	"github.com/openziti/dilithium/util"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFastRetx(t *testing.T) {
+	ri := &recordingInstrument{}
+	txp, seq := newTestTxPortal(t, ri)
+
+	for i := 0; i < 5; i++ {
+		_, err := txp.tx([]byte{byte(i)}, seq)
+		assert.NoError(t, err)
+	}
+
+	// #0 is missing; two later acks are not yet enough to infer loss
+	assert.NoError(t, txp.ack([]ack{{1, 2}}))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&ri.fastRetxs))
+
+	// the third later ack crosses the threshold
+	assert.NoError(t, txp.ack([]ack{{3, 3}}))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ri.fastRetxs))
+
+	// only fast retransmit once
+	assert.NoError(t, txp.ack([]ack{{4, 4}}))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ri.fastRetxs))
+
+	assert.NoError(t, txp.ack([]ack{{0, 0}}))
+	assert.Equal(t, 0, txp.tree.Size())
+	assert.False(t, txp.fastRetxSent)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&ri.timedRetxs))
+}
+
+func TestFastRetxGaps(t *testing.T) {
+	ri := &recordingInstrument{}
+	txp, seq := newTestTxPortal(t, ri)
+
+	for i := 0; i < 8; i++ {
+		_, err := txp.tx([]byte{byte(i)}, seq)
+		assert.NoError(t, err)
+	}
+
+	// #0 is passed over by three acks; #4 by none yet
+	assert.NoError(t, txp.ack([]ack{{1, 3}}))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ri.fastRetxs))
+
+	// #4 crosses the threshold; #0 is not retransmitted again
+	assert.NoError(t, txp.ack([]ack{{5, 7}}))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&ri.fastRetxs))
+	assert.Equal(t, int32(4), txp.fastRetxHigh)
+
+	assert.NoError(t, txp.ack([]ack{{0, 0}, {4, 4}}))
+	assert.Equal(t, 0, txp.tree.Size())
+	assert.False(t, txp.fastRetxSent)
+}
+
+func TestFastRetxWrap(t *testing.T) {
+	ri := &recordingInstrument{}
+	txp, seq := newTestTxPortal(t, ri)
+	seq.ResetTo(math.MaxInt32 - 1)
+
+	for i := 0; i < 5; i++ {
+		_, err := txp.tx([]byte{byte(i)}, seq)
+		assert.NoError(t, err)
+	}
+
+	// #MaxInt32-1 is missing, and passed over by the acks following it across the wrap
+	assert.NoError(t, txp.ack([]ack{{math.MaxInt32, 1}}))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ri.fastRetxs))
+
+	assert.NoError(t, txp.ack([]ack{{math.MaxInt32 - 1, 2}}))
+	assert.Equal(t, 0, txp.tree.Size())
+	assert.False(t, txp.fastRetxSent)
+}
+
+func TestFastRetxDisabled(t *testing.T) {
+	ri := &recordingInstrument{}
+	txp, seq := newTestTxPortal(t, ri)
+	txp.profile.TxPortalFastRetxThresh = 0
+
+	for i := 0; i < 5; i++ {
+		_, err := txp.tx([]byte{byte(i)}, seq)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, txp.ack([]ack{{1, 4}}))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&ri.fastRetxs))
+}
+
+func TestRetxMsWakesMonitor(t *testing.T) {
+	for _, wl := range []string{"array", "heap"} {
+		t.Run(wl, func(t *testing.T) {
+			ri := &recordingInstrument{}
+			profile := NewBaselineProfile()
+			profile.RetxStartMs = 60000
+			profile.RttProbeMs = 60000
+			profile.RetxWaitlist = wl
+			profile.i = ri
+			txp, seq := newTestTxPortalProfile(t, profile)
+
+			_, err := txp.tx([]byte{0}, seq)
+			assert.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+
+			// the monitor is waiting on the original deadline, a minute out
+			txp.lock.Lock()
+			txp.monitor.setRetxMs(50)
+			txp.lock.Unlock()
+			assert.Eventually(t, func() bool { return atomic.LoadInt64(&ri.timedRetxs) > 0 }, 2*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestRetxScaleIsolation(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.RetxStartMs = 60000
+	profile.RttProbeMs = 60000
+	profile.RetxEvaluationMs = 0
+	profile.TxPortalDupAckThresh = 1
+	profile.i = NewNilInstrument()
+	startRetxScale := profile.RetxScale
+
+	lossy, _ := newTestTxPortalProfile(t, profile)
+	clean, _ := newTestTxPortalProfile(t, profile)
+
+	lossy.lock.Lock()
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond)
+		lossy.duplicateAck(0)
+	}
+	lossyRetxScale := lossy.monitor.retxScale
+	lossy.lock.Unlock()
+
+	assert.True(t, lossyRetxScale > startRetxScale)
+	clean.lock.Lock()
+	assert.Equal(t, startRetxScale, clean.monitor.retxScale)
+	clean.lock.Unlock()
+	assert.Equal(t, startRetxScale, profile.RetxScale)
+}
+
+func TestConnProfileSnapshot(t *testing.T) {
+	profileId := registerTestProfile(t)
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	registered := GetProfile(profileId)
+	assert.True(t, conn.(*dialerConn).profile != registered)
+	assert.True(t, lConn.(*listenerConn).profile != registered)
+	assert.Equal(t, *registered, *lConn.(*listenerConn).profile)
+}
+
+func TestTxPortalPacing(t *testing.T) {
+	pi := &recordingInstrument{}
+	profile := NewBaselineProfile()
+	profile.RetxStartMs = 60000
+	profile.RttProbeMs = 60000
+	profile.TxPortalPacing = true
+	profile.i = pi
+	txp, seq := newTestTxPortalProfile(t, profile)
+
+	// unpaced until the rtt is known
+	txp.lock.Lock()
+	assert.Equal(t, 0, txp.currentPacingRate())
+	txp.lock.Unlock()
+
+	txp.helloRtt(100 * time.Millisecond)
+	txp.helloRtt(time.Millisecond)
+	txp.lock.Lock()
+	assert.Equal(t, 100*time.Millisecond, txp.monitor.rtt)
+	expected := int(profile.TxPortalPacingGain * float64(profile.TxPortalStartSz) * 10)
+	assert.Equal(t, expected, txp.currentPacingRate())
+	txp.lock.Unlock()
+
+	// 64k at ~1.2MB/s is ~53ms; the first window is spaced from its first segment, without a burst
+	start := time.Now()
+	_, err := txp.tx(make([]byte, 64*1024), seq)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 45*time.Millisecond, "%v", time.Since(start))
+	assert.Equal(t, int64(expected), atomic.LoadInt64(&pi.pacingRate))
+
+	// idle time is not credited to the next window
+	txp.lock.Lock()
+	highestTx := txp.highestTx
+	txp.lock.Unlock()
+	assert.NoError(t, txp.ack([]ack{{0, highestTx}}))
+	assert.Equal(t, 0, txp.tree.Size())
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	_, err = txp.tx(make([]byte, 64*1024), seq)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 45*time.Millisecond, "%v", time.Since(start))
+}
+
+func TestTxPortalPacingOversleep(t *testing.T) {
+	profile := NewBaselineProfile()
+	profile.RetxStartMs = 60000
+	profile.RttProbeMs = 60000
+	profile.TxPortalPacing = true
+	txp, _ := newTestTxPortalProfile(t, profile)
+	txp.helloRtt(100 * time.Millisecond)
+
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	interval := time.Duration(int64(1000) * int64(time.Second) / int64(txp.currentPacingRate()))
+
+	// behind the schedule after sleeping for it; the oversleep is caught up
+	behind := time.Now().Add(-5 * time.Millisecond)
+	txp.nextTx = behind
+	txp.lastPaced = behind
+	txp.pacingSlept = true
+	txp.paced(1000)
+	assert.Equal(t, behind.Add(interval), txp.nextTx)
+
+	// behind the schedule after going quiet; the idle time is not credited
+	behind = time.Now().Add(-5 * time.Millisecond)
+	txp.nextTx = behind
+	txp.lastPaced = behind
+	txp.paced(1000)
+	assert.True(t, txp.nextTx.After(behind.Add(interval)))
+
+	// oversleeping is only caught up to pacingMaxDebt
+	behind = time.Now().Add(-2 * pacingMaxDebt)
+	txp.nextTx = behind
+	txp.pacingSlept = true
+	txp.paced(1000)
+	assert.True(t, txp.nextTx.After(behind.Add(pacingMaxDebt)))
+}
+
+func TestTxPortalPacingDisabled(t *testing.T) {
+	pi := &recordingInstrument{}
+	txp, seq := newTestTxPortal(t, pi)
+	txp.helloRtt(100 * time.Millisecond)
+
+	_, err := txp.tx(make([]byte, 64*1024), seq)
+	assert.NoError(t, err)
+	txp.lock.Lock()
+	assert.Equal(t, 0, txp.currentPacingRate())
+	assert.True(t, txp.nextTx.IsZero())
+	txp.lock.Unlock()
+	assert.Equal(t, int64(0), atomic.LoadInt64(&pi.pacingRate))
+}
+
+func TestDatagramWindow(t *testing.T) {
+	txp, _ := newTestTxPortal(t, NewNilInstrument())
+	txp.helloRtt(100 * time.Millisecond)
+
+	// datagrams fill the window like stream data, and are dropped once it is full
+	sent := 0
+	for ; sent < 1000; sent++ {
+		if err := txp.sendDatagram(make([]byte, 1000)); err != nil {
+			assert.Equal(t, ErrDatagramDropped, err)
+			break
+		}
+	}
+	assert.True(t, sent > 0)
+	assert.True(t, sent <= txp.profile.TxPortalStartSz/1000, "%d", sent)
+	txp.lock.Lock()
+	assert.Equal(t, sent*1000, txp.txPortalSz)
+	txp.lock.Unlock()
+
+	// and are released after about an rtt
+	time.Sleep(200 * time.Millisecond)
+	txp.lock.Lock()
+	assert.Equal(t, 0, txp.txPortalSz)
+	txp.lock.Unlock()
+	assert.NoError(t, txp.sendDatagram(make([]byte, 1000)))
+}
+
+func newTestTxPortal(t *testing.T, i Instrument) (*txPortal, *util.Sequence) {
+	profile := NewBaselineProfile()
+	profile.RetxStartMs = 60000
+	profile.RttProbeMs = 60000
+	profile.i = i
+	return newTestTxPortalProfile(t, profile)
+}
+
+func newTestTxPortalProfile(t *testing.T, profile *Profile) (*txPortal, *util.Sequence) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	peer := sink.LocalAddr().(*net.UDPAddr)
+
+	seq := util.NewSequence(0)
+	ii := profile.i.NewInstance("test", peer)
+	pool := newPool("test", uint32(dataStart+profile.MaxSegmentSz), ii)
+	closer := newCloser(seq, profile, nil)
+	path := newPath(conn, peer)
+	txp := newTxPortal(path, peer, closer, profile, pool, ii)
+	txp.rxPortal = newRxPortal(path, peer, txp, seq, closer, profile, ii)
+	txp.lastRttProbe = time.Now()
+	txp.start()
+
+	t.Cleanup(func() {
+		txp.close()
+		txp.rxPortal.close()
+		_ = conn.Close()
+		_ = sink.Close()
+	})
+	return txp, seq
+}
+
+func TestTxPortalPacingTransfer(t *testing.T) {
+	profileId := registerTestProfile(t)
+	profile := GetProfile(profileId)
+	profile.TxPortalPacing = true
+	profile.RetxAddMs = 50
+
+	l, conn, lConn := connectTestPair(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, profileId)
+	defer func() { _ = l.Close() }()
+
+	data := make([]byte, 4*1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() { _, _ = conn.Write(data) }()
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(lConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf)
+
+	txp := conn.(*dialerConn).txPortal
+	txp.lock.Lock()
+	defer txp.lock.Unlock()
+	assert.True(t, txp.monitor.rtt >= 0)
+	assert.True(t, txp.pacingRate > 0)
+}
@@ -1,6 +1,9 @@
 package westworld3
 
 import (
+	"container/heap"
+	"github.com/pkg/errors"
+	"sort"
 	"time"
 )
 
@@ -23,6 +26,17 @@ type waitlistSubject struct {
 	wm       *wireMessage
 }
 
+func newWaitlist(name string) (waitlist, error) {
+	switch name {
+	case "array":
+		return newArrayWaitlist(), nil
+	case "heap":
+		return newHeapWaitlist(), nil
+	default:
+		return nil, errors.Errorf("unknown waitlist '%s'", name)
+	}
+}
+
 func newArrayWaitlist() waitlist {
 	return &arrayWaitlist{}
 }
@@ -34,20 +48,24 @@ func (self *arrayWaitlist) Add(wm *wireMessage, retxMs int, t time.Time) {
 func (self *arrayWaitlist) Update(retxMs int) {
 	for _, wl := range self.waitlist {
 		delta := retxMs - wl.retxMs
-		wl.deadline.Add(time.Duration(delta) * time.Millisecond)
+		wl.deadline = wl.deadline.Add(time.Duration(delta) * time.Millisecond)
+		wl.retxMs = retxMs
 	}
+	sort.SliceStable(self.waitlist, func(i, j int) bool {
+		if self.waitlist[i].deadline.Equal(self.waitlist[j].deadline) {
+			return seqLess(self.waitlist[i].wm.seq, self.waitlist[j].wm.seq)
+		}
+		return self.waitlist[i].deadline.Before(self.waitlist[j].deadline)
+	})
 }
 
 func (self *arrayWaitlist) Remove(wm *wireMessage) {
-	i := -1
-	for i = 0; i < len(self.waitlist); i++ {
+	for i := 0; i < len(self.waitlist); i++ {
 		if self.waitlist[i].wm == wm {
-			break
+			self.waitlist = append(self.waitlist[:i], self.waitlist[i+1:]...)
+			return
 		}
 	}
-	if i > -1 {
-		self.waitlist = append(self.waitlist[:i], self.waitlist[i+1:]...)
-	}
 }
 
 func (self *arrayWaitlist) Size() int {
@@ -69,3 +87,111 @@ func (self *arrayWaitlist) Next() (*wireMessage, time.Time) {
 	self.waitlist = self.waitlist[1:]
 	return next.wm, next.deadline
 }
+
+/*
+ * heapWaitlist keeps its subjects in a priority queue ordered by deadline, with an index from message to subject, so
+ * that Add, Remove and Next are O(log n). Subjects with equal deadlines are returned in sequence order (compared
+ * serially), and otherwise in the order they were added.
+ */
+type heapWaitlist struct {
+	subjects heapWaitlistSubjects
+	index    map[*wireMessage]*heapWaitlistSubject
+	nextId   uint64
+}
+
+type heapWaitlistSubject struct {
+	waitlistSubject
+	id uint64
+	i  int
+}
+
+type heapWaitlistSubjects []*heapWaitlistSubject
+
+func newHeapWaitlist() waitlist {
+	return &heapWaitlist{index: make(map[*wireMessage]*heapWaitlistSubject)}
+}
+
+func (self *heapWaitlist) Add(wm *wireMessage, retxMs int, t time.Time) {
+	if subject, found := self.index[wm]; found {
+		subject.deadline = t
+		subject.retxMs = retxMs
+		heap.Fix(&self.subjects, subject.i)
+		return
+	}
+	subject := &heapWaitlistSubject{waitlistSubject: waitlistSubject{t, retxMs, wm}, id: self.nextId}
+	self.nextId++
+	self.index[wm] = subject
+	heap.Push(&self.subjects, subject)
+}
+
+func (self *heapWaitlist) Update(retxMs int) {
+	for _, subject := range self.subjects {
+		delta := retxMs - subject.retxMs
+		subject.deadline = subject.deadline.Add(time.Duration(delta) * time.Millisecond)
+		subject.retxMs = retxMs
+	}
+	heap.Init(&self.subjects)
+}
+
+func (self *heapWaitlist) Remove(wm *wireMessage) {
+	if subject, found := self.index[wm]; found {
+		heap.Remove(&self.subjects, subject.i)
+		delete(self.index, wm)
+	}
+}
+
+func (self *heapWaitlist) Size() int {
+	return len(self.subjects)
+}
+
+func (self *heapWaitlist) Peek() (*wireMessage, time.Time) {
+	if len(self.subjects) < 1 {
+		return nil, time.Time{}
+	}
+	return self.subjects[0].wm, self.subjects[0].deadline
+}
+
+func (self *heapWaitlist) Next() (*wireMessage, time.Time) {
+	if len(self.subjects) < 1 {
+		return nil, time.Time{}
+	}
+	next := heap.Pop(&self.subjects).(*heapWaitlistSubject)
+	delete(self.index, next.wm)
+	return next.wm, next.deadline
+}
+
+func (self heapWaitlistSubjects) Len() int {
+	return len(self)
+}
+
+func (self heapWaitlistSubjects) Less(i, j int) bool {
+	if self[i].deadline.Equal(self[j].deadline) {
+		if self[i].wm.seq != self[j].wm.seq {
+			return seqLess(self[i].wm.seq, self[j].wm.seq)
+		}
+		return self[i].id < self[j].id
+	}
+	return self[i].deadline.Before(self[j].deadline)
+}
+
+func (self heapWaitlistSubjects) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].i = i
+	self[j].i = j
+}
+
+func (self *heapWaitlistSubjects) Push(x interface{}) {
+	subject := x.(*heapWaitlistSubject)
+	subject.i = len(*self)
+	*self = append(*self, subject)
+}
+
+func (self *heapWaitlistSubjects) Pop() interface{} {
+	old := *self
+	n := len(old)
+	subject := old[n-1]
+	old[n-1] = nil
+	subject.i = -1
+	*self = old[:n-1]
+	return subject
+}
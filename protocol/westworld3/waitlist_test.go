@@ -33,6 +33,94 @@ func TestArrayWaitlist_Add_Remove(t *testing.T) {
 	assert.Equal(t, time.Time{}, deadlineOut)
 }
 
+func TestArrayWaitlist_Update(t *testing.T) {
+	testWaitlistUpdate(t, newArrayWaitlist())
+}
+
+func TestHeapWaitlist_Add_Next(t *testing.T) {
+	hw := newHeapWaitlist()
+	deadline := time.Now().Add(200 * time.Millisecond)
+	hw.Add(&wireMessage{seq: int32(99)}, 200, deadline)
+
+	wmOut, deadlineOut := hw.Next()
+	assert.NotNil(t, wmOut)
+	assert.Equal(t, int32(99), wmOut.seq)
+	assert.Equal(t, deadline, deadlineOut)
+
+	wmOut, deadlineOut = hw.Next()
+	assert.Nil(t, wmOut)
+	assert.Equal(t, time.Time{}, deadlineOut)
+}
+
+func TestHeapWaitlist_Add_Remove(t *testing.T) {
+	hw := newHeapWaitlist()
+	wm := &wireMessage{seq: int32(66)}
+	deadline := time.Now().Add(200 * time.Millisecond)
+	hw.Add(wm, 200, deadline)
+
+	hw.Remove(wm)
+	hw.Remove(wm)
+	wmOut, deadlineOut := hw.Next()
+	assert.Nil(t, wmOut)
+	assert.Equal(t, time.Time{}, deadlineOut)
+}
+
+func TestHeapWaitlist_Order(t *testing.T) {
+	hw := newHeapWaitlist()
+	now := time.Now()
+	wms := make([]*wireMessage, 0)
+	for i := 0; i < 16; i++ {
+		wms = append(wms, &wireMessage{seq: int32(i)})
+	}
+	// reverse deadlines, with pairs of equal deadlines to exercise insertion-order ties
+	for i, wm := range wms {
+		hw.Add(wm, 200, now.Add(time.Duration(16-i/2*2)*time.Millisecond))
+	}
+	hw.Remove(wms[6])
+
+	expected := []int32{14, 15, 12, 13, 10, 11, 8, 9, 7, 4, 5, 2, 3, 0, 1}
+	for _, seq := range expected {
+		wmOut, _ := hw.Next()
+		assert.Equal(t, seq, wmOut.seq)
+	}
+	assert.Equal(t, 0, hw.Size())
+}
+
+func TestHeapWaitlist_Update(t *testing.T) {
+	testWaitlistUpdate(t, newHeapWaitlist())
+}
+
+func testWaitlistUpdate(t *testing.T, wl waitlist) {
+	now := time.Now()
+	wm0 := &wireMessage{seq: int32(0)}
+	wm1 := &wireMessage{seq: int32(1)}
+	wl.Add(wm0, 100, now.Add(150*time.Millisecond))
+	wl.Add(wm1, 300, now.Add(200*time.Millisecond))
+
+	_, deadline := wl.Peek()
+	assert.Equal(t, now.Add(150*time.Millisecond), deadline)
+
+	// wm0 moves earlier by 50ms, wm1 by 250ms, reordering the waitlist
+	wl.Update(50)
+	wmOut, deadlineOut := wl.Next()
+	assert.Equal(t, wm1, wmOut)
+	assert.Equal(t, now.Add(-50*time.Millisecond), deadlineOut)
+	wmOut, deadlineOut = wl.Next()
+	assert.Equal(t, wm0, wmOut)
+	assert.Equal(t, now.Add(100*time.Millisecond), deadlineOut)
+}
+
+func TestNewWaitlist(t *testing.T) {
+	wl, err := newWaitlist("array")
+	assert.NoError(t, err)
+	assert.IsType(t, &arrayWaitlist{}, wl)
+	wl, err = newWaitlist("heap")
+	assert.NoError(t, err)
+	assert.IsType(t, &heapWaitlist{}, wl)
+	_, err = newWaitlist("wheel")
+	assert.Error(t, err)
+}
+
 func benchmarkArrayWaitlist_Add_Next(sz int, b *testing.B) {
 	toAdd := make([]*waitlistSubject, 0)
 	for i := 0; i < sz; i++ {
@@ -107,3 +195,78 @@ func BenchmarkArrayWaitlist_Add_Remove_Reverse_4096(b *testing.B) {
 func BenchmarkArrayWaitlist_Add_Remove_Reverse_16384(b *testing.B) {
 	benchmarkArrayWaitlist_Add_Remove_Reverse(16384, b)
 }
+
+func benchmarkHeapWaitlist_Add_Next(sz int, b *testing.B) {
+	toAdd := make([]*waitlistSubject, 0)
+	for i := 0; i < sz; i++ {
+		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
+	}
+	hw := newHeapWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			hw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := 0; i < sz; i++ {
+			hw.Next()
+		}
+	}
+}
+func BenchmarkHeapWaitlist_Add_Next_1024(b *testing.B)  { benchmarkHeapWaitlist_Add_Next(1024, b) }
+func BenchmarkHeapWaitlist_Add_Next_4096(b *testing.B)  { benchmarkHeapWaitlist_Add_Next(4096, b) }
+func BenchmarkHeapWaitlist_Add_Next_16384(b *testing.B) { benchmarkHeapWaitlist_Add_Next(16384, b) }
+
+func benchmarkHeapWaitlist_Add_Remove(sz int, b *testing.B) {
+	toAdd := make([]*waitlistSubject, 0)
+	for i := 0; i < sz; i++ {
+		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
+	}
+	hw := newHeapWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			hw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := 0; i < sz; i++ {
+			hw.Remove(toAdd[i].wm)
+		}
+	}
+}
+func BenchmarkHeapWaitlist_Add_Remove_1024(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove(1024, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_4096(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove(4096, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_16384(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove(16384, b)
+}
+
+func benchmarkHeapWaitlist_Add_Remove_Reverse(sz int, b *testing.B) {
+	toAdd := make([]*waitlistSubject, 0)
+	for i := 0; i < sz; i++ {
+		toAdd = append(toAdd, &waitlistSubject{time.Now().Add(200 * time.Millisecond), 200, &wireMessage{seq: int32(i)}})
+	}
+	hw := newHeapWaitlist()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < sz; i++ {
+			hw.Add(toAdd[i].wm, 200, toAdd[i].deadline)
+		}
+		for i := sz - 1; i >= 0; i-- {
+			hw.Remove(toAdd[i].wm)
+		}
+	}
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_1024(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove_Reverse(1024, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_4096(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove_Reverse(4096, b)
+}
+func BenchmarkHeapWaitlist_Add_Remove_Reverse_16384(b *testing.B) {
+	benchmarkHeapWaitlist_Add_Remove_Reverse(16384, b)
+}